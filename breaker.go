@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrBreakerOpen = errors.New("控制器连续请求失败, 暂停请求")
+
+// 熔断器状态
+const (
+	breakerClosed   = "closed"    // 正常请求
+	breakerOpen     = "open"      // 暂停请求, 直接返回错误
+	breakerHalfOpen = "half-open" // 冷却结束, 放行一个探测请求
+)
+
+// 控制器熔断器: 连续失败 breaker_threshold 次后暂停请求 breaker_cooldown 秒, 之后放行一个探测请求,
+// 探测成功则恢复, 失败则继续暂停
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+var gBreaker = &circuitBreaker{state: breakerClosed}
+
+func (b *circuitBreaker) setState(state string) {
+	if b.state != state {
+		log.Printf("熔断器状态: %s -> %s", b.state, state)
+		b.state = state
+	}
+}
+
+// 判断是否允许发起请求
+func (b *circuitBreaker) allow(now time.Time) error {
+	if gConfig.BreakerThreshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < time.Duration(gConfig.BreakerCooldown)*time.Second {
+			return ErrBreakerOpen
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		// 探测请求返回前不放行其他请求
+		if b.probing {
+			return ErrBreakerOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// 记录请求结果
+func (b *circuitBreaker) record(ok bool, now time.Time) {
+	if gConfig.BreakerThreshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= gConfig.BreakerThreshold {
+		b.openedAt = now
+		b.setState(breakerOpen)
+	}
+}
+
+// 请求超时或被取消时既不计为成功也不计为失败, 超时多半是节点测速慢而不是控制器故障
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// 经过熔断器向控制器发起请求, 只有网络错误计为失败, 收到任何响应都说明控制器可用
+func doRequest(client *http.Client, req *http.Request) (*http.Response, error) {
+	if err := gBreaker.allow(time.Now()); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if gDebug {
+		logRequest(req, resp, err, time.Since(start))
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() || req.Context().Err() != nil {
+		gBreaker.release()
+	} else {
+		gBreaker.record(err == nil, time.Now())
+	}
+	return resp, err
+}
+
+// --debug 时输出控制器请求的方法、URL、结果和耗时
+func logRequest(req *http.Request, resp *http.Response, err error, elapsed time.Duration) {
+	result := ""
+	if err != nil {
+		result = err.Error()
+	} else {
+		result = resp.Status
+	}
+	log.Printf("请求控制器: %s %s -> %s (%dms)", req.Method, redactURL(req.URL), result, elapsed.Milliseconds())
+}
+
+// 隐藏 URL 中的密码、secret/token 参数和 api_key, 密钥通常在请求头中, 这里防止出现在 URL 里时被输出
+func redactURL(u *url.URL) string {
+	redacted := *u
+	query := redacted.Query()
+	for key := range query {
+		if strings.EqualFold(key, "secret") || strings.EqualFold(key, "token") {
+			query.Set(key, "******")
+		}
+	}
+	if len(query) > 0 {
+		redacted.RawQuery = query.Encode()
+	}
+	s := redacted.Redacted()
+	if gConfig.APIKey != "" {
+		s = strings.ReplaceAll(s, gConfig.APIKey, "******")
+		s = strings.ReplaceAll(s, url.QueryEscape(gConfig.APIKey), "******")
+	}
+	return s
+}
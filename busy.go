@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// 读取连接列表计算吞吐量的间隔
+var busySampleInterval = 5 * time.Second
+
+// 控制器 /connections 返回的连接列表, 只取需要的字段
+type connectionsResponse struct {
+	Connections []struct {
+		ID       string   `json:"id"`
+		Upload   int64    `json:"upload"`
+		Download int64    `json:"download"`
+		Chains   []string `json:"chains"` // 连接经过的节点和节点组
+	} `json:"connections"`
+}
+
+// 经过节点的每个连接已传输的字节数, 按连接 id
+func fetchNodeTraffic(ctx context.Context, node string) (map[string]int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", gConfig.APIEndpoint+"/connections", nil)
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+gConfig.APIKey)
+	resp, err := doRequest(&http.Client{Timeout: 5 * time.Second}, req)
+	if err != nil {
+		return nil, fmt.Errorf("获取连接列表失败: %w: %w", ErrUnreachable, err)
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, nil); err != nil {
+		return nil, fmt.Errorf("获取连接列表失败: %w", err)
+	}
+	var result connectionsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("解析连接列表失败: %v", err)
+	}
+	traffic := make(map[string]int64)
+	for _, conn := range result.Connections {
+		if slices.Contains(conn.Chains, node) {
+			traffic[conn.ID] = conn.Upload + conn.Download
+		}
+	}
+	return traffic, nil
+}
+
+// 当前节点最近的吞吐量, 由 startBusySampler 在不持有 mu 时读取流量后持有 mu 更新
+var (
+	gBusyNode       string    // 测量的节点
+	gBusyThroughput float64   // 吞吐量(KB/s)
+	gBusySampledAt  time.Time // 测量时间
+)
+
+// 读取流量的结果, 与下一次读取比较得到吞吐量
+type trafficSample struct {
+	node    string
+	traffic map[string]int64
+	at      time.Time
+}
+
+// 读取一次经过 node 的流量, 与上一次读取同一节点的结果比较, 更新吞吐量。
+// 按每个连接传输量的增加计算, 期间新建的连接全部计入
+func (prev *trafficSample) sample(ctx context.Context, node string, now time.Time) error {
+	traffic, err := fetchNodeTraffic(ctx, node)
+	if err != nil {
+		*prev = trafficSample{}
+		return err
+	}
+	if prev.node == node && now.After(prev.at) {
+		var bytes int64
+		for id, total := range traffic {
+			bytes += total - prev.traffic[id]
+		}
+		mu.Lock()
+		gBusyNode, gBusyThroughput, gBusySampledAt = node, float64(bytes)/1024/now.Sub(prev.at).Seconds(), now
+		mu.Unlock()
+	}
+	*prev = trafficSample{node: node, traffic: traffic, at: now}
+	return nil
+}
+
+// 启用 defer_switch_when_busy 时每隔 busySampleInterval 读取一次当前节点的流量。
+// 读取时不持有 mu, 判断是否推迟切换时只使用最近的结果, 不会阻塞其他协程
+func startBusySampler() {
+	ticker := time.NewTicker(busySampleInterval)
+	defer ticker.Stop()
+	var prev trafficSample
+	for {
+		mu.Lock()
+		node := ""
+		if gCurrent != nil {
+			node = gCurrent.Name
+		}
+		mu.Unlock()
+		if node != "" {
+			if err := prev.sample(gShutdown, node, time.Now()); err != nil && gDebug {
+				log.Printf("C 读取当前节点的流量失败: %v", err)
+			}
+		}
+		select {
+		case <-gShutdown.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 启用 defer_switch_when_busy 且当前节点的吞吐量超过 busy_threshold_kbps 时推迟不紧急的切换(当前节点过慢但可用),
+// 避免中断正在进行的下载或通话, 下次检查时再决定。调用时持有 mu。
+// 没有当前节点最近的吞吐量(刚切换或读取流量失败)时不推迟
+func deferSwitchWhenBusy(prefix string) bool {
+	if !gConfig.DeferSwitchWhenBusy || gCurrent == nil {
+		return false
+	}
+	if gBusyNode != gCurrent.Name || time.Since(gBusySampledAt) > 3*busySampleInterval {
+		log.Printf("%s 没有当前节点最近的流量, 不推迟切换", prefix)
+		return false
+	}
+	if gBusyThroughput <= float64(gConfig.BusyThreshold) {
+		return false
+	}
+	log.Printf("%s 当前节点正在传输 (%.0f KB/s), 推迟切换", prefix, gBusyThroughput)
+	return true
+}
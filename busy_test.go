@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 返回连接列表的控制器, 每次请求经过节点 A 的连接增加 perCall 字节, 经过 B 的连接不变
+func newConnectionsController(t *testing.T, perCall int64) {
+	var calls atomic.Int64
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/connections" {
+			http.NotFound(w, r)
+			return
+		}
+		n := calls.Add(1)
+		fmt.Fprintf(w, `{"connections":[
+			{"id":"1","upload":100,"download":%d,"chains":["A","Proxy"]},
+			{"id":"2","upload":0,"download":999999,"chains":["B","Proxy"]}
+		]}`, n*perCall)
+	})
+	t.Cleanup(func() { gBusyNode, gBusyThroughput, gBusySampledAt = "", 0, time.Time{} })
+}
+
+func TestTrafficSample(t *testing.T) {
+	// 1 秒内增加 1000KB
+	newConnectionsController(t, 1000*1024)
+	now := time.Now()
+	var prev trafficSample
+	if err := prev.sample(t.Context(), "A", now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if gBusyNode != "" {
+		t.Errorf("throughput set after the first sample: %s %.0f", gBusyNode, gBusyThroughput)
+	}
+	if err := prev.sample(t.Context(), "A", now); err != nil {
+		t.Fatal(err)
+	}
+	if gBusyNode != "A" || gBusyThroughput != 1000 || !gBusySampledAt.Equal(now) {
+		t.Errorf("throughput = %s %.0f KB/s, want A 1000", gBusyNode, gBusyThroughput)
+	}
+	// 节点变化后重新开始, 不与其他节点的流量比较
+	if err := prev.sample(t.Context(), "B", now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if gBusyNode != "A" {
+		t.Errorf("throughput updated across nodes: %s", gBusyNode)
+	}
+}
+
+func TestDeferSwitchWhenBusy(t *testing.T) {
+	newConnectionsController(t, 0)
+	gCurrent = &ProxyNode{Name: "A"}
+	t.Cleanup(func() { gCurrent = nil })
+	gBusyNode, gBusyThroughput, gBusySampledAt = "A", 1000, time.Now()
+
+	if deferSwitchWhenBusy("D") {
+		t.Error("未启用 defer_switch_when_busy 时不应推迟")
+	}
+	gConfig.DeferSwitchWhenBusy = true
+	gConfig.BusyThreshold = 500
+	if !deferSwitchWhenBusy("D") {
+		t.Error("吞吐量超过阈值时应推迟")
+	}
+	gConfig.BusyThreshold = 5000
+	if deferSwitchWhenBusy("D") {
+		t.Error("吞吐量低于阈值时不应推迟")
+	}
+
+	// 没有当前节点最近的吞吐量时不推迟
+	gConfig.BusyThreshold = 500
+	gBusySampledAt = time.Now().Add(-time.Hour)
+	if deferSwitchWhenBusy("D") {
+		t.Error("吞吐量过旧时不应推迟")
+	}
+	gBusyNode, gBusySampledAt = "B", time.Now()
+	if deferSwitchWhenBusy("D") {
+		t.Error("吞吐量不是当前节点的时不应推迟")
+	}
+}
+
+func TestLoadConfigBusyThreshold(t *testing.T) {
+	config, err := loadConfig(writeTestConfig(t, "defer_switch_when_busy: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.DeferSwitchWhenBusy || config.BusyThreshold != 500 {
+		t.Errorf("DeferSwitchWhenBusy = %v, BusyThreshold = %d", config.DeferSwitchWhenBusy, config.BusyThreshold)
+	}
+}
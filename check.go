@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 加载并校验配置(包括环境变量覆盖), 成功时输出生效的配置, 不连接控制器。
+// api_key 只输出是否已设置
+func checkConfig(configPath string, w io.Writer) error {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	resolved := *config
+	if resolved.APIKey != "" {
+		resolved.APIKey = "******"
+	}
+	data, err := yaml.Marshal(&resolved)
+	if err != nil {
+		return fmt.Errorf("输出配置失败: %v", err)
+	}
+	w.Write(data)
+	return nil
+}
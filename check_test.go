@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	t.Setenv("AUTOCLASH_LATENCYTHRESHOLD", "300")
+	var out strings.Builder
+	if err := checkConfig(writeTestConfig(t, "api_key: secret\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "latency_threshold: 300") {
+		t.Errorf("output does not contain the environment override:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("output contains the API key:\n%s", out.String())
+	}
+
+	out.Reset()
+	err := checkConfig(writeTestConfig(t, "api_endpoint: \"\"\nclashx_config: "+t.TempDir()+"/missing.yaml\n"), &out)
+	if err == nil || !strings.Contains(err.Error(), "api_endpoint") {
+		t.Errorf("checkConfig() error = %v, want an api_endpoint error", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("output = %q, want empty on error", out.String())
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ClashX 配置文件的默认位置, 相对于用户主目录
+const defaultClashXConfig = ".config/clash/config.yaml"
+
+// 未设置 api_endpoint 时, 尽量从 ClashX 的配置文件中读取 external-controller 和 secret。
+// 文件不存在或内容不完整时跳过, 由之后的配置校验报告 api_endpoint 为空
+func discoverController(config *Config) {
+	if config.APIEndpoint != "" {
+		return
+	}
+	path := config.ClashXConfig
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return
+		}
+		path = filepath.Join(home, defaultClashXConfig)
+	} else if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return
+		}
+		path = filepath.Join(home, rest)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var clashConfig struct {
+		ExternalController string `yaml:"external-controller"`
+		Secret             string `yaml:"secret"`
+	}
+	if err := yaml.Unmarshal(data, &clashConfig); err != nil {
+		log.Printf("警告: 解析 ClashX 配置 %s 失败: %v", path, err)
+		return
+	}
+	endpoint := controllerEndpoint(clashConfig.ExternalController)
+	if endpoint == "" {
+		return
+	}
+	config.APIEndpoint = endpoint
+	if config.APIKey == "" {
+		config.APIKey = clashConfig.Secret
+	}
+	log.Printf("未设置 api_endpoint, 使用 ClashX 配置 %s 中的控制器地址: %s", path, endpoint)
+}
+
+// 将 external-controller (如 127.0.0.1:9090、:9090、0.0.0.0:9090) 转换为本机可以访问的地址
+func controllerEndpoint(controller string) string {
+	host, port, err := net.SplitHostPort(strings.TrimSpace(controller))
+	if err != nil || port == "" {
+		return ""
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
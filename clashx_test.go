@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestControllerEndpoint(t *testing.T) {
+	tests := map[string]string{
+		"127.0.0.1:9090": "http://127.0.0.1:9090",
+		":9090":          "http://127.0.0.1:9090",
+		"0.0.0.0:9090":   "http://127.0.0.1:9090",
+		"192.168.1.2:53": "http://192.168.1.2:53",
+		"[::1]:9090":     "http://[::1]:9090",
+		"":               "",
+		"127.0.0.1":      "",
+	}
+	for controller, want := range tests {
+		if got := controllerEndpoint(controller); got != want {
+			t.Errorf("controllerEndpoint(%q) = %q, want %q", controller, got, want)
+		}
+	}
+}
+
+func TestLoadConfigDiscoverClashX(t *testing.T) {
+	clashx := t.TempDir() + "/config.yaml"
+	if err := os.WriteFile(clashx, []byte("port: 7890\nexternal-controller: 127.0.0.1:9091\nsecret: from-clashx\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(writeTestConfig(t, "api_endpoint: \"\"\nclashx_config: "+clashx+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.APIEndpoint != "http://127.0.0.1:9091" || config.APIKey != "from-clashx" {
+		t.Errorf("config = %s, %s, want the ClashX controller and secret", config.APIEndpoint, config.APIKey)
+	}
+
+	// 已设置的 api_key 不被覆盖
+	config, err = loadConfig(writeTestConfig(t, "api_endpoint: \"\"\napi_key: mine\nclashx_config: "+clashx+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.APIKey != "mine" {
+		t.Errorf("APIKey = %s, want mine", config.APIKey)
+	}
+
+	// 已设置 api_endpoint 时不读取 ClashX 配置
+	config, err = loadConfig(writeTestConfig(t, "clashx_config: "+clashx+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.APIEndpoint != "http://127.0.0.1:9090" || config.APIKey != "" {
+		t.Errorf("config = %s, %s, want the configured endpoint", config.APIEndpoint, config.APIKey)
+	}
+
+	// 找不到 ClashX 配置时仍然报告 api_endpoint 为空
+	if _, err := loadConfig(writeTestConfig(t, "api_endpoint: \"\"\nclashx_config: "+t.TempDir()+"/missing.yaml\n")); err == nil {
+		t.Error("loadConfig() should fail without api_endpoint")
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 控制器 /version 返回的版本信息, 不同内核返回的字段不同
+type coreVersion struct {
+	Version string `json:"version"`
+	Meta    bool   `json:"meta"`    // Clash.Meta / mihomo
+	Premium bool   `json:"premium"` // Clash Premium
+}
+
+func (v coreVersion) String() string {
+	name := "Clash"
+	switch {
+	case v.Meta:
+		name = "Clash.Meta (mihomo)"
+	case v.Premium:
+		name = "Clash Premium"
+	}
+	if v.Version == "" {
+		return name + " (未知版本)"
+	}
+	return name + " " + v.Version
+}
+
+var detectCoreOnce sync.Once
+var meanDelayOnce sync.Once
+
+// 识别控制器内核并输出一次, 不同内核的接口略有差异, 出问题时便于排查
+func detectCore() {
+	detectCoreOnce.Do(func() {
+		version, err := fetchVersion(context.Background())
+		if err != nil {
+			log.Printf("警告: 无法识别控制器内核, 如果节点列表或测试结果异常, 请确认内核版本: %v", err)
+			return
+		}
+		log.Printf("控制器内核: %s", version)
+	})
+}
+
+// 获取控制器的版本信息
+func fetchVersion(ctx context.Context) (coreVersion, error) {
+	var version coreVersion
+	client := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, "GET", gConfig.APIEndpoint+"/version", nil)
+	if err != nil {
+		return version, fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+gConfig.APIKey)
+
+	resp, err := doRequest(client, req)
+	if err != nil {
+		return version, fmt.Errorf("获取版本失败: %w: %w", ErrUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp, nil); err != nil {
+		return version, fmt.Errorf("获取版本失败: %w", err)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return version, fmt.Errorf("解析版本失败: %v", err)
+	}
+	return version, nil
+}
+
+// 测量访问控制器 /version 的耗时(毫秒), 作为节点延迟的基准, 用于区分节点慢和控制器慢, 失败时返回 -1
+func measureControllerLatency(ctx context.Context) int {
+	start := time.Now()
+	if _, err := fetchVersion(ctx); err != nil {
+		return -1
+	}
+	return max(int(time.Since(start).Milliseconds()), 1)
+}
+
+// 解析 /proxies 的响应。逐个解析代理, 个别代理的字段格式与预期不同时跳过该代理而不是整体失败。
+// 重名的代理在 JSON 中是重复的键, 按 on_duplicate_name 处理
+func parseProxies(body []byte) (*ProxiesResponse, error) {
+	entries, err := proxyEntries(body)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string][]ProxyNode)
+	var order []string
+	for _, entry := range entries {
+		node, err := parseProxy(entry.data)
+		if err != nil {
+			log.Printf("忽略无法解析的代理 %s: %v", entry.key, err)
+			continue
+		}
+		if node.Name == "" {
+			node.Name = entry.key
+		}
+		if _, ok := byName[entry.key]; !ok {
+			order = append(order, entry.key)
+		}
+		byName[entry.key] = append(byName[entry.key], node)
+	}
+
+	proxiesResp := &ProxiesResponse{Proxies: make(map[string]ProxyNode, len(order))}
+	for _, name := range order {
+		nodes := byName[name]
+		if len(nodes) == 1 {
+			proxiesResp.Proxies[name] = nodes[0]
+			continue
+		}
+		switch gConfig.OnDuplicateName {
+		case "skip":
+			log.Printf("警告: 有 %d 个名为 %s 的节点, 无法区分, 全部排除", len(nodes), name)
+		case "first_alive":
+			kept := nodes[0]
+			for _, node := range nodes {
+				if node.Alive == nil || *node.Alive {
+					kept = node
+					break
+				}
+			}
+			proxiesResp.Proxies[name] = kept
+		default:
+			log.Printf("警告: 有 %d 个名为 %s 的节点, 测试和切换时无法区分, 只使用第一个", len(nodes), name)
+			proxiesResp.Proxies[name] = nodes[0]
+		}
+	}
+	return proxiesResp, nil
+}
+
+// ProxyNode 字段在部分内核中的别名, 标准键名为空时按顺序查找。
+// 键名匹配不区分大小写, 由 encoding/json 处理, 这里不需要列出大小写不同的写法
+var proxyFieldAliases = map[string][]string{
+	"name":  nil,
+	"type":  {"proxyType"},
+	"alive": nil,
+	"now":   {"current", "selected"},
+	"all":   {"members"},
+}
+
+// 解析单个代理。proxy_fields 中配置的键名优先, 标准键名没有值时再查找已知别名
+func parseProxy(data json.RawMessage) (ProxyNode, error) {
+	var node ProxyNode
+	if err := json.Unmarshal(data, &node); err != nil {
+		return node, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return node, err
+	}
+	targets := map[string]any{
+		"name":  &node.Name,
+		"type":  &node.Type,
+		"alive": &node.Alive,
+		"now":   &node.Now,
+		"all":   &node.All,
+	}
+	empty := map[string]bool{
+		"name":  node.Name == "",
+		"type":  node.Type == "",
+		"alive": node.Alive == nil,
+		"now":   node.Now == "",
+		"all":   node.All == nil,
+	}
+	for field, target := range targets {
+		keys := proxyFieldAliases[field]
+		if key := gConfig.ProxyFields[field]; key != "" {
+			keys = []string{key}
+		} else if !empty[field] {
+			continue
+		}
+		for _, key := range keys {
+			if raw, ok := fields[key]; ok {
+				if err := json.Unmarshal(raw, target); err != nil {
+					return node, fmt.Errorf("%s 字段 (%s) 无效: %v", field, key, err)
+				}
+				break
+			}
+		}
+	}
+	return node, nil
+}
+
+// /proxies 中的一个代理
+type proxyEntry struct {
+	key  string
+	data json.RawMessage
+}
+
+// 按出现顺序取出 proxies 对象中的所有键值, 保留重复的键
+func proxyEntries(body []byte) ([]proxyEntry, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	var entries []proxyEntry
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key != "proxies" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if token == nil { // "proxies": null
+			continue
+		}
+		if token != json.Delim('{') {
+			return nil, fmt.Errorf("proxies 应为对象, 实际为 %v", token)
+		}
+		for dec.More() {
+			name, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			var data json.RawMessage
+			if err := dec.Decode(&data); err != nil {
+				return nil, err
+			}
+			entries = append(entries, proxyEntry{key: name.(string), data: data})
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("应为 %v, 实际为 %v", delim, token)
+	}
+	return nil
+}
+
+// delay_request 可以设置的键
+var delayRequestKeys = map[string]bool{"method": true, "path": true, "body": true, "delay_field": true}
+
+func validateDelayRequest(delayRequest map[string]string) error {
+	for key := range delayRequest {
+		if !delayRequestKeys[key] {
+			return fmt.Errorf("delay_request 只能设置 method、path、body、delay_field: %s", key)
+		}
+	}
+	switch delayRequest["method"] {
+	case "", http.MethodGet, http.MethodPost, http.MethodPut:
+	default:
+		return fmt.Errorf("delay_request 的 method 只能为 GET、POST 或 PUT: %s", delayRequest["method"])
+	}
+	if path := delayRequest["path"]; path != "" && !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("delay_request 的 path 应以 / 开头: %s", path)
+	}
+	return nil
+}
+
+// 创建经节点访问 testURL 的延迟测试请求。默认为标准的 GET /proxies/{name}/delay, 设置了 delay_request 时按其中的
+// method、path 和 body 创建, 其中的 {name}、{url}、{timeout}、{expected} 替换为节点名、测试 URL、
+// 超时时间(毫秒)和测试 URL 期望的状态码, path 中的值按 URL 编码, body 中的值按 JSON 字符串转义
+func newDelayRequest(ctx context.Context, node *ProxyNode, testURL string) (*http.Request, error) {
+	values := map[string]string{
+		"name":     node.Name,
+		"url":      testURL,
+		"timeout":  strconv.Itoa(gConfig.TestTimeoutMS),
+		"expected": expectStatusFor(testURL),
+	}
+	method := cmp.Or(gConfig.DelayRequest["method"], http.MethodGet)
+	path := gConfig.DelayRequest["path"]
+	if path == "" {
+		query := url.Values{}
+		query.Set("url", values["url"])
+		query.Set("timeout", values["timeout"])
+		if values["expected"] != "" {
+			query.Set("expected", values["expected"])
+		}
+		// 节点名中常有 emoji、空格和 | 等字符, 需要编码后才能放入路径
+		path = fmt.Sprintf("/proxies/%s/delay?%s", url.PathEscape(node.Name), query.Encode())
+	} else {
+		path = expandDelayTemplate(path, values, func(v string) string {
+			return strings.ReplaceAll(url.QueryEscape(v), "+", "%20")
+		})
+	}
+	var body io.Reader
+	if tmpl := gConfig.DelayRequest["body"]; tmpl != "" {
+		body = strings.NewReader(expandDelayTemplate(tmpl, values, func(v string) string {
+			quoted, _ := json.Marshal(v)
+			return string(quoted[1 : len(quoted)-1])
+		}))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, gConfig.APIEndpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// 将模板中的 {key} 替换为 escape 后的值
+func expandDelayTemplate(tmpl string, values map[string]string, escape func(string) string) string {
+	var pairs []string
+	for key, value := range values {
+		pairs = append(pairs, "{"+key+"}", escape(value))
+	}
+	return strings.NewReplacer(pairs...).Replace(tmpl)
+}
+
+// 解析延迟测试的响应, 兼容返回 delay 或 meanDelay 的内核。
+// 设置了 delay_request 的 delay_field 时只读取该字段, 可以用 . 分隔表示嵌套的字段, 如 data.delay
+func parseDelay(body []byte) (int, error) {
+	if field := gConfig.DelayRequest["delay_field"]; field != "" {
+		return parseDelayField(body, field)
+	}
+	var result struct {
+		Delay     *int `json:"delay"`
+		MeanDelay *int `json:"meanDelay"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return -1, err
+	}
+	switch {
+	case result.Delay != nil:
+		return *result.Delay, nil
+	case result.MeanDelay != nil:
+		meanDelayOnce.Do(func() {
+			log.Printf("控制器返回的测试结果使用 meanDelay 字段, 按平均延迟处理")
+		})
+		return *result.MeanDelay, nil
+	}
+	return -1, fmt.Errorf("测试结果中没有 delay 或 meanDelay 字段: %s", body)
+}
+
+// 读取响应中 field 指定的延迟字段
+func parseDelayField(body []byte, field string) (int, error) {
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		return -1, err
+	}
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return -1, fmt.Errorf("测试结果中没有 %s 字段: %s", field, body)
+		}
+		if value, ok = object[key]; !ok {
+			return -1, fmt.Errorf("测试结果中没有 %s 字段: %s", field, body)
+		}
+	}
+	delay, ok := value.(float64)
+	if !ok {
+		return -1, fmt.Errorf("测试结果中的 %s 字段不是数字: %s", field, body)
+	}
+	return int(delay), nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestParseDelay(t *testing.T) {
+	gConfig = &Config{}
+	tests := []struct {
+		body    string
+		want    int
+		wantErr bool
+	}{
+		{`{"delay": 120}`, 120, false},
+		{`{"meanDelay": 80, "delay_history": []}`, 80, false},
+		{`{"delay": 0, "meanDelay": 80}`, 0, false},
+		{`{"message": "ok"}`, -1, true},
+		{`not json`, -1, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDelay([]byte(tt.body))
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseDelay(%s) = %d, %v, want %d, wantErr %v", tt.body, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDelayRequestExpectedPerURL(t *testing.T) {
+	gConfig = &Config{APIEndpoint: "http://127.0.0.1:9090", TestTimeoutMS: 1000, TestExpectStatus: "204", TestURLOptions: testURLOptions{
+		"https://www.netflix.com/": {ExpectStatus: "200-299"},
+	}}
+	for testURL, want := range map[string]string{
+		"https://www.netflix.com/":            "200-299",
+		"http://www.gstatic.com/generate_204": "204",
+	} {
+		req, err := newDelayRequest(context.Background(), &ProxyNode{Name: "HK 01"}, testURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := req.URL.Query().Get("expected"); got != want {
+			t.Errorf("expected for %s = %q, want %q", testURL, got, want)
+		}
+	}
+}
+
+func TestDelayRequestCustom(t *testing.T) {
+	var method, path string
+	var body map[string]any
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.RequestURI()
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"data":{"latency":42}}`))
+	})
+	gConfig.TestTimeoutMS = 3000
+	gConfig.DelayRequest = map[string]string{
+		"method":      "POST",
+		"path":        "/api/delay?node={name}",
+		"body":        `{"name":"{name}","url":"{url}","timeout":{timeout}}`,
+		"delay_field": "data.latency",
+	}
+	if err := validateDelayRequest(gConfig.DelayRequest); err != nil {
+		t.Fatal(err)
+	}
+	delay, err := controllerDelay(context.Background(), &ProxyNode{Name: `香港 01 "x"`}, gConfig.TestURL)
+	if err != nil || delay != 42 {
+		t.Fatalf("controllerDelay() = %d, %v, want 42", delay, err)
+	}
+	if method != "POST" || path != "/api/delay?node=%E9%A6%99%E6%B8%AF%2001%20%22x%22" {
+		t.Errorf("request = %s %s", method, path)
+	}
+	if body["name"] != `香港 01 "x"` || body["url"] != gConfig.TestURL || body["timeout"] != 3000.0 {
+		t.Errorf("body = %v", body)
+	}
+
+	if _, err := parseDelay([]byte(`{"data":{}}`)); err == nil {
+		t.Error("parseDelay() without the configured field should fail")
+	}
+	for _, invalid := range []map[string]string{{"verb": "POST"}, {"method": "DELETE"}, {"path": "api/delay"}} {
+		if err := validateDelayRequest(invalid); err == nil {
+			t.Errorf("validateDelayRequest(%v) should fail", invalid)
+		}
+	}
+}
+
+func TestParseProxiesTolerant(t *testing.T) {
+	gConfig = &Config{OnDuplicateName: "warn"}
+	proxiesResp, err := parseProxies([]byte(`{"proxies":{
+		"Proxy":{"name":"Proxy","type":"Selector","now":"HK 01","all":["HK 01"],"hidden":false,"icon":""},
+		"HK 01":{"type":"Shadowsocks","alive":true,"extra":{"udp":true}},
+		"HK 02":{"name":"HK 02","type":"Trojan","alive":"yes"}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proxiesResp.Proxies) != 2 {
+		t.Fatalf("parseProxies() = %+v, want the malformed proxy skipped", proxiesResp.Proxies)
+	}
+	if node := proxiesResp.Proxies["HK 01"]; node.Name != "HK 01" {
+		t.Errorf("name = %q, want it filled from the key", node.Name)
+	}
+}
+
+func TestFetchVersion(t *testing.T) {
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"meta":true,"version":"v1.18.0"}`))
+	})
+	version, err := fetchVersion(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := version.String(); got != "Clash.Meta (mihomo) v1.18.0" {
+		t.Errorf("version = %s", got)
+	}
+	if got := (coreVersion{Premium: true}).String(); got != "Clash Premium (未知版本)" {
+		t.Errorf("version = %s", got)
+	}
+}
+
+func TestMeasureControllerLatency(t *testing.T) {
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version":"v1.18.0"}`))
+	})
+	if got := measureControllerLatency(context.Background()); got < 1 {
+		t.Errorf("measureControllerLatency(context.Background()) = %d, want at least 1", got)
+	}
+
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	if got := measureControllerLatency(context.Background()); got != -1 {
+		t.Errorf("measureControllerLatency(context.Background()) = %d, want -1", got)
+	}
+}
+
+func TestParseProxiesDuplicateNames(t *testing.T) {
+	body := []byte(`{"proxies":{
+		"HK 01":{"name":"HK 01","type":"Shadowsocks","alive":false},
+		"HK 01":{"name":"HK 01","type":"Trojan","alive":true},
+		"JP 01":{"name":"JP 01","type":"Trojan","alive":true}
+	}}`)
+	tests := []struct {
+		policy   string
+		wantType string // 保留的 HK 01 的类型, 为空表示排除
+	}{
+		{"warn", "Shadowsocks"},
+		{"first_alive", "Trojan"},
+		{"skip", ""},
+	}
+	for _, tt := range tests {
+		gConfig = &Config{OnDuplicateName: tt.policy}
+		proxiesResp, err := parseProxies(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, ok := proxiesResp.Proxies["HK 01"]
+		if node.Type != tt.wantType || ok != (tt.wantType != "") {
+			t.Errorf("%s: HK 01 = %+v, %v, want type %q", tt.policy, node, ok, tt.wantType)
+		}
+		if _, ok := proxiesResp.Proxies["JP 01"]; !ok {
+			t.Errorf("%s: JP 01 missing", tt.policy)
+		}
+	}
+
+	if proxiesResp, err := parseProxies([]byte(`{"proxies":null}`)); err != nil || len(proxiesResp.Proxies) != 0 {
+		t.Errorf("parseProxies(null) = %v, %v", proxiesResp, err)
+	}
+	if _, err := parseProxies([]byte(`{"proxies":[]}`)); err == nil {
+		t.Error("parseProxies() should reject a non-object proxies field")
+	}
+}
+
+func TestParseProxyFieldNames(t *testing.T) {
+	gConfig = &Config{}
+	node, err := parseProxy([]byte(`{"name":"Proxy","proxyType":"Selector","selected":"HK 01","members":["HK 01"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Type != "Selector" || node.Now != "HK 01" || len(node.All) != 1 {
+		t.Errorf("aliases: %+v", node)
+	}
+
+	gConfig = &Config{ProxyFields: map[string]string{"name": "名称", "alive": "可用"}}
+	node, err = parseProxy([]byte(`{"name":"ignored","名称":"香港 01","type":"Trojan","可用":false}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Name != "香港 01" || node.Alive == nil || *node.Alive {
+		t.Errorf("proxy_fields: %+v", node)
+	}
+
+	if _, err := parseProxy([]byte(`{"名称":1}`)); err == nil {
+		t.Error("parseProxy() should reject a configured field with the wrong type")
+	}
+	if _, err := loadConfig(writeTestConfig(t, "proxy_fields:\n  delay: d\n")); err == nil {
+		t.Error("loadConfig() should reject unknown proxy_fields")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 延迟基线的指数加权平均系数, 越大越偏向最近的测试结果
+const baselineAlpha = 0.3
+
+// 基线至少包含几轮测试结果后才开始比较, 避免刚启动时的波动触发告警
+const baselineMinRounds = 3
+
+// 延迟增加少于该值(毫秒)时不告警, 避免延迟很低的节点小幅波动就超过百分比
+const degradeMinDelta = 30
+
+// 节点的延迟基线
+type latencyBaseline struct {
+	latency float64
+	rounds  int
+}
+
+// 每个节点的延迟基线。仅保存在内存中, 重启后清空
+var gBaselines = make(map[string]*latencyBaseline)
+
+// 已告警的节点, 恢复到基线附近之前不再重复告警; 整体的告警以空字符串表示
+var gDegraded = make(map[string]bool)
+
+// 一次延迟劣化告警, 作为 degraded 事件的内容
+type degradeAlert struct {
+	Scope    string  `json:"scope"` // node 为单个节点, pool 为本轮所有有基线的节点
+	Name     string  `json:"name,omitempty"`
+	Latency  int     `json:"latency"`
+	Baseline int     `json:"baseline"`
+	Percent  float64 `json:"percent"`            // 比基线增加的百分比, pool 时为平均延迟增加的百分比
+	Degraded int     `json:"degraded,omitempty"` // pool 时变慢的节点数
+	Nodes    int     `json:"nodes,omitempty"`    // pool 时参与比较的节点数
+}
+
+func (alert degradeAlert) String() string {
+	if alert.Scope == "pool" {
+		return fmt.Sprintf("%d/%d 个节点的延迟明显增加, 平均延迟 %dms, 比基线 %dms 增加 %.0f%%", alert.Degraded, alert.Nodes, alert.Latency, alert.Baseline, alert.Percent)
+	}
+	return fmt.Sprintf("节点 %s 的延迟 %dms, 比基线 %dms 增加 %.0f%%", alert.Name, alert.Latency, alert.Baseline, alert.Percent)
+}
+
+// 延迟是否比基线增加超过 degrade_percent, 返回增加的百分比
+func degraded(latency, baseline float64) (float64, bool) {
+	percent := (latency - baseline) / baseline * 100
+	return percent, latency-baseline >= degradeMinDelta && percent > gConfig.DegradePercent
+}
+
+// 比较本轮测试结果和每个节点的基线, 单个节点或整体的延迟明显增加时告警, 然后用本轮结果更新基线。
+// 测试失败的节点不参与比较, 不可用由检查当前节点处理。返回本轮新产生的告警
+func checkDegradation(nodes []*ProxyNode) []degradeAlert {
+	if gConfig.DegradePercent <= 0 {
+		return nil
+	}
+	var alerts []degradeAlert
+	var poolLatency, poolBaseline float64
+	compared, slower := 0, 0
+	for _, node := range nodes {
+		if node.Latency <= 0 {
+			continue
+		}
+		baseline := gBaselines[node.Name]
+		if baseline == nil {
+			baseline = &latencyBaseline{}
+			gBaselines[node.Name] = baseline
+		}
+		if baseline.rounds >= baselineMinRounds {
+			percent, ok := degraded(float64(node.Latency), baseline.latency)
+			poolLatency += float64(node.Latency)
+			poolBaseline += baseline.latency
+			compared++
+			if ok {
+				slower++
+			}
+			switch {
+			case ok && !gDegraded[node.Name]:
+				gDegraded[node.Name] = true
+				alerts = append(alerts, degradeAlert{Scope: "node", Name: node.Name, Latency: node.Latency, Baseline: int(baseline.latency), Percent: percent})
+			case !ok && gDegraded[node.Name]:
+				delete(gDegraded, node.Name)
+				log.Printf("B 节点 %s 的延迟已恢复: %dms", node.Name, node.Latency)
+			}
+		}
+		if baseline.rounds == 0 {
+			baseline.latency = float64(node.Latency)
+		} else {
+			baseline.latency = baselineAlpha*float64(node.Latency) + (1-baselineAlpha)*baseline.latency
+		}
+		baseline.rounds++
+	}
+
+	// 整体劣化: 半数以上的节点同时变慢, 通常是订阅或上游线路的问题, 单个节点变慢不算
+	if compared >= 2 {
+		latency, baseline := poolLatency/float64(compared), poolBaseline/float64(compared)
+		percent := (latency - baseline) / baseline * 100
+		ok := slower*2 > compared
+		switch {
+		case ok && !gDegraded[""]:
+			gDegraded[""] = true
+			alerts = append(alerts, degradeAlert{Scope: "pool", Latency: int(latency), Baseline: int(baseline), Percent: percent, Degraded: slower, Nodes: compared})
+		case !ok && gDegraded[""]:
+			delete(gDegraded, "")
+			log.Printf("B 整体延迟已恢复: %dms", int(latency))
+		}
+	}
+
+	for _, alert := range alerts {
+		log.Printf("B 警告: %s", alert)
+		publishEvent(EventDegraded, alert)
+	}
+	return alerts
+}
+
+// 等待发送到 degrade_webhook 的告警数, 超过时丢弃新的告警
+const degradeWebhookQueue = 16
+
+// 发送告警的最多尝试次数, 之后丢弃
+const degradeWebhookAttempts = 5
+
+// 第一次重试前的等待时间, 之后每次加倍
+var degradeWebhookBackoff = time.Second
+
+// 订阅 degraded 事件并在单独的协程中发送到 degrade_webhook, 失败时按指数退避重试。
+// 发送慢或地址不可用时不会阻塞发布事件和选择节点, 队列满时丢弃新的告警。ctx 结束时停止
+func startDegradeWebhook(ctx context.Context, webhook string) {
+	events, unsubscribe := subscribeEvents()
+	queue := make(chan Event, degradeWebhookQueue)
+	go func() {
+		defer close(queue)
+		defer unsubscribe()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-events:
+				if event.Type != EventDegraded {
+					continue
+				}
+				select {
+				case queue <- event:
+				default:
+					log.Printf("B 等待发送的告警过多, 丢弃: %s", event.Payload)
+				}
+			}
+		}
+	}()
+	go func() {
+		for event := range queue {
+			deliverDegradeWebhook(ctx, webhook, event)
+		}
+	}()
+}
+
+// 发送一条告警, 失败时重试, 超过 degradeWebhookAttempts 次后丢弃并记录日志。返回是否发送成功
+func deliverDegradeWebhook(ctx context.Context, webhook string, event Event) bool {
+	backoff := degradeWebhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := postDegradeWebhook(ctx, webhook, event)
+		if err == nil {
+			return true
+		}
+		if attempt >= degradeWebhookAttempts {
+			log.Printf("B 发送告警失败 %d 次, 丢弃: %v", attempt, err)
+			return false
+		}
+		log.Printf("B 发送告警失败, %v 后重试: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// 以 POST 发送告警到 degrade_webhook, 内容与 /events 中的事件相同
+func postDegradeWebhook(ctx context.Context, webhook string, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("编码告警失败: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", webhook, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("状态码: %d", resp.StatusCode)
+	}
+	return nil
+}
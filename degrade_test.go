@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckDegradation(t *testing.T) {
+	received := make(chan Event, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer server.Close()
+	gConfig = &Config{DegradePercent: 50, DegradeWebhook: server.URL}
+	startDegradeWebhook(t.Context(), server.URL)
+	gBaselines = make(map[string]*latencyBaseline)
+	gDegraded = make(map[string]bool)
+	t.Cleanup(func() {
+		gBaselines = make(map[string]*latencyBaseline)
+		gDegraded = make(map[string]bool)
+	})
+
+	round := func(latencies ...int) []degradeAlert {
+		names := []string{"HK 01", "HK 02", "JP 01"}
+		var nodes []*ProxyNode
+		for i, latency := range latencies {
+			nodes = append(nodes, &ProxyNode{Name: names[i], Latency: latency})
+		}
+		return checkDegradation(nodes)
+	}
+	// 基线还不够 baselineMinRounds 轮时不告警
+	for range baselineMinRounds {
+		if alerts := round(100, 100, 20); alerts != nil {
+			t.Fatalf("alerts while building the baseline: %v", alerts)
+		}
+	}
+	// JP 01 增加了 100% 但只有 20ms, 不告警
+	alerts := round(300, 100, 40)
+	if len(alerts) != 1 || alerts[0].Scope != "node" || alerts[0].Name != "HK 01" || alerts[0].Percent != 200 {
+		t.Fatalf("alerts = %+v, want HK 01 +200%%", alerts)
+	}
+	select {
+	case event := <-received:
+		if event.Type != EventDegraded {
+			t.Errorf("webhook event = %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("webhook not called")
+	}
+	// 已告警的节点不重复告警; 所有节点都变慢时整体告警
+	alerts = round(600, 300, 200)
+	if len(alerts) != 3 || alerts[0].Name != "HK 02" || alerts[1].Name != "JP 01" || alerts[2].Scope != "pool" || alerts[2].Degraded != 3 || alerts[2].Nodes != 3 {
+		t.Errorf("alerts = %+v, want HK 02, JP 01 and pool", alerts)
+	}
+	// 测试失败的节点不参与比较
+	if alerts := round(-1, -1, -1); alerts != nil {
+		t.Errorf("alerts for failed nodes = %+v", alerts)
+	}
+}
+
+func TestDeliverDegradeWebhookRetry(t *testing.T) {
+	var calls atomic.Int32
+	failures := int32(2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	degradeWebhookBackoff = time.Millisecond
+	t.Cleanup(func() { degradeWebhookBackoff = time.Second })
+	event := Event{Type: EventDegraded, Payload: degradeAlert{Scope: "pool"}}
+
+	// 前两次失败, 第三次成功
+	if !deliverDegradeWebhook(t.Context(), server.URL, event) || calls.Load() != 3 {
+		t.Errorf("delivered after %d calls, want success on the 3rd", calls.Load())
+	}
+	// 一直失败时尝试 degradeWebhookAttempts 次后丢弃
+	calls.Store(0)
+	failures = 100
+	if deliverDegradeWebhook(t.Context(), server.URL, event) || calls.Load() != degradeWebhookAttempts {
+		t.Errorf("gave up after %d calls, want %d", calls.Load(), degradeWebhookAttempts)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// 诊断检查的结果输出
+type doctorReport struct {
+	failed bool
+}
+
+func (r *doctorReport) pass(name, detail string) {
+	fmt.Printf("\033[32m✔ %s\033[0m %s\n", name, detail)
+}
+
+func (r *doctorReport) fail(name string, err error, hint string) {
+	r.failed = true
+	fmt.Printf("\033[31m✘ %s\033[0m %v\n", name, err)
+	fmt.Printf("  提示: %s\n", hint)
+}
+
+// 依次检查常见的配置问题, 某项失败时跳过依赖它的后续检查
+func runDoctor(configPath string) bool {
+	r := &doctorReport{}
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		r.fail("配置文件", err, "请确认配置文件存在且内容正确, 或使用 -c 指定配置文件路径")
+		return false
+	}
+	gConfig = config
+	r.pass("配置文件", configPath)
+
+	proxiesResp, err := fetchProxies()
+	switch {
+	case errors.Is(err, ErrUnreachable):
+		r.fail("连接控制器", err, "请确认 Clash 已启动并开启 external-controller, 且 api_endpoint 地址正确")
+		return false
+	case errors.Is(err, ErrAuth):
+		r.pass("连接控制器", gConfig.APIEndpoint)
+		r.fail("控制器认证", err, "请确认 api_key 与 Clash 配置中的 secret 一致")
+		return false
+	case err != nil:
+		r.fail("连接控制器", err, "请确认 api_endpoint 指向的是 Clash 的 external-controller 地址")
+		return false
+	}
+	r.pass("连接控制器", gConfig.APIEndpoint)
+	r.pass("控制器认证", "")
+
+	if gConfig.SwitchGroup == "" || gConfig.CurrentGroup == "" {
+		if err := applySelectGroup(gConfig, proxiesResp); err != nil {
+			r.fail("自动选择节点组", err, "请在配置中设置 select_node, 可以用 groups 命令列出所有节点组")
+			return false
+		}
+		r.pass("自动选择节点组", gConfig.SelectNode)
+	}
+
+	nodes, _, err := parseNodes(proxiesResp)
+	if errors.Is(err, ErrGroupNotFound) {
+		r.fail("选择节点组", err, "请将 select_node (或 switch_group / current_group) 设置为 Clash 中节点组的完整名称(包括 emoji), 切换的节点组必须为 Selector 类型")
+		return false
+	}
+	if err != nil {
+		r.fail("选择节点组", err, "请检查控制器返回的节点列表")
+		return false
+	}
+	if gConfig.CurrentGroup != gConfig.SwitchGroup {
+		r.pass("选择节点组", fmt.Sprintf("切换 %s, 读取当前节点 %s", gConfig.SwitchGroup, gConfig.CurrentGroup))
+	} else {
+		r.pass("选择节点组", gConfig.SwitchGroup)
+	}
+
+	if len(nodes) == 0 {
+		r.fail("筛选节点", fmt.Errorf("没有节点通过筛选"), "请检查 include_regex 和 exclude_regex, 注意 exclude_regex 为空时会排除所有节点")
+		return false
+	}
+	r.pass("筛选节点", fmt.Sprintf("%d 个节点", len(nodes)))
+
+	// 依次尝试前几个节点, 只要有一个成功就说明测试 URL 可用
+	var lastErr error
+	for i := range min(len(nodes), 3) {
+		delay, err := testNode(context.Background(), nodes[i])
+		if err == nil {
+			r.pass("测试延迟", fmt.Sprintf("%s: %dms", nodes[i].Name, delay))
+			return !r.failed
+		}
+		lastErr = err
+	}
+	r.fail("测试延迟", lastErr, "请确认 test_url 可以通过节点访问, 或更换为 http://www.gstatic.com/generate_204")
+	return false
+}
+
+func newDoctorCmd(configPath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "doctor",
+		Short: "检查配置、控制器连接和节点筛选等常见问题",
+		Run: func(cmd *cobra.Command, args []string) {
+			if !runDoctor(*configPath) {
+				os.Exit(1)
+			}
+		},
+	}
+}
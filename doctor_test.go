@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRunDoctor(t *testing.T) {
+	proxies := `{"proxies":{
+		"Proxy":{"name":"Proxy","type":"Selector","now":"HK 01"},
+		"HK 01":{"name":"HK 01","type":"Shadowsocks","alive":true}
+	}}`
+	tests := []struct {
+		name       string
+		selectNode string
+		delay      int
+		want       bool
+	}{
+		{"healthy", "Proxy", http.StatusOK, true},
+		{"missing group", "Missing", http.StatusOK, false},
+		{"detected group", `""`, http.StatusOK, true},
+		{"delay fails", "Proxy", http.StatusRequestTimeout, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/delay") {
+					w.WriteHeader(tt.delay)
+					w.Write([]byte(`{"delay":80}`))
+					return
+				}
+				w.Write([]byte(proxies))
+			}))
+			defer server.Close()
+			path := writeTestConfig(t, "api_endpoint: "+server.URL+"\nselect_node: "+tt.selectNode+"\n")
+			if got := runDoctor(path); got != tt.want {
+				t.Errorf("runDoctor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// 事件类型
+const (
+	EventSwitched       = "switched"        // 切换了当前节点
+	EventBestSelected   = "best_selected"   // 选出了最优节点
+	EventNodeDown       = "node_down"       // 当前节点测试失败
+	EventNodeUp         = "node_up"         // 当前节点恢复
+	EventCycleCompleted = "cycle_completed" // 完成一轮测试
+	EventDegraded       = "degraded"        // 节点或整体延迟比基线明显增加
+)
+
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Payload any       `json:"payload"`
+}
+
+// 每个订阅者的事件缓冲, 满了之后丢弃新事件, 避免慢速订阅者阻塞调用方
+const eventBuffer = 64
+
+var eventMu sync.Mutex
+var eventSubscribers = make(map[chan Event]struct{})
+
+// 订阅事件, 返回的函数用于取消订阅
+func subscribeEvents() (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+	eventMu.Lock()
+	eventSubscribers[ch] = struct{}{}
+	eventMu.Unlock()
+	return ch, func() {
+		eventMu.Lock()
+		delete(eventSubscribers, ch)
+		eventMu.Unlock()
+	}
+}
+
+// 发布事件给所有订阅者, 不会阻塞
+func publishEvent(eventType string, payload any) {
+	event := Event{Type: eventType, Time: time.Now(), Payload: payload}
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	for ch := range eventSubscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 通过状态服务临时排除的节点及排除截止时间, 由 mu 保护
+var gExcluded = make(map[string]time.Time)
+
+// 节点是否被临时排除, 顺便清除已过期的排除
+func manuallyExcluded(node *ProxyNode, now time.Time) bool {
+	until, ok := gExcluded[node.Name]
+	if !ok {
+		return false
+	}
+	if !now.Before(until) {
+		delete(gExcluded, node.Name)
+		log.Printf("S 节点临时排除已到期: %s", node.Name)
+		return false
+	}
+	return true
+}
+
+// 排除节点到 until, 排除的是当前最优节点时立即重新选择, 当前节点由检查协程切换
+func excludeNode(name string, until time.Time) {
+	gExcluded[name] = until
+	log.Printf("S 临时排除节点: %s, 直到 %s", name, until.Format(time.DateTime))
+	if gBest != nil && gBest.Name == name {
+		decision := pickFastestNode(time.Now())
+		if decision.Best != nil {
+			gDecision = &decision
+			gBest = decision.Best
+			log.Printf("S 重新选择最优节点: %s", gBest.Name)
+		}
+	}
+}
+
+// 未过期的临时排除, 调用方需持有 mu
+func activeExclusions(now time.Time) map[string]time.Time {
+	active := make(map[string]time.Time)
+	for name, until := range gExcluded {
+		if now.Before(until) {
+			active[name] = until
+		}
+	}
+	return active
+}
+
+// POST /exclude?node=<节点名>&duration=30m (或 until=<RFC3339 时间>) 临时排除节点,
+// DELETE /exclude?node=<节点名> 取消排除, 都返回当前的排除列表
+func handleExclude(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("node")
+	if name == "" {
+		http.Error(w, "缺少 node 参数", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	var until time.Time
+	if r.Method == http.MethodPost {
+		var err error
+		until, err = parseExcludeUntil(r, now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	mu.Lock()
+	if r.Method == http.MethodPost {
+		excludeNode(name, until)
+	} else {
+		delete(gExcluded, name)
+		log.Printf("S 取消临时排除节点: %s", name)
+	}
+	active := activeExclusions(now)
+	mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(active)
+}
+
+// 从 duration 或 until 参数得到排除截止时间
+func parseExcludeUntil(r *http.Request, now time.Time) (time.Time, error) {
+	query := r.URL.Query()
+	switch {
+	case query.Get("duration") != "":
+		d, err := time.ParseDuration(query.Get("duration"))
+		if err != nil || d <= 0 {
+			return time.Time{}, fmt.Errorf("duration 无效: %s", query.Get("duration"))
+		}
+		return now.Add(d), nil
+	case query.Get("until") != "":
+		until, err := time.Parse(time.RFC3339, query.Get("until"))
+		if err != nil || !until.After(now) {
+			return time.Time{}, fmt.Errorf("until 无效或已过去: %s", query.Get("until"))
+		}
+		return until, nil
+	}
+	return time.Time{}, fmt.Errorf("需要 duration 或 until 参数")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHandleExclude(t *testing.T) {
+	gConfig = &Config{LatencyThreshold: 200}
+	gExcluded = make(map[string]time.Time)
+	gNodes = []*ProxyNode{
+		{Name: "HK 01", Flow: 1, Latency: 50},
+		{Name: "HK 02", Flow: 1, Latency: 80},
+	}
+	gCurrent, gBest = gNodes[0], gNodes[0]
+	mux := newStatusMux()
+	do := func(method, query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, "/exclude?"+query, nil))
+		return rec
+	}
+
+	rec := do("POST", "node="+url.QueryEscape("HK 01")+"&duration=30m")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /exclude = %d %s", rec.Code, rec.Body)
+	}
+	if gBest.Name != "HK 02" {
+		t.Errorf("best = %s after excluding HK 01, want HK 02", gBest.Name)
+	}
+	if best, _ := pickNode(gNodes, time.Now()); best.Name != "HK 02" {
+		t.Errorf("pickNode() = %s, want the excluded node skipped", best.Name)
+	}
+	if best, _ := pickNode(gNodes, time.Now().Add(time.Hour)); best.Name != "HK 01" {
+		t.Errorf("pickNode() after expiry = %s, want HK 01", best.Name)
+	}
+
+	do("POST", "node="+url.QueryEscape("HK 02")+"&until="+url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339)))
+	status := httptest.NewRecorder()
+	mux.ServeHTTP(status, httptest.NewRequest("GET", "/status", nil))
+	var snapshot statusSnapshot
+	json.NewDecoder(status.Body).Decode(&snapshot)
+	if _, ok := snapshot.Excluded["HK 02"]; !ok || len(snapshot.Excluded) != 1 {
+		t.Errorf("/status excluded = %v, want HK 02 only", snapshot.Excluded)
+	}
+
+	do("DELETE", "node="+url.QueryEscape("HK 02"))
+	if len(gExcluded) != 0 {
+		t.Errorf("gExcluded = %v after DELETE", gExcluded)
+	}
+
+	for _, query := range []string{"duration=30m", "node=a", "node=a&duration=-1m", "node=a&until=2000-01-01T00:00:00Z"} {
+		if rec := do("POST", query); rec.Code != http.StatusBadRequest {
+			t.Errorf("POST /exclude?%s = %d, want 400", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// export 命令输出的内容
+type exportData struct {
+	Since        time.Time              `json:"since"`
+	Measurements map[string]measurement `json:"measurements"` // 每个节点最近一次的测试结果
+	Switches     []switchRecord         `json:"switches"`
+}
+
+// 从 state_file 中取出 since 之后的测试结果和切换记录
+func exportState(path string, since time.Time, w io.Writer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("读取状态文件失败: %v", err)
+	}
+	state, err := parseState(data)
+	if err != nil {
+		return err
+	}
+	export := exportData{Since: since, Measurements: make(map[string]measurement), Switches: []switchRecord{}}
+	for name, m := range state.Measurements {
+		if !m.TestedAt.Before(since) {
+			export.Measurements[name] = m
+		}
+	}
+	for _, record := range state.Switches {
+		if !record.Time.Before(since) {
+			export.Switches = append(export.Switches, record)
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+func newExportCmd(configPath *string) *cobra.Command {
+	var since time.Duration
+	var format string
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "从 state_file 导出最近的节点测试结果和切换记录",
+		Run: func(cmd *cobra.Command, args []string) {
+			if format != "json" {
+				fmt.Fprintf(os.Stderr, "不支持的格式: %s, 目前只支持 json\n", format)
+				os.Exit(1)
+			}
+			config, err := loadConfig(*configPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "加载配置失败: %v\n", err)
+				os.Exit(1)
+			}
+			if config.StateFile == "" {
+				fmt.Fprintln(os.Stderr, "需要在配置中设置 state_file")
+				os.Exit(1)
+			}
+			if err := exportState(config.StateFile, time.Now().Add(-since), os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "导出失败: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().DurationVar(&since, "since", 24*time.Hour, "导出多长时间内的记录")
+	cmd.Flags().StringVar(&format, "format", "json", "输出格式, 目前只支持 json")
+	return cmd
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportState(t *testing.T) {
+	now := time.Now()
+	path := t.TempDir() + "/state.json"
+	gConfig = &Config{StateFile: path}
+	gBest = nil
+	gMeasurements = map[string]measurement{
+		"HK 01": {Latency: 80, Success: 3, TestedAt: now.Add(-10 * time.Minute)},
+		"JP 01": {Latency: 120, Success: 3, TestedAt: now.Add(-3 * time.Hour)},
+	}
+	gSwitchHistory = []switchRecord{
+		{Time: now.Add(-2 * time.Hour), From: "JP 01", To: "US 01"},
+		{Time: now.Add(-5 * time.Minute), From: "US 01", To: "HK 01"},
+	}
+	defer func() { gMeasurements, gSwitchHistory = make(map[string]measurement), nil }()
+	if err := saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := exportState(path, now.Add(-time.Hour), &out); err != nil {
+		t.Fatal(err)
+	}
+	var export exportData
+	if err := json.Unmarshal([]byte(out.String()), &export); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := export.Measurements["HK 01"]; !ok || len(export.Measurements) != 1 {
+		t.Errorf("measurements = %v, want only HK 01", export.Measurements)
+	}
+	if len(export.Switches) != 1 || export.Switches[0].To != "HK 01" {
+		t.Errorf("switches = %v, want only the switch to HK 01", export.Switches)
+	}
+
+	// 重启后恢复切换记录
+	gSwitchHistory = nil
+	if err := loadState(now); err != nil {
+		t.Fatal(err)
+	}
+	if len(gSwitchHistory) != 2 {
+		t.Errorf("restored %d switches, want 2", len(gSwitchHistory))
+	}
+}
@@ -2,9 +2,15 @@ module autoclash
 
 go 1.24.0
 
+require (
+	github.com/expr-lang/expr v1.17.7
+	github.com/spf13/cobra v1.9.1
+	golang.org/x/net v0.40.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/spf13/cobra v1.9.1 // indirect
 	github.com/spf13/pflag v1.0.6 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/sys v0.33.0 // indirect
 )
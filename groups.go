@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// 可以作为 select_node 的节点组类型
+var groupTypes = []string{"Selector", "URLTest", "Fallback"}
+
+// 取出所有节点组, 按名称排序
+func listGroups(proxiesResp *ProxiesResponse) []ProxyNode {
+	var groups []ProxyNode
+	for _, proxy := range proxiesResp.Proxies {
+		for _, groupType := range groupTypes {
+			if proxy.Type == groupType {
+				groups = append(groups, proxy)
+				break
+			}
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// 输出节点组的名称、类型、当前节点和成员数, 当前配置切换的节点组前标记 *
+func printGroups(w io.Writer, groups []ProxyNode) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\t名称\t类型\t当前节点\t成员数")
+	for _, group := range groups {
+		mark := ""
+		if group.Name == gConfig.SwitchGroup {
+			mark = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%q\t%s\t%s\t%d\n", mark, group.Name, group.Type, group.Now, len(group.All))
+	}
+	tw.Flush()
+}
+
+func newGroupsCmd(configPath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "groups",
+		Short: "列出控制器中的节点组, 用于设置 select_node",
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := loadConfig(*configPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "加载配置失败: %v\n", err)
+				os.Exit(1)
+			}
+			gConfig = config
+			proxiesResp, err := fetchProxies()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "获取节点组失败: %v\n", err)
+				os.Exit(1)
+			}
+			printGroups(os.Stdout, listGroups(proxiesResp))
+		},
+	}
+}
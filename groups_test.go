@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestListGroups(t *testing.T) {
+	var proxiesResp ProxiesResponse
+	err := json.Unmarshal([]byte(`{"proxies":{
+		"🔰 节点选择":{"name":"🔰 节点选择","type":"Selector","now":"HK 01","all":["HK 01","HK 02","DIRECT"]},
+		"♻️ 自动选择":{"name":"♻️ 自动选择","type":"URLTest","now":"HK 02","all":["HK 01","HK 02"]},
+		"⚖️ 负载均衡":{"name":"⚖️ 负载均衡","type":"LoadBalance","all":["HK 01"]},
+		"HK 01":{"name":"HK 01","type":"Shadowsocks"},
+		"DIRECT":{"name":"DIRECT","type":"Direct"}
+	}}`), &proxiesResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := listGroups(&proxiesResp)
+	if len(groups) != 2 || groups[0].Name != "♻️ 自动选择" || groups[1].Name != "🔰 节点选择" {
+		t.Fatalf("listGroups() = %+v", groups)
+	}
+
+	gConfig = &Config{SwitchGroup: "🔰 节点选择"}
+	var out strings.Builder
+	printGroups(&out, groups)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[2], "*") || !strings.Contains(lines[2], `"🔰 节点选择"`) || !strings.HasSuffix(lines[2], "3") {
+		t.Errorf("printGroups() =\n%s", out.String())
+	}
+}
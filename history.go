@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// 切换记录中延迟的显示, 0 为没有记录
+func formatHistoryLatency(latency int) string {
+	if latency == 0 {
+		return "-"
+	}
+	return formatLatency(latency)
+}
+
+// 从早到晚输出切换记录: 时间、切换前后的节点及延迟和原因
+func printHistory(w io.Writer, records []switchRecord) {
+	if len(records) == 0 {
+		fmt.Fprintln(w, "没有切换记录")
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "时间\t从\t延迟\t到\t延迟\t原因")
+	for _, record := range records {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", record.Time.Local().Format(reportTimeLayout),
+			orNone(record.From), formatHistoryLatency(record.FromLatency),
+			record.To, formatHistoryLatency(record.ToLatency), orNone(record.Reason))
+	}
+	tw.Flush()
+}
+
+func newHistoryCmd(configPath *string) *cobra.Command {
+	var addr string
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "输出运行中的 autoclash 最近的切换记录, 包括切换原因和前后节点的延迟",
+		Run: func(cmd *cobra.Command, args []string) {
+			if addr == "" {
+				config, err := loadConfig(*configPath)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "加载配置失败: %v\n", err)
+					os.Exit(1)
+				}
+				addr = config.StatusAddr
+			}
+			if addr == "" {
+				fmt.Fprintln(os.Stderr, "需要在配置中设置 status_addr 或使用 --addr 指定状态服务地址")
+				os.Exit(1)
+			}
+			snapshot, err := fetchStatus(statusClient(addr, 5*time.Second), statusURL(addr))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "获取状态失败, autoclash 是否在运行: %v\n", err)
+				os.Exit(1)
+			}
+			printHistory(os.Stdout, snapshot.Switches)
+		},
+	}
+	cmd.Flags().StringVar(&addr, "addr", "", "状态服务地址, 如 127.0.0.1:9091 或 unix:/path, 默认为配置中的 status_addr")
+	return cmd
+}
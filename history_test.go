@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintHistory(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)
+	var out strings.Builder
+	printHistory(&out, []switchRecord{
+		{Time: now.Add(-time.Hour), To: "HK 01", Reason: "没有当前节点", ToLatency: 80},
+		{Time: now, From: "HK 01", To: "JP 01", Reason: "当前节点不可用", FromLatency: -1, ToLatency: 120},
+	})
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("output has %d lines, want header and 2 records:\n%s", len(lines), out.String())
+	}
+	for _, want := range []string{"2024-01-02 03:04:05", "HK 01", "失败", "JP 01", "120ms", "当前节点不可用"} {
+		if !strings.Contains(lines[2], want) {
+			t.Errorf("record line %q does not contain %q", lines[2], want)
+		}
+	}
+	if !strings.Contains(lines[1], "无") || !strings.Contains(lines[1], "80ms") {
+		t.Errorf("first record line = %q", lines[1])
+	}
+
+	out.Reset()
+	printHistory(&out, nil)
+	if out.String() != "没有切换记录\n" {
+		t.Errorf("empty history output = %q", out.String())
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 等待执行的 on_switch_exec 数量上限, 超过时丢弃新的切换
+const switchHookQueue = 16
+
+type switchHook struct {
+	command  string
+	timeout  time.Duration
+	from, to string
+}
+
+var switchHooks chan switchHook
+var switchHooksOnce sync.Once
+
+// 切换后执行 on_switch_exec。命令在单独的协程中按顺序执行, 不会阻塞调用方
+func runSwitchHook(from, to string) {
+	if gConfig.OnSwitchExec == "" {
+		return
+	}
+	switchHooksOnce.Do(func() {
+		switchHooks = make(chan switchHook, switchHookQueue)
+		go func() {
+			for hook := range switchHooks {
+				execSwitchHook(hook)
+			}
+		}()
+	})
+	select {
+	case switchHooks <- switchHook{gConfig.OnSwitchExec, time.Duration(gConfig.OnSwitchTimeout) * time.Second, from, to}:
+	default:
+		log.Printf("H 等待执行的 on_switch_exec 过多, 丢弃: %s -> %s", from, to)
+	}
+}
+
+// 执行命令并把输出写入日志, 超时后结束命令
+func execSwitchHook(hook switchHook) {
+	ctx, cancel := context.WithTimeout(context.Background(), hook.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook.command)
+	cmd.Env = append(os.Environ(), "AUTOCLASH_FROM="+hook.from, "AUTOCLASH_TO="+hook.to)
+	// 命令启动的子进程仍持有输出时, 超时后不再等待
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimRight(string(output), "\n"), "\n") {
+		if line != "" {
+			log.Printf("H on_switch_exec: %s", line)
+		}
+	}
+	switch {
+	case ctx.Err() != nil:
+		log.Printf("H on_switch_exec 超时 (%s), 已结束", hook.timeout)
+	case err != nil:
+		log.Printf("H on_switch_exec 失败: %v", err)
+	}
+}
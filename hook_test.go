@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExecSwitchHook(t *testing.T) {
+	path := t.TempDir() + "/hook.txt"
+	execSwitchHook(switchHook{`echo "$AUTOCLASH_FROM -> $AUTOCLASH_TO" > ` + path, time.Second, "HK 01", "JP 01"})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "HK 01 -> JP 01\n" {
+		t.Errorf("hook output = %q", data)
+	}
+
+	start := time.Now()
+	execSwitchHook(switchHook{"sleep 10", 200 * time.Millisecond, "a", "b"})
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("hanging hook took %v, want it killed after the timeout", elapsed)
+	}
+}
+
+func TestRunSwitchHookDoesNotBlock(t *testing.T) {
+	gConfig = &Config{OnSwitchExec: "sleep 1", OnSwitchTimeout: 5}
+	start := time.Now()
+	for range switchHookQueue + 5 {
+		runSwitchHook("a", "b")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("runSwitchHook blocked for %v", elapsed)
+	}
+}
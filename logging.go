@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"time"
+	_ "time/tzdata" // 精简的 Docker 镜像中没有时区数据
+)
+
+// 标准库日志默认的时间格式
+const defaultLogTimeFormat = "2006/01/02 15:04:05"
+
+// 在每行日志前加上指定格式和时区的时间, 代替标准库按本机时区输出的时间
+type timestampWriter struct {
+	out    io.Writer
+	layout string
+	loc    *time.Location
+	now    func() time.Time
+}
+
+func (w *timestampWriter) Write(p []byte) (int, error) {
+	line := make([]byte, 0, len(w.layout)+1+len(p))
+	line = w.now().In(w.loc).AppendFormat(line, w.layout)
+	line = append(line, ' ')
+	line = append(line, p...)
+	if _, err := w.out.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 按 log_time_format 和 log_timezone 设置日志时间, 都未设置时保持标准库的默认输出
+func setupLogTime(config *Config) {
+	if config.LogTimeFormat == "" && config.LogTimezone == "" {
+		return
+	}
+	loc := time.Local
+	if config.LogTimezone != "" {
+		// 时区已在加载配置时校验
+		loc, _ = time.LoadLocation(config.LogTimezone)
+	}
+	layout := config.LogTimeFormat
+	if layout == "" {
+		layout = defaultLogTimeFormat
+	}
+	log.SetFlags(log.Flags() &^ (log.Ldate | log.Ltime | log.Lmicroseconds | log.LUTC))
+	log.SetOutput(&timestampWriter{out: os.Stderr, layout: layout, loc: loc, now: time.Now})
+}
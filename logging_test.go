@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimestampWriter(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	w := &timestampWriter{
+		out:    &out,
+		layout: time.RFC3339,
+		loc:    loc,
+		now:    func() time.Time { return time.Date(2024, 1, 2, 0, 30, 0, 0, time.UTC) },
+	}
+	if n, err := w.Write([]byte("A 更新节点列表成功\n")); err != nil || n != len("A 更新节点列表成功\n") {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	if want := "2024-01-02T08:30:00+08:00 A 更新节点列表成功\n"; out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestLoadConfigLogTimezone(t *testing.T) {
+	path := writeTestConfig(t, "log_timezone: Mars/Olympus\n")
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "log_timezone") {
+		t.Errorf("loadConfig() error = %v, want invalid log_timezone", err)
+	}
+}
@@ -2,81 +2,719 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/expr-lang/expr/vm"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	APIEndpoint      string `yaml:"api_endpoint"`      // ClashX API 地址
-	APIKey           string `yaml:"api_key"`           // ClashX API 密钥
-	IncludeRegex     string `yaml:"include_regex"`     // 匹配需要使用的节点正则
-	ExcludeRegex     string `yaml:"exclude_regex"`     // 排除节点的正则
-	TestURL          string `yaml:"test_url"`          // 测试 URL
-	RetrieveInterval int    `yaml:"retrieve_interval"` // 更新节点列表的间隔时间
-	CurrentInterval  int    `yaml:"current_interval"`  // 测试当前节点的间隔时间
-	BestInterval     int    `yaml:"best_interval"`     // 测试所有节点延迟的间隔时间，选出最优节点
-	TestTimes        int    `yaml:"test_times"`        // 测试次数, 取平均值
-	SelectNode       string `yaml:"select_node"`       // 选择节点名，默认为"🔰 节点选择"
-	LatencyThreshold int    `yaml:"latency_threshold"` // 迟延阈值
+	APIEndpoint            string            `yaml:"api_endpoint"`                   // ClashX API 地址
+	APIKey                 string            `yaml:"api_key"`                        // ClashX API 密钥
+	APIKeyFile             string            `yaml:"api_key_file"`                   // 从文件读取 API 密钥, 与 api_key 只能设置一个
+	ClashXConfig           string            `yaml:"clashx_config"`                  // 未设置 api_endpoint 时从 ClashX 的配置文件读取控制器地址和密钥, 默认为 ~/.config/clash/config.yaml
+	IncludeRegex           string            `yaml:"include_regex"`                  // 匹配需要使用的节点正则
+	ExcludeRegex           string            `yaml:"exclude_regex"`                  // 排除节点的正则
+	ExcludeFromTest        string            `yaml:"exclude_from_test"`              // 不参与测试、也不会被选为最优节点的节点正则, 用于测速总是失败但实际可用的节点
+	InfoNodeRegex          string            `yaml:"info_node_regex"`                // 订阅中剩余流量、到期时间等信息节点的正则, 匹配的节点总是排除, 默认匹配常见的写法
+	OnDuplicateName        string            `yaml:"on_duplicate_name"`              // 控制器返回重名节点时的处理: warn(默认, 保留第一个并输出警告), first_alive(保留第一个可用的), skip(全部排除并输出警告)
+	ProxyFields            map[string]string `yaml:"proxy_fields"`                   // 控制器 /proxies 中 name、type、alive、now、all 字段使用的 JSON 键名, 用于字段名不同的内核
+	DelayRequest           map[string]string `yaml:"delay_request"`                  // 延迟测试请求的 method、path、body 和响应中延迟的字段 delay_field, 用于测试接口不同的内核, 未设置的使用标准的 GET /proxies/{name}/delay
+	RequireTags            []string          `yaml:"require_tags"`                   // 节点名中必须包含的全部标签, 如 IEPL
+	ExcludeTags            []string          `yaml:"exclude_tags"`                   // 节点名中包含任一标签即排除
+	IncludeTypes           []string          `yaml:"include_types"`                  // 只使用这些协议类型的节点, 如 Trojan、Vmess, 不区分大小写, 为空时不限制
+	ExcludeTypes           []string          `yaml:"exclude_types"`                  // 排除这些协议类型的节点, 如 Shadowsocks
+	TagDelimiter           string            `yaml:"tag_delimiter"`                  // 节点名中标签的分隔符, 默认为 "|", 标签为两个分隔符之间的内容
+	TestURL                string            `yaml:"test_url"`                       // 测试 URL
+	ProbeURL               string            `yaml:"probe_url"`                      // 检查当前节点使用的 URL, 如轻量的 204 地址, 为空时与选择最优节点相同, 使用 test_url
+	TestURLs               map[string]string `yaml:"test_urls"`                      // 按节点组或区域指定的测试 URL, 键为节点组名或匹配节点名的正则, 都不匹配时使用 test_url
+	RetrieveInterval       int               `yaml:"retrieve_interval"`              // 更新节点列表的间隔时间
+	MaxNodeListAge         int               `yaml:"max_node_list_age"`              // 节点列表超过多少秒未成功更新时暂停切换节点并告警, 更新成功后恢复, 0 为不限制
+	CurrentInterval        int               `yaml:"current_interval"`               // 测试当前节点的间隔时间
+	MeasurementFreshness   int               `yaml:"measurement_freshness"`          // 最优节点选择在多少秒内成功测试过当前节点时, 检查当前节点直接使用该结果, 0 为总是单独测试
+	LogCurrentLatency      bool              `yaml:"log_current_latency"`            // 当前节点与最优节点相同时也在每次检查时输出其延迟
+	BestInterval           int               `yaml:"best_interval"`                  // 测试所有节点延迟的间隔时间，选出最优节点
+	AlignIntervals         bool              `yaml:"align_intervals"`                // 定时任务对齐到整数倍间隔的时刻(如每分钟的 0 秒), 重启后时间表不变, 不再随机推迟首次触发
+	BestDeadline           int               `yaml:"best_selection_deadline"`        // 每轮测试所有节点的最长时间(秒), 超时未完成的节点视为测试失败, 0 为不限制
+	TestTimes              int               `yaml:"test_times"`                     // 测试次数, 取平均值
+	TestTimeoutMS          int               `yaml:"test_timeout_ms"`                // 控制器测试节点的超时时间(毫秒), 默认为 5000
+	TestExpectStatus       string            `yaml:"test_expect_status"`             // 测试 URL 期望的状态码, 如 204 或 200-299, 多个用 / 分隔, 状态码不符时视为测试失败, 需要 Clash.Meta (mihomo) 内核, 为空时不检查
+	TestURLOptions         testURLOptions    `yaml:"test_url_options"`               // 按测试 URL 指定期望的状态码 expect_status 和请求方法 method, 覆盖 test_expect_status
+	TreatZeroAs            string            `yaml:"treat_zero_as"`                  // 测试节点得到的延迟为 0 时的处理: failure(默认, 视为测试失败), success_min(视为 1ms 的成功), ignore(不计入这次测试)
+	SelectNode             string            `yaml:"select_node"`                    // 选择节点名, 为空时启动后从控制器自动选择: 优先名称为"节点选择"、PROXY、🔰 等常见默认名称的 Selector, 否则为第一个 Selector
+	SwitchGroup            string            `yaml:"switch_group"`                   // 切换节点的节点组, 必须为 Selector, 默认为 select_node
+	CurrentGroup           string            `yaml:"current_group"`                  // 读取当前节点的节点组(取其 now), 可以为 Fallback 等类型, 默认为 switch_group
+	LatencyThreshold       int               `yaml:"latency_threshold"`              // 迟延阈值
+	SelectionMode          string            `yaml:"selection_mode"`                 // 选择方式: flow_groups(默认, 超过阈值的节点被排除, 没有合格节点时逐步放宽阈值), soft_penalty(超过阈值的节点按超出部分加罚) 或 sticky(按 flow_groups 选择, 当前节点不可用或延迟超过 sticky_degrade_threshold 前不切换)
+	PenaltySlope           float64           `yaml:"penalty_slope"`                  // soft_penalty 方式下超过阈值的部分每 1ms 增加的得分(再乘以流量系数), 默认为 1
+	FlowLatencyPenalty     float64           `yaml:"flow_latency_penalty_ms"`        // 不按流量系数分组, 把流量系数折算为延迟后统一比较: 有效延迟 = 延迟 + (流量系数 - 1) × 该值, 0 为不启用
+	FlowJumpRatio          float64           `yaml:"flow_jump_ratio"`                // flow_groups 方式下, 流量系数较低的分组中最优节点的得分达到较高分组中最优节点的多少倍时改选较高分组的节点, 如 3, 0 为不启用
+	StickyDegradeThreshold int               `yaml:"sticky_degrade_threshold"`       // sticky 方式下当前节点延迟超过该值才重新选择, 默认为 latency_threshold
+	TieBreak               string            `yaml:"tie_break"`                      // 得分相同时的选择: name(默认, 按节点名排序), jitter(抖动低者优先), current(优先当前节点), 其余情况按节点名
+	ProfileWeight          float64           `yaml:"profile_weight"`                 // 按时段历史表现加权的比例(0~1), 0 为不启用
+	LatencyHistorySize     int               `yaml:"latency_history_size"`           // 每个节点保留最近多少轮的延迟, 在 /status 的 history 中输出, 用于绘制趋势图, 0 为不保留
+	DegradePercent         float64           `yaml:"degrade_percent"`                // 节点或整体延迟比基线(最近几轮的加权平均)增加超过该百分比时告警, 0 为不检查
+	DegradeWebhook         string            `yaml:"degrade_webhook"`                // 告警时以 POST 发送 JSON 的地址, 为空时只记录日志和发布 degraded 事件
+	UsagePenaltyWeight     float64           `yaml:"usage_penalty_weight"`           // 按最近使用时长加罚的权重: 每分钟最近使用时长增加的得分(ms), 使用时长每小时减半, 0 为不启用
+	LossPenalty            float64           `yaml:"loss_penalty_ms"`                // 按丢包率加罚: 丢包率(0~1) × 该值加到得分上, 如 500 时丢包 20% 的节点得分增加 100ms, 0 为不启用
+	MaxLossRatio           float64           `yaml:"max_loss_ratio"`                 // 最近一轮测试失败次数占 test_times 的比例超过该值的节点不参与选择, 0 为不限制
+	NodeScoresFile         string            `yaml:"node_scores_file"`               // 节点偏置文件, 每行为 "正则: 偏置(ms)", 匹配的节点得分加上偏置, 文件变化后自动重新读取, 为空时不启用
+	BestSampleSize         int               `yaml:"best_sample_size"`               // 每轮最多测试的节点数, 0 为测试全部节点
+	TestShardSize          int               `yaml:"test_shard_size"`                // 分片测试每片的节点数, 每 best_interval 内分多次测试, 每次测试一片, 0 为不分片
+	MinStabilityCycles     int               `yaml:"min_stability_cycles"`           // 节点需要连续多少轮测试延迟在阈值内才能成为最优节点, 没有满足条件的节点时不限制, 0 为不启用
+	TestBandwidthBudget    int               `yaml:"test_bandwidth_budget"`          // 每轮测试最多消耗的流量(KB), 超出后不再测试更多节点, 0 为不限制
+	TestSizeEstimate       int               `yaml:"test_size_estimate"`             // 估计每次测试消耗的流量(KB), 默认为 10
+	MaxGoroutines          int               `yaml:"max_goroutines"`                 // 同时测试节点的协程数上限, 所有测试共用, 0 为不限制
+	FailureCooldown        int               `yaml:"failure_cooldown"`               // 节点测试全部失败后多少秒内不再测试, 0 为不启用
+	AssumeAlive            bool              `yaml:"assume_alive_when_missing"`      // 控制器未返回 alive 字段时视为可用, 默认为 true
+	ScoreExpr              string            `yaml:"score_expr"`                     // 自定义得分表达式, 可用变量 latency, jitter, flow, success, 为空时使用内置规则
+	ScoreOrder             string            `yaml:"score_order"`                    // 自定义得分的比较方式: lowest(默认, 得分低者优先) 或 highest
+	NodePriority           []string          `yaml:"node_priority"`                  // 节点优先级正则列表, 在延迟合格的节点中优先选择靠前的正则匹配的节点
+	StateFile              string            `yaml:"state_file"`                     // 保存测试结果的文件, 重启后用于临时选择最优节点, 为空时不保存
+	HistorySize            int               `yaml:"history_size"`                   // 内存中保留的最近切换记录数, 可通过 /status 和 history 命令查看, 默认为 20
+	SlowThreshold          int               `yaml:"slow_threshold"`                 // 当前节点延迟超过该值视为过慢, 默认为 latency_threshold 的 2 倍
+	SlowAction             string            `yaml:"slow_action"`                    // 当前节点过慢时的处理: next_cycle(默认, 下一轮选出最优节点后再决定), switch(立即切换), ignore(仅记录)
+	DeferSwitchWhenBusy    bool              `yaml:"defer_switch_when_busy"`         // 当前节点过慢但可用时, 如果经当前节点的流量超过 busy_threshold_kbps, 推迟切换直到流量下降
+	BusyThreshold          int               `yaml:"busy_threshold_kbps"`            // 视为正在传输的吞吐量(KB/s), 默认为 500
+	DeadFailures           int               `yaml:"dead_failures"`                  // 当前节点连续测试失败多少次视为不可用并立即切换, 默认为 1
+	PreferSameRegion       bool              `yaml:"prefer_same_region_on_failover"` // 当前节点不可用时先尝试与它同区域的节点, 没有可用的再切换到最优节点
+	PreferRecovery         bool              `yaml:"prefer_recovery"`                // 当前节点不可用而切换后, 每次检查时重新测试原节点, 恢复且延迟在阈值内时切换回去
+	RegionRegex            string            `yaml:"region_regex"`                   // 从节点名中提取区域的正则, 有捕获组时取第一个捕获组, 默认取第一段中文或英文字母
+	Profile                string            `yaml:"profile"`                        // 使用的配置方案, 会被 --profile 参数覆盖
+	StatusAddr             string            `yaml:"status_addr"`                    // 状态服务监听地址, 如 127.0.0.1:9091, 或 unix:/path 监听权限为 0600 的 unix socket, 为空时不启用
+	MetricsFile            string            `yaml:"metrics_file"`                   // 定期写入指标的文件, 供 node_exporter 的 textfile collector 读取, 文件名需以 .prom 结尾, 为空时不写入
+	MetricsFileInterval    int               `yaml:"metrics_file_interval"`          // 写入指标文件的间隔(秒), 默认为 60
+	ReportFile             string            `yaml:"report_file"`                    // 定期写入当前节点、节点列表和最近切换记录的报告文件, 以 .html 或 .htm 结尾时为 HTML, 否则为 Markdown, 为空时不写入
+	ReportInterval         int               `yaml:"report_interval"`                // 写入报告文件的间隔(秒), 默认为 3600
+	BreakerThreshold       int               `yaml:"breaker_threshold"`              // 控制器连续请求失败多少次后暂停请求, 默认为 5, 负数为不启用
+	BreakerCooldown        int               `yaml:"breaker_cooldown"`               // 暂停请求的时间(秒), 之后放行一个探测请求, 默认为 60
+	TestMethod             string            `yaml:"test_method"`                    // 测试方式: controller(默认, 通过控制器测试 test_url), tcp(直接连接节点服务器), icmp(ping 节点服务器)
+	NodeAddressFile        string            `yaml:"node_address_file"`              // 读取节点服务器地址的 Clash 配置文件, tcp/icmp 测试方式需要
+	CurrentTestProxy       string            `yaml:"current_test_proxy"`             // 检查当前节点时经该 Clash 入站端口访问测试 URL, 如 http://127.0.0.1:7890 或 socks5://127.0.0.1:7891, 使测试经过与实际流量相同的入站和规则, 为空时与其他节点相同
+	StartupGrace           int               `yaml:"startup_grace_period"`           // 启动后多少秒内不切换节点, 留出时间完成第一轮最优节点选择
+	WarmupDuration         int               `yaml:"warmup_duration"`                // 首次启动后的预热时间(秒), 期间多轮测试并累计结果, 结束后才第一次切换节点, 0 为不预热
+	StartupTimeout         int               `yaml:"startup_timeout"`                // 启动时等待控制器就绪的最长时间(秒), 超时后退出, 用于开机时与 Clash 同时启动的情况, 0 为不等待
+	MonitorOnly            bool              `yaml:"monitor_only"`                   // 只测试、记录和报告节点状态, 从不切换节点, 用于由其他工具负责切换的场景
+	SwitchRetries          int               `yaml:"switch_retries"`                 // 切换节点失败后的重试次数, 默认为 2, 负数为不重试
+	SwitchRetryDelay       int               `yaml:"switch_retry_delay"`             // 切换节点重试的间隔(毫秒), 默认为 500
+	PrewarmBeforeSwitch    bool              `yaml:"prewarm_before_switch"`          // 切换前先通过控制器经新节点访问一次 test_url, 提前建立连接
+	VerifyAfterSwitch      bool              `yaml:"verify_after_switch"`            // 切换后立即测试一次新节点(配置了 current_test_proxy 时经入站端口), 失败时切换到下一个候选节点
+	CurrentNodeFile        string            `yaml:"current_node_file"`              // 当前节点变化时写入节点名的文件, 为空时不写入
+	CurrentNodeFileLatency bool              `yaml:"current_node_file_latency"`      // 在 current_node_file 第二行写入当前节点的延迟
+	OnSwitchExec           string            `yaml:"on_switch_exec"`                 // 切换当前节点后执行的 shell 命令, 环境变量 AUTOCLASH_FROM 和 AUTOCLASH_TO 为切换前后的节点名, 输出记录到日志, 为空时不执行
+	OnSwitchTimeout        int               `yaml:"on_switch_timeout"`              // on_switch_exec 的超时时间(秒), 超时后结束命令, 默认为 30
+	SessionSummary         bool              `yaml:"session_summary"`                // 退出时在日志中输出本次运行的统计摘要
+	LogTimeFormat          string            `yaml:"log_time_format"`                // 日志时间的格式, 使用 Go 的时间格式, 如 2006-01-02T15:04:05.000Z07:00, 默认与标准库相同
+	LogTimezone            string            `yaml:"log_timezone"`                   // 日志时间使用的时区, 如 UTC、Asia/Shanghai, 默认为本机时区
+
+	scoreProgram  *vm.Program      // 编译后的得分表达式
+	priorityRes   []*regexp.Regexp // 编译后的 node_priority
+	excludeTestRe *regexp.Regexp   // 编译后的 exclude_from_test
+	infoNodeRe    *regexp.Regexp   // 编译后的 info_node_regex
+	regionURLs    []regionURL      // test_urls 中按区域指定的测试 URL, 按键排序
+	regionRe      *regexp.Regexp   // 编译后的 region_regex
+}
+
+// 单个测试 URL 的检查方式, 未设置的项使用全局配置
+type testURLOption struct {
+	ExpectStatus string `yaml:"expect_status"` // 期望的状态码, 格式与 test_expect_status 相同
+	Method       string `yaml:"method"`        // 请求方法 GET 或 HEAD, 只用于 autoclash 自己发出的请求(current_test_proxy)
+}
+
+// 按测试 URL 的检查方式, 键为完整的测试 URL
+type testURLOptions map[string]testURLOption
+
+// 按区域指定的测试 URL
+type regionURL struct {
+	re  *regexp.Regexp
+	url string
 }
 
 type ProxyNode struct {
-	Name    string  `json:"name"`
-	Type    string  `json:"type"`
-	Alive   bool    `json:"alive"`
-	Now     string  `json:"now"`
-	Flow    float64 `json:"-"`
-	Latency int     `json:"-"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Alive    *bool     `json:"alive"` // 部分控制器不返回该字段, 此时为 nil
+	Now      string    `json:"now"`
+	All      []string  `json:"all"` // 节点组的成员, 节点为空
+	Flow     float64   `json:"-"`
+	Latency  int       `json:"-"`
+	Jitter   int       `json:"-"` // 最近一轮测试延迟的标准差
+	Success  int       `json:"-"` // 最近一轮测试成功次数
+	Loss     float64   `json:"-"` // 最近一轮测试失败次数占测试次数的比例
+	TestedAt time.Time `json:"-"` // 测试结果的时间, 为零表示没有可用的测试结果
+	Stale    bool      `json:"-"` // 测试结果来自上次运行, 尚未重新测试
+	Healthy  int       `json:"-"` // 连续多少轮测试延迟在阈值内
+	Address  string    `json:"-"` // 节点服务器地址(host:port), 来自 node_address_file
+	Reason   string    `json:"-"` // 最近一轮选择的结果代码, 见 reasonBest 等常量
 }
 
 type ProxiesResponse struct {
 	Proxies map[string]ProxyNode `json:"proxies"`
 }
 
+// 控制器错误类型，调用方可通过 errors.Is 区分并做不同处理
+var (
+	ErrAuth          = errors.New("控制器认证失败")
+	ErrUnreachable   = errors.New("无法连接控制器")
+	ErrGroupNotFound = errors.New("节点组不存在")
+	ErrNodeNotFound  = errors.New("节点不存在")
+)
+
+var errStartupGrace = errors.New("启动保护期内不切换节点")
+var errMonitorOnly = errors.New("仅监控模式不切换节点")
+var errVerifyFailed = errors.New("切换后验证失败")
+var errStaleNodeList = errors.New("节点列表过旧, 不切换节点")
+
+// 收到退出信号时取消, 之后被中断的测试不计为节点失败, 也不会因此切换节点
+var gShutdown, stopAll = context.WithCancel(context.Background())
+
+var errShutdown = errors.New("正在退出")
+
+// 切换失败时最多依次尝试的候选节点数
+const failoverCandidates = 3
+
 var gConfig *Config
+var gVerbose bool
+var gDebug bool         // 输出每个控制器请求
+var gProfileName string // --profile 参数指定的配置方案
+var gConfigDir string   // --config-dir 参数指定的配置目录
 var gNodes []*ProxyNode
 var gCurrent *ProxyNode
 var gBest *ProxyNode
+var gStartedAt = time.Now()
+var gDecision *selectionDecision                 // 最近一次选择最优节点的依据
+var gSlowPending bool                            // 当前节点过慢, 等待下一轮选出最优节点后决定是否切换
+var gCurrentFailures int                         // 当前节点连续测试失败的次数
+var gMeasurements = make(map[string]measurement) // 按节点名保存的测试结果, 更新节点列表后仍然保留
+var gCurrentLatency = -1                         // 最近一次检查当前节点的延迟, -1 为测试失败或未测试
+var gCurrentCheckedAt time.Time                  // 最近一次检查当前节点的时间
+var gRecoverTo string                            // 启用 prefer_recovery 时, 因不可用而切换走的节点, 恢复后切换回去
+var gControllerLatency = -1                      // 最近一轮选择时访问控制器本身的耗时, -1 为失败或未测试
+var gSwitchReason string                         // 下一次切换的原因, 由发起切换的地方设置, 记录在切换记录中
+var gFilterChecked bool                          // 是否已检查过筛选条件, 只在第一次获取节点列表时检查
+var gNodesUpdatedAt time.Time                    // 最近一次成功更新节点列表的时间
+var gNodeListStale bool                          // 是否已因节点列表过旧告警, 更新成功后清除
 var mu sync.Mutex
 
+// 同一时间只进行一轮测试, 定时选择和手动重新选择不会同时测试所有节点
+var sweepMu sync.Mutex
+
+// 对控制器的写请求同一时间只发出一个, 避免多个协程同时切换时请求乱序或互相覆盖; 读请求不受影响
+var writeMu sync.Mutex
+
+// 订阅在节点列表中插入的信息节点, 如 "剩余流量：10GB"、"套餐到期：2025-12-31"
+const defaultInfoNodeRegex = `剩余流量|流量剩余|已用流量|套餐到期|到期时间|过期时间|距离下次重置|流量重置|官网|官方网址|(?i)expire|traffic|remaining`
+
+// test_expect_status 的格式, 与 Clash.Meta 的 expected 参数相同
+var expectStatusRe = regexp.MustCompile(`^\d{3}(-\d{3})?(/\d{3}(-\d{3})?)*$`)
+
 // 加载配置文件
 func loadConfig(filePath string) (*Config, error) {
 	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("读取配置文件失败: %v", err)
 	}
-	var config Config
-	err = yaml.Unmarshal(data, &config)
+	// 默认值, 配置文件中的设置会覆盖
+	config := Config{
+		AssumeAlive: true,
+	}
+	var raw map[string]any
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("解析配置文件失败: %v", err)
+	}
+	if raw == nil {
+		raw = make(map[string]any)
+	}
+	if gConfigDir != "" {
+		if err := mergeConfigDir(raw, gConfigDir); err != nil {
+			return nil, err
+		}
+	}
+	raw, err = applyProfile(raw, gProfileName)
+	if err != nil {
+		return nil, err
+	}
+	merged, _ := yaml.Marshal(raw)
+	err = yaml.Unmarshal(merged, &config)
 	if err != nil {
 		return nil, fmt.Errorf("解析配置文件失败: %v", err)
 	}
+	// 环境变量覆盖配置文件, 需要在计算依赖其他配置项的默认值之前
 	v := reflect.ValueOf(&config).Elem()
 	t := v.Type()
 	for i := range v.NumField() {
 		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
 		envName := "AUTOCLASH_" + strings.ToUpper(field.Name)
 		envValue := os.Getenv(envName)
 		if envValue != "" {
-			v.Field(i).SetString(envValue)
+			if err := setFromEnv(v.Field(i), envValue); err != nil {
+				return nil, fmt.Errorf("环境变量 %s 无效: %v", envName, err)
+			}
 		}
 	}
+	if err := resolveAPIKey(&config); err != nil {
+		return nil, err
+	}
+	discoverController(&config)
+	if config.SlowThreshold == 0 {
+		config.SlowThreshold = config.LatencyThreshold * 2
+	}
+	clampInterval("retrieve_interval", &config.RetrieveInterval)
+	clampInterval("current_interval", &config.CurrentInterval)
+	clampInterval("best_interval", &config.BestInterval)
+	if config.OnDuplicateName == "" {
+		config.OnDuplicateName = "warn"
+	}
+	if config.TestTimeoutMS <= 0 {
+		config.TestTimeoutMS = 5000
+	}
+	if config.TestSizeEstimate <= 0 {
+		config.TestSizeEstimate = 10
+	}
+	if config.MetricsFileInterval <= 0 {
+		config.MetricsFileInterval = 60
+	}
+	if config.HistorySize <= 0 {
+		config.HistorySize = defaultHistorySize
+	}
+	if config.OnSwitchTimeout <= 0 {
+		config.OnSwitchTimeout = 30
+	}
+	if config.ReportInterval <= 0 {
+		config.ReportInterval = 3600
+	}
+	if config.SwitchGroup == "" {
+		config.SwitchGroup = config.SelectNode
+	}
+	if config.CurrentGroup == "" {
+		config.CurrentGroup = config.SwitchGroup
+	}
+	if config.SelectionMode == "" {
+		config.SelectionMode = "flow_groups"
+	}
+	if config.PenaltySlope == 0 {
+		config.PenaltySlope = 1
+	}
+	if config.StickyDegradeThreshold <= 0 {
+		config.StickyDegradeThreshold = config.LatencyThreshold
+	}
+	if config.TieBreak == "" {
+		config.TieBreak = "name"
+	}
+	if config.RegionRegex == "" {
+		config.RegionRegex = defaultRegionRegex
+	}
+	if config.InfoNodeRegex == "" {
+		config.InfoNodeRegex = defaultInfoNodeRegex
+	}
+	if config.TagDelimiter == "" {
+		config.TagDelimiter = "|"
+	}
+	if config.SlowAction == "" {
+		config.SlowAction = "next_cycle"
+	}
+	if config.BusyThreshold <= 0 {
+		config.BusyThreshold = 500
+	}
+	if config.TreatZeroAs == "" {
+		config.TreatZeroAs = "failure"
+	}
+	if config.DeadFailures == 0 {
+		config.DeadFailures = 1
+	}
+	if config.SwitchRetries == 0 {
+		config.SwitchRetries = 2
+	}
+	if config.SwitchRetryDelay <= 0 {
+		config.SwitchRetryDelay = 500
+	}
+	if config.BreakerThreshold == 0 {
+		config.BreakerThreshold = 5
+	}
+	if config.BreakerCooldown <= 0 {
+		config.BreakerCooldown = 60
+	}
+	if err := validateConfig(&config); err != nil {
+		return nil, err
+	}
 	return &config, nil
 }
 
+// 定时任务的最小间隔(秒)
+const minInterval = 1
+
+// 间隔小于 minInterval 时改为 minInterval 并给出警告, 避免写错配置导致定时器 panic
+func clampInterval(name string, interval *int) {
+	if *interval < minInterval {
+		log.Printf("警告: %s 为 %d, 小于 %d 秒, 按 %d 秒处理", name, *interval, minInterval, minInterval)
+		*interval = minInterval
+	}
+}
+
+// 按配置项的类型解析环境变量的值
+func setFromEnv(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("该配置项不支持通过环境变量设置")
+	}
+	return nil
+}
+
+var envRefRe = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// 解析 API 密钥: 从 api_key_file 读取, 或替换 api_key 中的 ${环境变量}。
+// 错误信息中只包含文件路径和变量名, 不包含密钥
+func resolveAPIKey(config *Config) error {
+	if config.APIKeyFile != "" {
+		if config.APIKey != "" {
+			return fmt.Errorf("api_key 和 api_key_file 只能设置一个")
+		}
+		data, err := os.ReadFile(config.APIKeyFile)
+		if err != nil {
+			return fmt.Errorf("读取 api_key_file 失败: %v", err)
+		}
+		config.APIKey = strings.TrimSpace(string(data))
+		return nil
+	}
+	var missing []string
+	config.APIKey = envRefRe.ReplaceAllStringFunc(config.APIKey, func(ref string) string {
+		name := envRefRe.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return fmt.Errorf("api_key 引用的环境变量未设置: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// 按文件名顺序读取目录中的 *.yml 文件并合并到 raw 上, 后读取的文件中的顶层配置项覆盖之前的同名项
+func mergeConfigDir(raw map[string]any, dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yml"))
+	if err != nil {
+		return fmt.Errorf("读取配置目录失败: %v", err)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("读取配置文件失败: %v", err)
+		}
+		var overlay map[string]any
+		if err := yaml.Unmarshal(data, &overlay); err != nil {
+			return fmt.Errorf("解析配置文件 %s 失败: %v", file, err)
+		}
+		for key, value := range overlay {
+			raw[key] = value
+		}
+	}
+	return nil
+}
+
+// 将选中的配置方案合并到基础配置上, 方案中的配置项覆盖基础配置中的同名项。
+// name 为空时使用配置文件中 profile 指定的方案, 都未指定时直接使用基础配置
+func applyProfile(raw map[string]any, name string) (map[string]any, error) {
+	profiles, _ := raw["profiles"].(map[string]any)
+	delete(raw, "profiles")
+	if name == "" {
+		name, _ = raw["profile"].(string)
+	}
+	if name == "" {
+		return raw, nil
+	}
+	profile, ok := profiles[name].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("配置方案不存在: %s", name)
+	}
+	for key, value := range profile {
+		raw[key] = value
+	}
+	raw["profile"] = name
+	return raw, nil
+}
+
+// 检查配置是否有效, 返回遇到的第一个错误
+func validateConfig(config *Config) error {
+	if config.APIEndpoint == "" {
+		return fmt.Errorf("api_endpoint 不能为空")
+	}
+	if _, err := url.ParseRequestURI(config.APIEndpoint); err != nil {
+		return fmt.Errorf("api_endpoint 无效: %v", err)
+	}
+	if _, err := regexp.Compile(config.IncludeRegex); err != nil {
+		return fmt.Errorf("include_regex 无效: %v", err)
+	}
+	if _, err := regexp.Compile(config.ExcludeRegex); err != nil {
+		return fmt.Errorf("exclude_regex 无效: %v", err)
+	}
+	positives := []struct {
+		name  string
+		value int
+	}{
+		{"test_times", config.TestTimes},
+		{"latency_threshold", config.LatencyThreshold},
+	}
+	for _, p := range positives {
+		if p.value <= 0 {
+			return fmt.Errorf("%s 必须大于 0: %d", p.name, p.value)
+		}
+	}
+	if config.UsagePenaltyWeight < 0 {
+		return fmt.Errorf("usage_penalty_weight 不能为负数: %v", config.UsagePenaltyWeight)
+	}
+	if config.ProfileWeight < 0 || config.ProfileWeight > 1 {
+		return fmt.Errorf("profile_weight 必须在 0 到 1 之间: %v", config.ProfileWeight)
+	}
+	if config.MaxLossRatio < 0 || config.MaxLossRatio > 1 {
+		return fmt.Errorf("max_loss_ratio 必须在 0 到 1 之间: %v", config.MaxLossRatio)
+	}
+	if config.LossPenalty < 0 {
+		return fmt.Errorf("loss_penalty_ms 不能为负数: %v", config.LossPenalty)
+	}
+	if config.MaxNodeListAge < 0 || config.MaxNodeListAge > 0 && config.MaxNodeListAge < config.RetrieveInterval {
+		return fmt.Errorf("max_node_list_age 不能为负数, 也不能小于 retrieve_interval: %d", config.MaxNodeListAge)
+	}
+	if config.MeasurementFreshness < 0 {
+		return fmt.Errorf("measurement_freshness 不能为负数: %d", config.MeasurementFreshness)
+	}
+	if config.StartupTimeout < 0 {
+		return fmt.Errorf("startup_timeout 不能为负数: %d", config.StartupTimeout)
+	}
+	if config.LatencyHistorySize < 0 {
+		return fmt.Errorf("latency_history_size 不能为负数: %d", config.LatencyHistorySize)
+	}
+	if config.DegradePercent < 0 {
+		return fmt.Errorf("degrade_percent 不能为负数: %v", config.DegradePercent)
+	}
+	if config.MinStabilityCycles < 0 {
+		return fmt.Errorf("min_stability_cycles 不能为负数: %d", config.MinStabilityCycles)
+	}
+	if config.FailureCooldown < 0 {
+		return fmt.Errorf("failure_cooldown 不能为负数: %d", config.FailureCooldown)
+	}
+	if config.MaxGoroutines < 0 {
+		return fmt.Errorf("max_goroutines 不能为负数: %d", config.MaxGoroutines)
+	}
+	if config.TestBandwidthBudget < 0 {
+		return fmt.Errorf("test_bandwidth_budget 不能为负数: %d", config.TestBandwidthBudget)
+	}
+	if config.BestSampleSize < 0 {
+		return fmt.Errorf("best_sample_size 不能为负数: %d", config.BestSampleSize)
+	}
+	if config.TestShardSize < 0 {
+		return fmt.Errorf("test_shard_size 不能为负数: %d", config.TestShardSize)
+	}
+	if config.TestShardSize > 0 && config.BestSampleSize > 0 {
+		return fmt.Errorf("test_shard_size 和 best_sample_size 只能设置一个")
+	}
+	switch config.TestMethod {
+	case "", "controller":
+	case "tcp", "icmp":
+		if config.NodeAddressFile == "" {
+			return fmt.Errorf("test_method 为 %s 时需要配置 node_address_file", config.TestMethod)
+		}
+	default:
+		return fmt.Errorf("test_method 只能为 controller、tcp 或 icmp: %s", config.TestMethod)
+	}
+	if config.CurrentTestProxy != "" {
+		proxyURL, err := url.Parse(config.CurrentTestProxy)
+		if err != nil || proxyURL.Host == "" || proxyURL.Scheme != "http" && proxyURL.Scheme != "socks5" {
+			return fmt.Errorf("current_test_proxy 应为 http://host:port 或 socks5://host:port: %s", config.CurrentTestProxy)
+		}
+	}
+	for field := range config.ProxyFields {
+		if _, ok := proxyFieldAliases[field]; !ok {
+			return fmt.Errorf("proxy_fields 只能设置 name、type、alive、now、all: %s", field)
+		}
+	}
+	if config.LogTimezone != "" {
+		if _, err := time.LoadLocation(config.LogTimezone); err != nil {
+			return fmt.Errorf("log_timezone 无效: %v", err)
+		}
+	}
+	if err := validateDelayRequest(config.DelayRequest); err != nil {
+		return err
+	}
+	switch config.OnDuplicateName {
+	case "warn", "first_alive", "skip":
+	default:
+		return fmt.Errorf("on_duplicate_name 只能为 warn、first_alive 或 skip: %s", config.OnDuplicateName)
+	}
+	switch config.SlowAction {
+	case "next_cycle", "switch", "ignore":
+	default:
+		return fmt.Errorf("slow_action 只能为 next_cycle、switch 或 ignore: %s", config.SlowAction)
+	}
+	switch config.TreatZeroAs {
+	case "failure", "success_min", "ignore":
+	default:
+		return fmt.Errorf("treat_zero_as 只能为 failure、success_min 或 ignore: %s", config.TreatZeroAs)
+	}
+	if config.StatusAddr == unixAddrPrefix {
+		return fmt.Errorf("status_addr 的 unix socket 路径不能为空")
+	}
+	if config.SlowThreshold < 0 || config.DeadFailures < 0 || config.StartupGrace < 0 || config.WarmupDuration < 0 {
+		return fmt.Errorf("slow_threshold、dead_failures、startup_grace_period 和 warmup_duration 不能为负数")
+	}
+	config.excludeTestRe = nil
+	if config.ExcludeFromTest != "" {
+		re, err := regexp.Compile(config.ExcludeFromTest)
+		if err != nil {
+			return fmt.Errorf("exclude_from_test 无效: %v", err)
+		}
+		config.excludeTestRe = re
+	}
+	infoNodeRe, err := regexp.Compile(config.InfoNodeRegex)
+	if err != nil {
+		return fmt.Errorf("info_node_regex 无效: %v", err)
+	}
+	config.infoNodeRe = infoNodeRe
+	config.priorityRes = nil
+	for _, expr := range config.NodePriority {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("node_priority 无效: %v", err)
+		}
+		config.priorityRes = append(config.priorityRes, re)
+	}
+	switch config.SelectionMode {
+	case "", "flow_groups", "soft_penalty", "sticky":
+	default:
+		return fmt.Errorf("selection_mode 只能为 flow_groups、soft_penalty 或 sticky: %s", config.SelectionMode)
+	}
+	if config.PenaltySlope < 0 {
+		return fmt.Errorf("penalty_slope 不能为负数: %v", config.PenaltySlope)
+	}
+	if config.FlowJumpRatio != 0 && config.FlowJumpRatio < 1 {
+		return fmt.Errorf("flow_jump_ratio 应大于等于 1: %v", config.FlowJumpRatio)
+	}
+	if config.FlowLatencyPenalty < 0 {
+		return fmt.Errorf("flow_latency_penalty_ms 不能为负数: %v", config.FlowLatencyPenalty)
+	}
+	if config.FlowLatencyPenalty > 0 && config.SelectionMode == "soft_penalty" {
+		return fmt.Errorf("flow_latency_penalty_ms 不能与 selection_mode: soft_penalty 同时使用")
+	}
+	if config.TestExpectStatus != "" && !expectStatusRe.MatchString(config.TestExpectStatus) {
+		return fmt.Errorf("test_expect_status 无效, 应为状态码或范围, 多个用 / 分隔, 如 204 或 200-299/302: %s", config.TestExpectStatus)
+	}
+	for testURL, option := range config.TestURLOptions {
+		if _, err := url.ParseRequestURI(testURL); err != nil {
+			return fmt.Errorf("test_url_options 中的 URL 无效: %v", err)
+		}
+		if option.ExpectStatus != "" && !expectStatusRe.MatchString(option.ExpectStatus) {
+			return fmt.Errorf("test_url_options 中 %s 的 expect_status 无效: %s", testURL, option.ExpectStatus)
+		}
+		switch option.Method {
+		case "", http.MethodGet, http.MethodHead:
+		default:
+			return fmt.Errorf("test_url_options 中 %s 的 method 只能为 GET 或 HEAD: %s", testURL, option.Method)
+		}
+	}
+	switch config.TieBreak {
+	case "", "name", "jitter", "current":
+	default:
+		return fmt.Errorf("tie_break 只能为 name、jitter 或 current: %s", config.TieBreak)
+	}
+	regionRe, err := regexp.Compile(config.RegionRegex)
+	if err != nil {
+		return fmt.Errorf("region_regex 无效: %v", err)
+	}
+	config.regionRe = regionRe
+	config.regionURLs = nil
+	if config.ProbeURL != "" {
+		if _, err := url.ParseRequestURI(config.ProbeURL); err != nil {
+			return fmt.Errorf("probe_url 无效: %v", err)
+		}
+	}
+	if config.DegradeWebhook != "" {
+		if _, err := url.ParseRequestURI(config.DegradeWebhook); err != nil {
+			return fmt.Errorf("degrade_webhook 无效: %v", err)
+		}
+	}
+	keys := make([]string, 0, len(config.TestURLs))
+	for key := range config.TestURLs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, err := url.ParseRequestURI(config.TestURLs[key]); err != nil {
+			return fmt.Errorf("test_urls 中 %s 的 URL 无效: %v", key, err)
+		}
+	}
+	// select_node 为空时切换的节点组要等自动选择后才能确定, 由 applySelectGroup 区分
+	if config.SwitchGroup != "" {
+		if err := compileTestURLs(config); err != nil {
+			return err
+		}
+	}
+	if err := compileScoreExpr(config); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 根据响应状态码生成对应的错误, notFound 为 404 时返回的错误
+func checkStatus(resp *http.Response, notFound error) error {
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w，状态码: %d", ErrAuth, resp.StatusCode)
+	case resp.StatusCode == http.StatusNotFound && notFound != nil:
+		return fmt.Errorf("%w，状态码: %d", notFound, resp.StatusCode)
+	default:
+		return fmt.Errorf("请求失败，状态码: %d", resp.StatusCode)
+	}
+}
+
 // 获取节点流量系数
 func getFlow(nodeName string) float64 {
 	// 从节点名中提取流量系数， 名字中含有(d.dx)或(dx)的格式或者dx的格式, 例如1.0x, 1.5x, 2.0x或1x,2x
@@ -96,35 +734,65 @@ func getFlow(nodeName string) float64 {
 	return 1.0
 }
 
-// 从获取节点列表
-func getNodes() ([]*ProxyNode, *ProxyNode, error) {
+// 从控制器获取全部代理及节点组
+func fetchProxies() (*ProxiesResponse, error) {
 	client := &http.Client{}
 	req, err := http.NewRequest("GET", gConfig.APIEndpoint+"/proxies", nil)
 	if err != nil {
-		return nil, nil, fmt.Errorf("创建请求失败: %v", err)
+		return nil, fmt.Errorf("创建请求失败: %v", err)
 	}
 	req.Header.Set("Authorization", "Bearer "+gConfig.APIKey)
 
-	resp, err := client.Do(req)
+	resp, err := doRequest(client, req)
 	if err != nil {
-		return nil, nil, fmt.Errorf("获取节点列表失败: %v", err)
+		return nil, fmt.Errorf("获取节点列表失败: %w: %w", ErrUnreachable, err)
 	}
 	defer resp.Body.Close()
 
+	if err := checkStatus(resp, nil); err != nil {
+		return nil, fmt.Errorf("获取节点列表失败: %w", err)
+	}
+
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, nil, fmt.Errorf("读取响应失败: %v", err)
+		return nil, fmt.Errorf("读取响应失败: %v", err)
+	}
+
+	proxiesResp, err := parseProxies(body)
+	if err != nil {
+		return nil, fmt.Errorf("解析节点列表失败: %v", err)
 	}
+	detectCore()
+	return proxiesResp, nil
+}
 
-	var proxiesResp ProxiesResponse
-	err = json.Unmarshal(body, &proxiesResp)
+// 从获取节点列表
+func getNodes() ([]*ProxyNode, *ProxyNode, error) {
+	proxiesResp, err := fetchProxies()
 	if err != nil {
-		return nil, nil, fmt.Errorf("解析节点列表失败: %v", err)
+		return nil, nil, err
+	}
+	return parseNodes(proxiesResp)
+}
+
+// 从代理列表中取出可用且符合筛选条件的节点, 以及 current_group 当前使用的节点
+func parseNodes(proxiesResp *ProxiesResponse) ([]*ProxyNode, *ProxyNode, error) {
+	group, ok := proxiesResp.Proxies[gConfig.SwitchGroup]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrGroupNotFound, gConfig.SwitchGroup)
+	}
+	if group.Type != "Selector" {
+		return nil, nil, fmt.Errorf("%w: %s 的类型为 %s, 不是 Selector", ErrGroupNotFound, gConfig.SwitchGroup, group.Type)
 	}
+	currentGroup, ok := proxiesResp.Proxies[gConfig.CurrentGroup]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrGroupNotFound, gConfig.CurrentGroup)
+	}
+
 	ignoreTypes := []string{"Selector", "Direct", "URLTest", "Fallback", "LoadBalance", "Reject", "Selector"}
 	var nodes []*ProxyNode
 	var current *ProxyNode
-	var currentName string
+	currentName := currentGroup.Now
 	for i := range proxiesResp.Proxies {
 		toIgnore := false
 		node := proxiesResp.Proxies[i]
@@ -134,21 +802,38 @@ func getNodes() ([]*ProxyNode, *ProxyNode, error) {
 				continue
 			}
 		}
-		if node.Name == gConfig.SelectNode {
-			currentName = node.Now
+		if node.Name == gConfig.SwitchGroup || node.Name == gConfig.CurrentGroup {
 			continue
 		}
-		if toIgnore || !node.Alive {
+		if toIgnore || !isAlive(&node) || infoNode(node.Name) {
 			continue
 		}
 		node.Flow = getFlow(node.Name)
 		nodes = append(nodes, &node)
 	}
 
-	nodes, err = filterNodes(nodes)
+	candidates := nodes
+	nodes, err := filterNodes(candidates)
 	if err != nil {
 		return nil, nil, fmt.Errorf("筛选节点失败: %v", err)
 	}
+	if !gFilterChecked {
+		gFilterChecked = true
+		if warning := emptyFilterWarning(candidates, nodes); warning != "" {
+			log.Printf("A 警告: %s", warning)
+		}
+	}
+	// 控制器返回的是 map, 按节点名排序使每次运行的顺序相同
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	if gConfig.NodeAddressFile != "" {
+		addresses, err := loadNodeAddresses(gConfig.NodeAddressFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, node := range nodes {
+			node.Address = addresses[node.Name]
+		}
+	}
 	for i := range nodes {
 		node := nodes[i]
 		if node.Name == currentName {
@@ -159,6 +844,19 @@ func getNodes() ([]*ProxyNode, *ProxyNode, error) {
 	return nodes, current, nil
 }
 
+// 是否为订阅插入的剩余流量、到期时间等信息节点
+func infoNode(name string) bool {
+	return gConfig.infoNodeRe != nil && gConfig.infoNodeRe.MatchString(name)
+}
+
+// 判断节点是否可用, 未返回 alive 字段时按配置处理
+func isAlive(node *ProxyNode) bool {
+	if node.Alive == nil {
+		return gConfig.AssumeAlive
+	}
+	return *node.Alive
+}
+
 // 根据正则表达式筛选节点
 func filterNodes(nodes []*ProxyNode) ([]*ProxyNode, error) {
 	includeRe, err := regexp.Compile(gConfig.IncludeRegex)
@@ -173,54 +871,189 @@ func filterNodes(nodes []*ProxyNode) ([]*ProxyNode, error) {
 	var filtered []*ProxyNode
 	for i := range nodes {
 		node := nodes[i]
-		if includeRe.MatchString(node.Name) && !excludeRe.MatchString(node.Name) {
+		if includeRe.MatchString(node.Name) && !excludeRe.MatchString(node.Name) && tagsMatch(node.Name) && typeMatches(node.Type) {
 			filtered = append(filtered, node)
 		}
 	}
 	return filtered, nil
 }
 
+// 筛选前有节点而筛选后没有节点时, 返回包含筛选条件和部分被排除节点名的警告, 否则返回空字符串
+func emptyFilterWarning(candidates, filtered []*ProxyNode) string {
+	if len(candidates) == 0 || len(filtered) > 0 {
+		return ""
+	}
+	var samples []string
+	for _, node := range candidates[:min(len(candidates), 5)] {
+		samples = append(samples, node.Name)
+	}
+	warning := fmt.Sprintf("%d 个节点全部被筛选条件排除, include_regex: %q, exclude_regex: %q", len(candidates), gConfig.IncludeRegex, gConfig.ExcludeRegex)
+	if len(gConfig.RequireTags)+len(gConfig.ExcludeTags)+len(gConfig.IncludeTypes)+len(gConfig.ExcludeTypes) > 0 {
+		warning += ", 另外设置了 require_tags / exclude_tags / include_types / exclude_types"
+	}
+	warning += fmt.Sprintf("。被排除的节点如: %s", strings.Join(samples, ", "))
+	if gConfig.ExcludeRegex == "" {
+		warning += "。注意 exclude_regex 为空时会排除所有节点"
+	}
+	return warning
+}
+
+// 解析节点名中的标签, 如 "香港 01 |IEPL|BGP|" 的标签为 IEPL 和 BGP
+func nodeTags(name string) []string {
+	parts := strings.Split(name, gConfig.TagDelimiter)
+	if len(parts) < 3 {
+		return nil
+	}
+	var tags []string
+	for _, part := range parts[1 : len(parts)-1] {
+		if tag := strings.TrimSpace(part); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// 节点的协议类型是否满足 include_types 和 exclude_types, 类型比较不区分大小写
+func typeMatches(nodeType string) bool {
+	has := func(types []string) bool {
+		for _, t := range types {
+			if strings.EqualFold(t, nodeType) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(gConfig.IncludeTypes) > 0 && !has(gConfig.IncludeTypes) {
+		return false
+	}
+	return !has(gConfig.ExcludeTypes)
+}
+
+// 节点名中的标签是否满足 require_tags 和 exclude_tags, 标签比较不区分大小写
+func tagsMatch(name string) bool {
+	if len(gConfig.RequireTags) == 0 && len(gConfig.ExcludeTags) == 0 {
+		return true
+	}
+	tags := nodeTags(name)
+	has := func(want string) bool {
+		for _, tag := range tags {
+			if strings.EqualFold(tag, want) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, tag := range gConfig.RequireTags {
+		if !has(tag) {
+			return false
+		}
+	}
+	for _, tag := range gConfig.ExcludeTags {
+		if has(tag) {
+			return false
+		}
+	}
+	return true
+}
+
 // 并行测试节点延迟
-func testNode(node *ProxyNode) int {
+// ctx 被取消时测试中断并返回错误, 调用方应检查 ctx.Err() 区分取消和节点本身的失败
+func testNode(ctx context.Context, node *ProxyNode) (int, error) {
 	if node == nil {
-		return -1
+		return -1, ErrNodeNotFound
+	}
+	switch gConfig.TestMethod {
+	case "tcp":
+		return tcpPing(ctx, node)
+	case "icmp":
+		return icmpPing(ctx, node)
 	}
+	return controllerDelay(ctx, node, testURLFor(node))
+}
+
+// 客户端超时比控制器的测试超时多出的时间, 避免控制器返回超时结果前客户端先放弃
+const testClientBuffer = 2 * time.Second
+
+// 控制器测试节点时客户端的超时时间
+func testClientTimeout() time.Duration {
+	return time.Duration(gConfig.TestTimeoutMS)*time.Millisecond + testClientBuffer
+}
+
+// 通过控制器经节点访问 testURL, 返回延迟
+func controllerDelay(ctx context.Context, node *ProxyNode, testURL string) (int, error) {
 	// log.Println("测试节点: ", node.Name)
-	client := &http.Client{Timeout: 5 * time.Second}
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/proxies/%s/delay?url=%s&timeout=5000", gConfig.APIEndpoint, node.Name, gConfig.TestURL), nil)
+	client := &http.Client{Timeout: testClientTimeout()}
+	req, err := newDelayRequest(ctx, node, testURL)
 	if err != nil {
-		return -1
+		return -1, fmt.Errorf("创建请求失败: %v", err)
 	}
 	req.Header.Set("Authorization", "Bearer "+gConfig.APIKey)
 
-	resp, err := client.Do(req)
+	resp, err := doRequest(client, req)
 	if err != nil {
-		return -1
+		return -1, fmt.Errorf("测试节点失败: %w: %w", ErrUnreachable, err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return -1
+	if err := checkStatus(resp, ErrNodeNotFound); err != nil {
+		return -1, fmt.Errorf("测试节点失败: %w", err)
 	}
 
-	var result struct {
-		Delay int `json:"delay"`
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return -1, fmt.Errorf("读取响应失败: %v", err)
 	}
-	err = json.NewDecoder(resp.Body).Decode(&result)
+	delay, err := parseDelay(body)
 	if err != nil {
-		return -1
+		return -1, fmt.Errorf("解析测试结果失败: %v", err)
+	}
+	return delay, nil
+}
+
+// 将 test_urls 分为切换的节点组和按区域匹配节点名的正则, 切换的节点组确定后调用
+func compileTestURLs(config *Config) error {
+	config.regionURLs = nil
+	keys := make([]string, 0, len(config.TestURLs))
+	for key := range config.TestURLs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == config.SwitchGroup {
+			continue
+		}
+		re, err := regexp.Compile(key)
+		if err != nil {
+			return fmt.Errorf("test_urls 中的 %s 既不是节点组名也不是有效的正则: %v", key, err)
+		}
+		config.regionURLs = append(config.regionURLs, regionURL{re: re, url: config.TestURLs[key]})
 	}
+	return nil
+}
 
-	return result.Delay
+// 节点使用的测试 URL: 先按区域匹配节点名, 再按切换的节点组, 都没有配置时使用 test_url
+func testURLFor(node *ProxyNode) string {
+	for _, region := range gConfig.regionURLs {
+		if region.re.MatchString(node.Name) {
+			return region.url
+		}
+	}
+	if testURL, ok := gConfig.TestURLs[gConfig.SwitchGroup]; ok {
+		return testURL
+	}
+	return gConfig.TestURL
 }
 
 // 切换到指定节点
 func switchNode(node *ProxyNode) error {
 	if node == nil {
-		return fmt.Errorf("无效的节点名")
+		return fmt.Errorf("无效的节点名: %w", ErrNodeNotFound)
 	}
+	// 持有到读完响应, 下一个写请求在控制器处理完这一个之后才发出
+	writeMu.Lock()
+	defer writeMu.Unlock()
 	client := &http.Client{}
-	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/proxies/%s", gConfig.APIEndpoint, gConfig.SelectNode), nil)
+	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/proxies/%s", gConfig.APIEndpoint, url.PathEscape(gConfig.SwitchGroup)), nil)
 	if err != nil {
 		return fmt.Errorf("创建请求失败: %v", err)
 	}
@@ -230,80 +1063,472 @@ func switchNode(node *ProxyNode) error {
 	jsonPayload, _ := json.Marshal(payload)
 	req.Body = io.NopCloser(bytes.NewReader(jsonPayload))
 
-	resp, err := client.Do(req)
+	resp, err := doRequest(client, req)
 	if err != nil {
-		return fmt.Errorf("切换节点失败: %v", err)
+		return fmt.Errorf("切换节点失败: %w: %w", ErrUnreachable, err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode > 299 || resp.StatusCode < 200 {
-		return fmt.Errorf("切换节点失败，状态码: %d", resp.StatusCode)
+	// 节点组不存在时返回 404; 400 可能是节点不在组内, 也可能是请求体无效, 需根据返回信息区分
+	if resp.StatusCode == http.StatusBadRequest {
+		var result struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		if strings.Contains(result.Message, "proxy not exist") {
+			return fmt.Errorf("切换节点失败: %w: %s", ErrNodeNotFound, node.Name)
+		}
+		return fmt.Errorf("切换节点失败，状态码: %d, %s", resp.StatusCode, result.Message)
+	}
+	if err := checkStatus(resp, ErrGroupNotFound); err != nil {
+		return fmt.Errorf("切换节点失败: %w", err)
 	}
 
 	return nil
 }
 
-// 选择最优的节点
+// 选择最优的节点。调用时不能持有 mu: 测试期间不持有 mu, 其他协程和状态服务继续使用上一轮的结果,
+// 测试完成后再持有 mu 记录结果并选择
 func selectFastestNode() (*ProxyNode, error) {
-	var wg sync.WaitGroup
-
-	for i := range gNodes {
-		node := gNodes[i]
-		wg.Add(1)
-		go func(node *ProxyNode) {
-			defer wg.Done()
-			totalLatency := 0
-			successCount := 0
-			for range gConfig.TestTimes {
-				latency := testNode(node)
-				if latency > 0 {
-					totalLatency += latency
-					successCount++
-				}
-				time.Sleep(1 * time.Second) // 避免过于频繁测试
-			}
-			if successCount > 0 {
-				node.Latency = totalLatency / successCount
-			} else {
-				node.Latency = -1
-			}
-		}(node)
+	sweepMu.Lock()
+	defer sweepMu.Unlock()
+	ctx := gShutdown
+	if gConfig.BestDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(gConfig.BestDeadline)*time.Second)
+		defer cancel()
 	}
 
-	wg.Wait()
+	// 测试节点的副本, 测试期间节点列表可能被更新, 原来的节点也可能被其他协程修改
+	mu.Lock()
+	targets := limitToBudget(sampleNodes(gNodes))
+	probes := make([]*ProxyNode, len(targets))
+	for i, node := range targets {
+		probe := *node
+		probes[i] = &probe
+	}
+	mu.Unlock()
 
-	// 按流量系数分组节点
-	nodeGroups := make(map[float64][]*ProxyNode)
-	for i := range gNodes {
-		node := gNodes[i]
-		nodeGroups[node.Flow] = append(nodeGroups[node.Flow], node)
+	now := time.Now()
+	controllerLatency := measureControllerLatency(ctx)
+	results, attempts := measureNodes(ctx, probes)
+	// 退出时被中断的一轮不记录结果, 避免把所有节点记为失败
+	if gShutdown.Err() != nil {
+		return nil, errShutdown
 	}
 
-	// 获取所有流量系数并排序
-	var flowKeys []float64
-	for flow := range nodeGroups {
-		flowKeys = append(flowKeys, flow)
+	// 结果按节点名记录, 测试期间节点列表被更新时由 applyMeasurements 应用到新的节点列表
+	mu.Lock()
+	defer mu.Unlock()
+	gControllerLatency = controllerLatency
+	failed := 0
+	for i, node := range targets {
+		node.Success = len(results[i])
+		node.Loss = float64(attempts[i]-node.Success) / float64(max(attempts[i], 1))
+		node.Latency, node.Jitter = summarizeSamples(results[i])
+		failed += attempts[i] - node.Success
 	}
-	sort.Float64s(flowKeys)
+	gStats.recordCycle(failed)
+	mergeWarmup(targets, results, attempts, time.Now())
+	recordMeasurements(targets, now)
+	applyMeasurements(gNodes, now)
+	updateProfiles(targets, now)
+	updateLatencyHistory(targets)
+	checkDegradation(targets)
+	publishEvent(EventCycleCompleted, map[string]any{"tested": len(targets), "duration": time.Since(now).Seconds()})
 
-	latencyThreshold := gConfig.LatencyThreshold
-	for {
-		for _, flow := range flowKeys {
-			nodes := nodeGroups[flow]
-			var bestNode *ProxyNode
-			bestLatency := -1
-			for i := range nodes {
-				node := nodes[i]
-				if node.Latency > 0 && node.Latency <= latencyThreshold {
-					if bestLatency == -1 || node.Latency < bestLatency {
-						bestLatency = node.Latency
-						bestNode = node
-					}
+	reloadNodeScores()
+	decision := pickFastestNode(now)
+	gDecision = &decision
+	bestNode := decision.Best
+	for _, node := range gNodes {
+		node.Reason, _ = nodeReason(node, bestNode, decision.Threshold)
+	}
+	log.Printf("B 选择依据: %s", decision)
+	if gVerbose {
+		logNodeTable(bestNode, decision.Threshold, now)
+	}
+	if bestNode == nil {
+		return nil, fmt.Errorf("没有找到合适的节点")
+	}
+	return bestNode, nil
+}
+
+// 并发测试节点, 返回每个节点成功的延迟样本和计入的测试次数。
+// 计入的测试次数为 test_times 减去按 treat_zero_as: ignore 忽略的次数。
+// ctx 结束时不再等待未完成的测试, 返回已有的结果, 未完成的节点视为测试失败
+func measureNodes(ctx context.Context, targets []*ProxyNode) ([][]int, []int) {
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		results  = make([][]int, len(targets))
+		attempts = make([]int, len(targets))
+		done     = make([]bool, len(targets))
+	)
+	// 超过 max_goroutines 时等待空闲名额再启动, ctx 结束后不再启动, 剩余的节点视为未完成
+	for i, node := range targets {
+		wg.Add(1)
+		started := gWorkers.Go(ctx, func() {
+			defer wg.Done()
+			var samples []int
+			counted := 0
+			for range gConfig.TestTimes {
+				latency, err := testNode(ctx, node)
+				if err == nil && latency == 0 {
+					latency, err = zeroDelay(node)
+				}
+				if !errors.Is(err, errZeroIgnored) {
+					counted++
+				}
+				if err == nil && latency > 0 {
+					samples = append(samples, latency)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(1 * time.Second): // 避免过于频繁测试
 				}
 			}
+			lock.Lock()
+			results[i], attempts[i], done[i] = samples, counted, true
+			lock.Unlock()
+		})
+		if !started {
+			wg.Done()
+			break
+		}
+	}
+
+	// ctx 结束后测试和等待都会立即返回, 等所有协程退出后再读取结果, 避免返回后仍被写入
+	wg.Wait()
+
+	unfinished := 0
+	for i := range targets {
+		if !done[i] {
+			results[i], attempts[i] = nil, gConfig.TestTimes
+			unfinished++
+		}
+	}
+	if unfinished > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log.Printf("B 超过 best_selection_deadline, %d 个节点未完成测试, 视为失败", unfinished)
+	}
+	return results, attempts
+}
+
+// treat_zero_as: ignore 时忽略的测试结果, 不计为成功也不计为失败
+var errZeroIgnored = errors.New("延迟为 0, 忽略这次测试")
+
+// 处理测试得到的延迟 0。有的控制器对缓存的结果或出错时返回 0,
+// 而本机或局域网内的节点也可能真的不到 1ms, 两者无法区分, 由 treat_zero_as 决定
+func zeroDelay(node *ProxyNode) (int, error) {
+	switch gConfig.TreatZeroAs {
+	case "success_min":
+		return 1, nil
+	case "ignore":
+		return -1, errZeroIgnored
+	}
+	if gVerbose {
+		log.Printf("B 节点 %s 的延迟为 0, 视为测试失败", node.Name)
+	}
+	return -1, fmt.Errorf("节点 %s 的延迟为 0", node.Name)
+}
+
+// 按 test_bandwidth_budget 限制本轮测试的节点数: 优先当前节点, 其次上次测试合格的节点(延迟低的优先), 最后是其他节点
+func limitToBudget(targets []*ProxyNode) []*ProxyNode {
+	if gConfig.TestBandwidthBudget <= 0 {
+		return targets
+	}
+	perNode := gConfig.TestSizeEstimate * max(gConfig.TestTimes, 1)
+	limit := gConfig.TestBandwidthBudget / perNode
+	if limit >= len(targets) {
+		return targets
+	}
+	rank := func(node *ProxyNode) int {
+		switch m, ok := gMeasurements[node.Name]; {
+		case sameNode(node, gCurrent):
+			return 0
+		case ok && m.Latency > 0 && m.Latency <= gConfig.LatencyThreshold:
+			return 1
+		default:
+			return 2
+		}
+	}
+	ordered := make([]*ProxyNode, len(targets))
+	copy(ordered, targets)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ri, rj := rank(ordered[i]), rank(ordered[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return ri == 1 && gMeasurements[ordered[i].Name].Latency < gMeasurements[ordered[j].Name].Latency
+	})
+	log.Printf("B 本轮测试流量预算 %dKB, 每个节点约 %dKB, 只测试 %d/%d 个节点", gConfig.TestBandwidthBudget, perNode, limit, len(targets))
+	return ordered[:limit]
+}
+
+// 计算多次测试的平均延迟和标准差, 没有成功的测试时延迟为 -1
+func summarizeSamples(samples []int) (int, int) {
+	if len(samples) == 0 {
+		return -1, 0
+	}
+	total := 0
+	for _, sample := range samples {
+		total += sample
+	}
+	mean := float64(total) / float64(len(samples))
+	variance := 0.0
+	for _, sample := range samples {
+		variance += (float64(sample) - mean) * (float64(sample) - mean)
+	}
+	return total / len(samples), int(math.Sqrt(variance / float64(len(samples))))
+}
+
+// 节点的测试结果
+type measurement struct {
+	Latency  int       `json:"latency"`
+	Jitter   int       `json:"jitter"`
+	Success  int       `json:"success"`
+	Loss     float64   `json:"loss,omitempty"`
+	TestedAt time.Time `json:"tested_at"`
+	Healthy  int       `json:"healthy_cycles,omitempty"` // 连续多少轮测试延迟在阈值内
+	Stale    bool      `json:"-"`                        // 从状态文件读取, 不受有效期限制, 重新测试后清除
+}
+
+// 保存本轮测试的节点结果
+func recordMeasurements(nodes []*ProxyNode, now time.Time) {
+	for _, node := range nodes {
+		healthy := 0
+		if node.Latency > 0 && node.Latency <= gConfig.LatencyThreshold {
+			healthy = gMeasurements[node.Name].Healthy + 1
+		}
+		gMeasurements[node.Name] = measurement{Latency: node.Latency, Jitter: node.Jitter, Success: node.Success, Loss: node.Loss, TestedAt: now, Healthy: healthy}
+	}
+}
+
+// 将保存的测试结果应用到节点上, 超过有效期的结果视为未测试
+func applyMeasurements(nodes []*ProxyNode, now time.Time) {
+	maxAge := measurementMaxAge(len(nodes))
+	for _, node := range nodes {
+		m, ok := gMeasurements[node.Name]
+		if !ok || !m.Stale && now.Sub(m.TestedAt) > maxAge {
+			node.Latency, node.Jitter, node.Success, node.Loss, node.TestedAt, node.Stale, node.Healthy = 0, 0, 0, 0, time.Time{}, false, 0
+			continue
+		}
+		node.Latency, node.Jitter, node.Success, node.Loss, node.TestedAt, node.Stale, node.Healthy = m.Latency, m.Jitter, m.Success, m.Loss, m.TestedAt, m.Stale, m.Healthy
+	}
+}
 
-			if bestNode != nil {
-				return bestNode, nil
+// 测试结果的有效期: 轮流测试覆盖全部节点所需的轮数再多一轮
+func measurementMaxAge(total int) time.Duration {
+	cycles := 1
+	size := sampleSize()
+	if size > 0 && size < total {
+		// 每轮有一个名额留给当前最优节点
+		perCycle := max(size-1, 1)
+		cycles = (total + perCycle - 1) / perCycle
+	}
+	return time.Duration(cycles+1) * bestCycleInterval(total)
+}
+
+// 每轮最多测试的节点数, 0 为全部测试。分片测试时每轮测试一片, 另加当前最优节点
+func sampleSize() int {
+	if gConfig.TestShardSize > 0 {
+		return gConfig.TestShardSize + 1
+	}
+	return gConfig.BestSampleSize
+}
+
+// 两轮选择最优节点之间的间隔。分片测试时 best_interval 内测试完所有分片
+func bestCycleInterval(total int) time.Duration {
+	interval := time.Duration(gConfig.BestInterval) * time.Second
+	if gConfig.TestShardSize <= 0 || total <= gConfig.TestShardSize {
+		return interval
+	}
+	shards := (total + gConfig.TestShardSize - 1) / gConfig.TestShardSize
+	return max(interval/time.Duration(shards), minInterval*time.Second)
+}
+
+// 节点最近一次测试全部失败且仍在 failure_cooldown 内, 最优节点除外
+func coolingDown(node *ProxyNode, now time.Time) bool {
+	if gConfig.FailureCooldown <= 0 || sameNode(node, gBest) {
+		return false
+	}
+	m, ok := gMeasurements[node.Name]
+	return ok && m.Latency <= 0 && now.Sub(m.TestedAt) < time.Duration(gConfig.FailureCooldown)*time.Second
+}
+
+// 节点是否被 exclude_from_test 排除在测试之外
+func testExcluded(node *ProxyNode) bool {
+	return gConfig.excludeTestRe != nil && gConfig.excludeTestRe.MatchString(node.Name)
+}
+
+// 选出本轮需要测试的节点: 当前最优节点加上最久未测试的其余节点, 多轮后覆盖全部节点
+func sampleNodes(all []*ProxyNode) []*ProxyNode {
+	var nodes []*ProxyNode
+	now := time.Now()
+	for _, node := range all {
+		if !testExcluded(node) && !coolingDown(node, now) {
+			nodes = append(nodes, node)
+		}
+	}
+	size := sampleSize()
+	if size <= 0 || size >= len(nodes) {
+		return nodes
+	}
+	var sampled, rest []*ProxyNode
+	for _, node := range nodes {
+		if gBest != nil && node.Name == gBest.Name {
+			sampled = append(sampled, node)
+		} else {
+			rest = append(rest, node)
+		}
+	}
+	// 先随机打乱, 再按最近测试时间排序, 使从未测试或同时测试的节点随机入选
+	rand.Shuffle(len(rest), func(i, j int) { rest[i], rest[j] = rest[j], rest[i] })
+	sort.SliceStable(rest, func(i, j int) bool {
+		return gMeasurements[rest[i].Name].TestedAt.Before(gMeasurements[rest[j].Name].TestedAt)
+	})
+	for _, node := range rest {
+		if len(sampled) >= size {
+			break
+		}
+		sampled = append(sampled, node)
+	}
+	return sampled
+}
+
+// 最近一次选择最优节点的依据
+type selectionDecision struct {
+	Mode            string     `json:"mode"`           // 选择方式
+	Threshold       int        `json:"threshold"`      // 放宽后实际使用的延迟阈值
+	Flow            float64    `json:"flow"`           // 最优节点所在的流量系数分组
+	Tier            int        `json:"tier,omitempty"` // 最优节点所在的优先级档位, 未配置 node_priority 时为 0
+	Best            *ProxyNode `json:"-"`
+	BestName        string     `json:"best,omitempty"`
+	BestLatency     int        `json:"best_latency,omitempty"`
+	RunnerUp        string     `json:"runner_up,omitempty"` // 次优节点
+	RunnerUpLatency int        `json:"runner_up_latency,omitempty"`
+	Controller      int        `json:"controller_latency"` // 本轮访问控制器本身的耗时, 节点延迟都偏高且该值也高时多半是控制器慢, -1 为失败
+	Time            time.Time  `json:"time"`
+}
+
+func (d selectionDecision) String() string {
+	controller := "失败"
+	if d.Controller > 0 {
+		controller = fmt.Sprintf("%dms", d.Controller)
+	}
+	if d.Best == nil {
+		return fmt.Sprintf("方式: %s, 阈值: %dms, 控制器延迟: %s, 没有合适的节点", d.Mode, d.Threshold, controller)
+	}
+	runnerUp := "无"
+	if d.RunnerUp != "" {
+		runnerUp = fmt.Sprintf("%s (%dms)", d.RunnerUp, d.RunnerUpLatency)
+	}
+	tier := ""
+	if d.Tier > 0 {
+		tier = fmt.Sprintf(", 优先级: %d", d.Tier)
+	}
+	return fmt.Sprintf("方式: %s, 阈值: %dms, 流量系数: %.1fx%s, 次优节点: %s, 控制器延迟: %s", d.Mode, d.Threshold, d.Flow, tier, runnerUp, controller)
+}
+
+// 根据测试结果按流量系数分组选出最优节点, 并记录选择依据
+func pickFastestNode(now time.Time) selectionDecision {
+	decision := selectionDecision{Mode: selectionMode(), Controller: gControllerLatency, Time: now}
+	best, threshold := pickNode(gNodes, now)
+	decision.Threshold = threshold
+	if best == nil {
+		return decision
+	}
+	decision.Best, decision.BestName, decision.BestLatency, decision.Flow = best, best.Name, best.Latency, best.Flow
+	if len(gConfig.priorityRes) > 0 {
+		decision.Tier = nodeTier(best)
+	}
+
+	// 去掉最优节点后再选一次, 得到次优节点
+	others := make([]*ProxyNode, 0, len(gNodes))
+	for _, node := range gNodes {
+		if node != best {
+			others = append(others, node)
+		}
+	}
+	if runnerUp, _ := pickNode(others, now); runnerUp != nil {
+		decision.RunnerUp, decision.RunnerUpLatency = runnerUp.Name, runnerUp.Latency
+	}
+	return decision
+}
+
+// 当前使用的选择方式
+func selectionMode() string {
+	if gConfig.scoreProgram != nil {
+		return "score_expr"
+	}
+	switch gConfig.SelectionMode {
+	case "soft_penalty", "sticky":
+		return gConfig.SelectionMode
+	}
+	return "flow_groups"
+}
+
+// 从 nodes 中选出最优节点, 同时返回最终使用的延迟阈值
+func pickNode(all []*ProxyNode, now time.Time) (*ProxyNode, int) {
+	var nodes, stable []*ProxyNode
+	for _, node := range all {
+		if testExcluded(node) || manuallyExcluded(node, now) || lossExceeded(node) {
+			continue
+		}
+		nodes = append(nodes, node)
+		if stableEnough(node) {
+			stable = append(stable, node)
+		}
+	}
+	// 配置了 min_stability_cycles 时先只在稳定的节点中选择, 刚启动等没有稳定节点时不限制
+	if len(stable) < len(nodes) {
+		if best, threshold := pickInTiers(stable, now); best != nil {
+			return best, threshold
+		}
+	}
+	return pickInTiers(nodes, now)
+}
+
+// 节点最近一轮的丢包率是否超过 max_loss_ratio
+func lossExceeded(node *ProxyNode) bool {
+	return gConfig.MaxLossRatio > 0 && node.Loss > gConfig.MaxLossRatio
+}
+
+// 节点是否已连续 min_stability_cycles 轮测试合格
+func stableEnough(node *ProxyNode) bool {
+	return node.Healthy >= gConfig.MinStabilityCycles
+}
+
+// 配置了 node_priority 时, 先在优先级最高的一档中选择, 没有合格节点时再依次尝试后面的档位
+func pickInTiers(nodes []*ProxyNode, now time.Time) (*ProxyNode, int) {
+	tiers := priorityTiers(nodes)
+
+	// 使用自定义得分表达式时, 由表达式完全决定节点优劣
+	if gConfig.scoreProgram != nil {
+		for _, tier := range tiers {
+			if best := pickByScore(tier, now); best != nil {
+				return best, gConfig.LatencyThreshold
+			}
+		}
+		return nil, gConfig.LatencyThreshold
+	}
+
+	// soft_penalty 不放宽阈值, 超过阈值的节点加罚后参与比较
+	if selectionMode() == "soft_penalty" {
+		for _, tier := range tiers {
+			if best := pickWithPenalty(tier, now); best != nil {
+				return best, gConfig.LatencyThreshold
+			}
+		}
+		return nil, gConfig.LatencyThreshold
+	}
+
+	latencyThreshold := gConfig.LatencyThreshold
+	for {
+		for _, tier := range tiers {
+			if best := pickInFlowGroups(tier, latencyThreshold, now); best != nil {
+				return best, latencyThreshold
 			}
 		}
 
@@ -313,64 +1538,442 @@ func selectFastestNode() (*ProxyNode, error) {
 			break
 		}
 	}
-	return nil, fmt.Errorf("没有找到合适的节点")
+	return nil, gConfig.LatencyThreshold * 2
+}
+
+// 选出自定义得分最优的节点
+func pickByScore(nodes []*ProxyNode, now time.Time) *ProxyNode {
+	var bestNode *ProxyNode
+	bestScore := 0.0
+	for _, node := range nodes {
+		if node.Latency <= 0 {
+			continue
+		}
+		score := nodeScore(node, now)
+		if math.IsInf(score, 1) {
+			continue
+		}
+		if betterNode(node, score, bestNode, bestScore) {
+			bestScore = score
+			bestNode = node
+		}
+	}
+	return bestNode
+}
+
+// 加罚后的得分: 超过阈值的部分每 1ms 增加 penalty_slope × 流量系数,
+// 超过阈值时流量系数越高罚得越多, 对应 flow_groups 放宽阈值时优先低流量系数节点的做法
+func penalizedScore(node *ProxyNode, now time.Time) float64 {
+	score := nodeScore(node, now)
+	if excess := node.Latency - gConfig.LatencyThreshold; excess > 0 {
+		score += gConfig.PenaltySlope * float64(excess) * node.Flow
+	}
+	return score
+}
+
+// 按流量系数从低到高依次比较各分组中加罚后得分最优的节点, 遇到阈值内的节点时停止,
+// 即流量系数较低的分组有阈值内的节点时仍然优先; 所有节点都超过阈值时选出加罚后得分最优的节点
+func pickWithPenalty(nodes []*ProxyNode, now time.Time) *ProxyNode {
+	nodeGroups := make(map[float64][]*ProxyNode)
+	var flowKeys []float64
+	for _, node := range nodes {
+		if node.Latency <= 0 {
+			continue
+		}
+		if _, ok := nodeGroups[node.Flow]; !ok {
+			flowKeys = append(flowKeys, node.Flow)
+		}
+		nodeGroups[node.Flow] = append(nodeGroups[node.Flow], node)
+	}
+	sort.Float64s(flowKeys)
+
+	var bestNode *ProxyNode
+	bestScore := 0.0
+	for _, flow := range flowKeys {
+		within := false
+		for _, node := range nodeGroups[flow] {
+			score := penalizedScore(node, now)
+			if betterNode(node, score, bestNode, bestScore) {
+				bestScore = score
+				bestNode = node
+			}
+			within = within || node.Latency <= gConfig.LatencyThreshold
+		}
+		if within {
+			break
+		}
+	}
+	return bestNode
+}
+
+// 按流量系数从低到高, 选出第一个有合格节点的分组中得分最优的节点。
+// 配置了 flow_jump_ratio 时, 较高分组中的最优节点得分低到该比例以下时改选较高分组的节点
+func pickInFlowGroups(nodes []*ProxyNode, latencyThreshold int, now time.Time) *ProxyNode {
+	if gConfig.FlowLatencyPenalty > 0 {
+		return pickByFlowLatency(nodes, latencyThreshold, now)
+	}
+	// 按流量系数分组节点
+	nodeGroups := make(map[float64][]*ProxyNode)
+	for i := range nodes {
+		node := nodes[i]
+		nodeGroups[node.Flow] = append(nodeGroups[node.Flow], node)
+	}
+
+	// 获取所有流量系数并排序
+	var flowKeys []float64
+	for flow := range nodeGroups {
+		flowKeys = append(flowKeys, flow)
+	}
+	sort.Float64s(flowKeys)
+
+	var bestNode *ProxyNode
+	bestScore := 0.0
+	for _, flow := range flowKeys {
+		nodes := nodeGroups[flow]
+		var groupBest *ProxyNode
+		groupScore := 0.0
+		for i := range nodes {
+			node := nodes[i]
+			if node.Latency > 0 && node.Latency <= latencyThreshold {
+				score := nodeScore(node, now)
+				if betterNode(node, score, groupBest, groupScore) {
+					groupScore = score
+					groupBest = node
+				}
+			}
+		}
+
+		switch {
+		case groupBest == nil:
+		case bestNode == nil:
+			bestNode, bestScore = groupBest, groupScore
+			if gConfig.FlowJumpRatio <= 0 {
+				return bestNode
+			}
+		case bestScore >= gConfig.FlowJumpRatio*groupScore:
+			// 流量系数较高的分组中有快得多的节点, 不再坚持较慢的低流量系数节点
+			bestNode, bestScore = groupBest, groupScore
+		}
+	}
+	return bestNode
+}
+
+// 流量系数折算为延迟后的得分, 如 flow_latency_penalty_ms 为 100 时 2x 节点需要快 100ms 才与 1x 节点相当
+func flowLatencyScore(node *ProxyNode, now time.Time) float64 {
+	return nodeScore(node, now) + (node.Flow-1)*gConfig.FlowLatencyPenalty
+}
+
+// 不分组, 在阈值内的节点中选出流量系数折算后得分最优的节点
+func pickByFlowLatency(nodes []*ProxyNode, latencyThreshold int, now time.Time) *ProxyNode {
+	var bestNode *ProxyNode
+	bestScore := 0.0
+	for _, node := range nodes {
+		if node.Latency <= 0 || node.Latency > latencyThreshold {
+			continue
+		}
+		score := flowLatencyScore(node, now)
+		if betterNode(node, score, bestNode, bestScore) {
+			bestScore = score
+			bestNode = node
+		}
+	}
+	return bestNode
+}
+
+// 得分为 score 的 node 是否优于目前最优的 best, 得分相同时按 tie_break 决定,
+// 使选择结果不依赖控制器返回节点的顺序
+func betterNode(node *ProxyNode, score float64, best *ProxyNode, bestScore float64) bool {
+	if best == nil || score < bestScore {
+		return true
+	}
+	if score > bestScore {
+		return false
+	}
+	switch gConfig.TieBreak {
+	case "jitter":
+		if node.Jitter != best.Jitter {
+			return node.Jitter < best.Jitter
+		}
+	case "current":
+		if gCurrent != nil && node.Name != best.Name {
+			if node.Name == gCurrent.Name || best.Name == gCurrent.Name {
+				return node.Name == gCurrent.Name
+			}
+		}
+	}
+	return node.Name < best.Name
+}
+
+// 节点所在的优先级档位, 从 1 开始, 不匹配任何 node_priority 的节点在最后一档
+func nodeTier(node *ProxyNode) int {
+	for i, re := range gConfig.priorityRes {
+		if re.MatchString(node.Name) {
+			return i + 1
+		}
+	}
+	return len(gConfig.priorityRes) + 1
+}
+
+// 按 node_priority 将节点分档, 没有配置时所有节点在同一档
+func priorityTiers(nodes []*ProxyNode) [][]*ProxyNode {
+	if len(gConfig.priorityRes) == 0 {
+		return [][]*ProxyNode{nodes}
+	}
+	tiers := make([][]*ProxyNode, len(gConfig.priorityRes)+1)
+	for _, node := range nodes {
+		tier := nodeTier(node)
+		tiers[tier-1] = append(tiers[tier-1], node)
+	}
+	return tiers
+}
+
+// 按延迟升序输出所有节点的测试结果及落选原因
+func logNodeTable(best *ProxyNode, threshold int, now time.Time) {
+	nodes := make([]*ProxyNode, len(gNodes))
+	copy(nodes, gNodes)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if (nodes[i].Latency > 0) != (nodes[j].Latency > 0) {
+			return nodes[i].Latency > 0
+		}
+		return nodes[i].Latency < nodes[j].Latency
+	})
+	log.Printf("B 本轮测试结果 (阈值: %dms), 延迟 / 得分 / 成功次数 / 丢包率 / 流量系数 / 节点 / 结果:", threshold)
+	for _, node := range nodes {
+		code, reason := nodeReason(node, best, threshold)
+		if node.Stale {
+			reason = fmt.Sprintf("上次运行的结果 (%s 前); %s", now.Sub(node.TestedAt).Round(time.Second), reason)
+		} else if !node.TestedAt.IsZero() && node.TestedAt.Before(now) {
+			reason = fmt.Sprintf("本轮未测试, 沿用 %s 前的结果; %s", now.Sub(node.TestedAt).Round(time.Second), reason)
+		}
+		log.Printf("B   %-6d %-8.1f %d/%d  %3.0f%%  %.1fx  %s  [%s: %s]", node.Latency, nodeScore(node, now), node.Success, gConfig.TestTimes, node.Loss*100, node.Flow, node.Name, code, reason)
+	}
+}
+
+// 节点在本轮选择中的结果代码, 在 /status 每个节点的 reason 中输出, 便于程序统计落选原因
+const (
+	reasonBest          = "best"           // 最优节点
+	reasonNotTested     = "not_tested"     // 匹配 exclude_test_regex, 不参与测试
+	reasonBlacklisted   = "blacklisted"    // 被临时排除
+	reasonUntested      = "untested"       // 还没有测试结果
+	reasonCoolingDown   = "cooling_down"   // 测试全部失败, 冷却中
+	reasonFailedAll     = "failed_all"     // 测试全部失败
+	reasonHighLoss      = "high_loss"      // 丢包率超过 max_loss_ratio
+	reasonOverThreshold = "over_threshold" // 延迟超过阈值
+	reasonUnstable      = "unstable"       // 连续合格的轮数不足 min_stability_cycles
+	reasonLowPriority   = "low_priority"   // node_priority 的优先级较低
+	reasonScoreExpr     = "score_expr"     // score_expr 得分较差
+	reasonFlowLatency   = "flow_latency"   // 按流量系数折算后延迟较高
+	reasonHigherFlow    = "higher_flow"    // 流量系数较高
+	reasonProfile       = "profile"        // 按时段历史加权后得分较高
+	reasonUsage         = "usage"          // 最近使用较多
+	reasonTie           = "tie"            // 与最优节点延迟相同
+	reasonSlower        = "slower"         // 延迟较高
+)
+
+// 节点在本轮选择中的结果: 最优或落选原因, 返回结果代码和说明
+func nodeReason(node, best *ProxyNode, threshold int) (string, string) {
+	switch {
+	case node == best:
+		return reasonBest, "最优"
+	case testExcluded(node):
+		return reasonNotTested, "不参与测试"
+	case manuallyExcluded(node, time.Now()):
+		return reasonBlacklisted, "临时排除至 " + gExcluded[node.Name].Format(time.DateTime)
+	case node.TestedAt.IsZero():
+		return reasonUntested, "未测试"
+	case node.Latency <= 0 && coolingDown(node, time.Now()):
+		return reasonCoolingDown, "测试全部失败, 冷却中"
+	case node.Latency <= 0:
+		return reasonFailedAll, "测试全部失败"
+	case lossExceeded(node):
+		return reasonHighLoss, fmt.Sprintf("丢包率 %.0f%% 超过 max_loss_ratio", node.Loss*100)
+	case node.Latency > threshold && selectionMode() == "soft_penalty":
+		return reasonOverThreshold, "超过阈值, 加罚后得分较高"
+	case node.Latency > threshold:
+		return reasonOverThreshold, "超过阈值"
+	case !stableEnough(node) && best != nil && stableEnough(best):
+		return reasonUnstable, fmt.Sprintf("连续合格 %d 轮, 不足 %d 轮", node.Healthy, gConfig.MinStabilityCycles)
+	case best != nil && nodeTier(node) > nodeTier(best):
+		return reasonLowPriority, "优先级较低"
+	case gConfig.scoreProgram != nil:
+		return reasonScoreExpr, "表达式得分较差"
+	case best != nil && gConfig.FlowLatencyPenalty > 0 && node.Flow != best.Flow:
+		return reasonFlowLatency, "流量系数折算后延迟较高"
+	case best != nil && node.Flow > best.Flow:
+		return reasonHigherFlow, "流量系数较高"
+	case best != nil && gConfig.ProfileWeight > 0 && node.Latency < best.Latency:
+		return reasonProfile, "时段加权得分较高"
+	case best != nil && gConfig.UsagePenaltyWeight > 0 && node.Latency <= best.Latency:
+		return reasonUsage, "最近使用较多"
+	case best != nil && node.Latency == best.Latency:
+		return reasonTie, "与最优节点延迟相同"
+	default:
+		return reasonSlower, "延迟较高"
+	}
+}
+
+// 更新节点列表时保留最近一轮选择的结果代码, 直到下一轮选择
+func keepReasons(previous, nodes []*ProxyNode) {
+	reasons := make(map[string]string, len(previous))
+	for _, node := range previous {
+		reasons[node.Name] = node.Reason
+	}
+	for _, node := range nodes {
+		node.Reason = reasons[node.Name]
+	}
+}
+
+// 首次触发随机推迟的定时器, 之后按原周期触发。
+// 几个定时任务同时启动且周期成倍数时总是同时触发, 错开相位可以分散对控制器的请求
+type staggeredTicker struct {
+	*time.Ticker
+	interval time.Duration
+	shifted  bool
+}
+
+// 创建周期为 interval 的定时器, 首次触发额外推迟 [0, interval/4) 的随机时间,
+// 启用 align_intervals 时改为在下一个整数倍间隔的时刻触发
+func newStaggeredTicker(interval time.Duration) *staggeredTicker {
+	if interval <= 0 {
+		interval = minInterval * time.Second
+	}
+	first := interval + time.Duration(rand.Int64N(int64(interval/4)+1))
+	if gConfig != nil && gConfig.AlignIntervals {
+		first = alignedDelay(interval, time.Now())
+	}
+	return &staggeredTicker{Ticker: time.NewTicker(first), interval: interval}
+}
+
+// 从 now 到下一个整数倍 interval 时刻的时间。启动时各任务已立即执行一次,
+// 距离下一个时刻不足 1/4 个间隔时跳到再下一个, 避免连续执行两次
+func alignedDelay(interval time.Duration, now time.Time) time.Duration {
+	next := now.Truncate(interval).Add(interval)
+	if next.Sub(now) < interval/4 {
+		next = next.Add(interval)
+	}
+	return next.Sub(now)
+}
+
+// 修改之后的触发间隔, 间隔变化时从现在开始重新计时
+func (t *staggeredTicker) setInterval(interval time.Duration) {
+	if interval == t.interval {
+		return
+	}
+	t.interval = interval
+	t.Reset(interval)
+	t.shifted = true
+}
+
+// 等待下一次触发
+func (t *staggeredTicker) wait() {
+	<-t.C
+	if !t.shifted {
+		t.Reset(t.interval)
+		t.shifted = true
+	}
 }
 
 // 定时更新节点列表
 func startNodeUpdater() {
-	ticker := time.NewTicker(time.Duration(gConfig.RetrieveInterval) * time.Second)
+	ticker := newStaggeredTicker(time.Duration(gConfig.RetrieveInterval) * time.Second)
 	defer ticker.Stop()
 	toUpdate := false
 	for {
 		log.Println("A 等待更新节点列表")
 		mu.Lock()
-		if len(gNodes) == 0 || toUpdate {
-			log.Println("A 开始更新节点列表")
-			nodes, current, err := getNodes()
-			if err != nil {
-				log.Printf("A 更新节点列表失败: %v", err)
-				mu.Unlock()
-				time.Sleep(10 * time.Second)
-				continue
-			}
-			if len(nodes) == 0 {
-				log.Printf("A 更新节点列表为空")
-				mu.Unlock()
-				time.Sleep(10 * time.Second)
-				continue
-			}
-			if len(nodes) > 0 {
-				log.Println("A 更新节点列表成功")
-				gNodes = nodes
-				gCurrent = current
-			}
-		}
+		empty := len(gNodes) == 0
 		mu.Unlock()
+		if (empty || toUpdate) && !refreshNodes() {
+			time.Sleep(10 * time.Second)
+			continue
+		}
 		toUpdate = false
-		<-ticker.C
+		ticker.wait()
 		toUpdate = true
 	}
 }
 
+// 更新一次节点列表, 返回是否成功。请求控制器时不持有 mu, 期间其他协程继续使用原来的节点列表,
+// 成功后再持有 mu 替换; 失败时保留原来的节点列表
+func refreshNodes() bool {
+	log.Println("A 开始更新节点列表")
+	mu.Lock()
+	before := gCurrent
+	mu.Unlock()
+	nodes, current, err := getNodes()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		if errors.Is(err, ErrAuth) {
+			log.Printf("A 更新节点列表失败, 请检查 api_key 配置: %v", err)
+		} else {
+			log.Printf("A 更新节点列表失败: %v", err)
+		}
+		warnStaleNodeList(time.Now())
+		return false
+	}
+	if len(nodes) == 0 {
+		log.Printf("A 更新节点列表为空")
+		warnStaleNodeList(time.Now())
+		return false
+	}
+	log.Println("A 更新节点列表成功")
+	applyMeasurements(nodes, time.Now())
+	keepReasons(gNodes, nodes)
+	gNodes = nodes
+	// 请求期间切换过节点时, 控制器返回的当前节点可能是切换前的, 以切换结果为准
+	if gCurrent == before || sameNode(gCurrent, before) {
+		setCurrent(current)
+	} else if gDebug {
+		log.Println("A 更新节点列表期间切换了节点, 保留切换后的当前节点")
+	}
+	gNodesUpdatedAt = time.Now()
+	if gNodeListStale {
+		gNodeListStale = false
+		log.Println("A 节点列表已更新, 恢复切换节点")
+	}
+	return true
+}
+
 // 定时选择最优节点
 func startBestNodeSelector() {
-	ticker := time.NewTicker(time.Duration(gConfig.BestInterval) * time.Second)
+	ticker := newStaggeredTicker(time.Duration(gConfig.BestInterval) * time.Second)
 	defer ticker.Stop()
 	toUpdate := false
 	for {
 		log.Println("B 等待选择最优节点")
 		mu.Lock()
+		if len(gNodes) > 0 && gBest == nil && !toUpdate {
+			if best := provisionalBest(time.Now()); best != nil {
+				log.Printf("B 根据上次运行的测试结果临时选择最优节点: %s, 延迟: %d", best.Name, best.Latency)
+				gBest = best
+				mu.Unlock()
+				toUpdate = true
+				time.Sleep(time.Second) // 让检查协程先切换到临时最优节点, 再开始完整测试
+				continue
+			}
+		}
 		if len(gNodes) > 0 && gBest == nil || toUpdate {
 			log.Println("B 开始查找最优节点")
+			mu.Unlock()
 			bestNode, err := selectFastestNode()
+			mu.Lock()
 			if err != nil {
 				log.Printf("B 查找最优节点失败: %v", err)
 				mu.Unlock()
 				time.Sleep(10 * time.Second)
 				continue
 			}
-			gBest = bestNode
-			log.Printf("B 最优节点: %s, 延迟: %d", bestNode.Name, bestNode.Latency)
+			adoptBest(bestNode, "B")
+			if gSlowPending {
+				resolveSlowCurrent()
+			}
+			interval := bestCycleInterval(len(gNodes))
+			if warmingUp() {
+				interval = min(interval, warmupSweepInterval)
+			}
+			ticker.setInterval(interval)
 		} else {
 			log.Println("B 没有节点可用")
 			mu.Unlock()
@@ -379,15 +1982,268 @@ func startBestNodeSelector() {
 		}
 		mu.Unlock()
 		toUpdate = false
-		<-ticker.C
+		ticker.wait()
 		toUpdate = true
 	}
 }
 
+// 更新最优节点并保存测试结果
+func adoptBest(bestNode *ProxyNode, prefix string) {
+	gBest = bestNode
+	log.Printf("%s 最优节点: %s, 延迟: %d", prefix, bestNode.Name, bestNode.Latency)
+	publishEvent(EventBestSelected, map[string]any{"name": bestNode.Name, "latency": bestNode.Latency})
+	if err := saveState(); err != nil {
+		log.Printf("%s 保存测试结果失败: %v", prefix, err)
+	}
+}
+
+// 是否处于启动保护期
+func inStartupGrace(now time.Time) bool {
+	return now.Sub(gStartedAt) < time.Duration(gConfig.StartupGrace)*time.Second
+}
+
+// 节点列表是否超过 max_node_list_age 未更新。过旧的列表中的节点可能已被删除或更换, 不能据此切换
+func nodeListStale(now time.Time) bool {
+	return gConfig.MaxNodeListAge > 0 && !gNodesUpdatedAt.IsZero() && now.Sub(gNodesUpdatedAt) > time.Duration(gConfig.MaxNodeListAge)*time.Second
+}
+
+// 更新节点列表失败后检查列表是否过旧, 第一次超过 max_node_list_age 时告警
+func warnStaleNodeList(now time.Time) {
+	if !nodeListStale(now) || gNodeListStale {
+		return
+	}
+	gNodeListStale = true
+	log.Printf("A 警告: 节点列表已 %s 未更新, 超过 max_node_list_age, 暂停切换节点直到更新成功", now.Sub(gNodesUpdatedAt).Round(time.Second))
+}
+
+// 切换到指定节点并更新当前节点, prefix 为日志前缀
+func switchCurrent(node *ProxyNode, prefix string) error {
+	// 目标已是当前节点时不向控制器发出请求, 也不记录切换、发布事件或执行 on_switch_exec
+	if sameNode(node, gCurrent) {
+		if gDebug {
+			log.Printf("%s 已是当前节点, 无需切换: %s", prefix, node.Name)
+		}
+		gSwitchReason = ""
+		return nil
+	}
+	if gConfig.MonitorOnly {
+		log.Printf("%s 仅监控模式, 不切换到: %s", prefix, node.Name)
+		return errMonitorOnly
+	}
+	if inStartupGrace(time.Now()) {
+		log.Printf("%s 启动保护期内, 暂不切换到: %s", prefix, node.Name)
+		return errStartupGrace
+	}
+	if warmingUp() {
+		log.Printf("%s 预热中, 暂不切换到: %s", prefix, node.Name)
+		return errStartupGrace
+	}
+	if nodeListStale(time.Now()) {
+		log.Printf("%s 节点列表过旧, 暂不切换到: %s", prefix, node.Name)
+		return errStaleNodeList
+	}
+	if gConfig.PrewarmBeforeSwitch {
+		prewarmNode(node, prefix)
+	}
+	if err := switchNodeWithRetry(node, prefix); err != nil {
+		log.Printf("%s 切换当前节点失败: %v", prefix, err)
+		return err
+	}
+	log.Printf("%s 切换当前节点成功: %s", prefix, node.Name)
+	from := ""
+	if gCurrent != nil {
+		from = gCurrent.Name
+	}
+	publishEvent(EventSwitched, map[string]any{"from": from, "to": node.Name})
+	record := switchRecord{Time: time.Now(), From: from, To: node.Name, Reason: gSwitchReason, ToLatency: node.Latency}
+	if gCurrent != nil {
+		record.FromLatency = gCurrentLatency
+	}
+	recordSwitchHistory(record)
+	gSwitchReason = ""
+	runSwitchHook(from, node.Name)
+	if err := saveState(); err != nil {
+		log.Printf("%s 保存切换记录失败: %v", prefix, err)
+	}
+	gStats.recordSwitch()
+	setCurrent(node)
+	gSlowPending = false
+	gCurrentFailures = 0
+	if gConfig.VerifyAfterSwitch {
+		return verifySwitch(node, prefix)
+	}
+	return nil
+}
+
+// 切换后立即测试一次新的当前节点, 确认它实际可用而不只是控制器接受了切换。
+// 失败时返回 errVerifyFailed, 由调用方切换到下一个候选节点
+func verifySwitch(node *ProxyNode, prefix string) error {
+	delay, err := testCurrent(gShutdown)
+	if gShutdown.Err() != nil {
+		return nil
+	}
+	recordCurrentLatency(delay, err)
+	if err != nil {
+		log.Printf("%s 切换后验证失败: %s: %v", prefix, node.Name, err)
+		gSwitchReason = "切换后验证失败"
+		return fmt.Errorf("%w: %s: %v", errVerifyFailed, node.Name, err)
+	}
+	log.Printf("%s 切换后验证成功: %s, 延迟: %d", prefix, node.Name, delay)
+	return nil
+}
+
+// 切换前经新节点访问一次测试 URL, 让 Clash 提前建立到节点的连接, 减少切换后最初几个连接的等待。
+// 不论测试方式如何都通过控制器访问, 失败只记录日志, 不影响切换
+func prewarmNode(node *ProxyNode, prefix string) {
+	delay, err := controllerDelay(gShutdown, node, testURLFor(node))
+	if err != nil {
+		log.Printf("%s 预热节点失败: %s: %v", prefix, node.Name, err)
+		return
+	}
+	log.Printf("%s 预热节点: %s, 延迟: %d", prefix, node.Name, delay)
+}
+
+// 切换节点, 失败时按 switch_retries 重试。认证失败、节点组或节点不存在时重试没有意义, 直接返回
+func switchNodeWithRetry(node *ProxyNode, prefix string) error {
+	for attempt := 1; ; attempt++ {
+		err := switchNode(node)
+		if err == nil || attempt > gConfig.SwitchRetries ||
+			errors.Is(err, ErrAuth) || errors.Is(err, ErrGroupNotFound) || errors.Is(err, ErrNodeNotFound) || errors.Is(err, ErrBreakerOpen) {
+			return err
+		}
+		log.Printf("%s 切换节点失败, 第 %d 次重试: %v", prefix, attempt, err)
+		time.Sleep(time.Duration(gConfig.SwitchRetryDelay) * time.Millisecond)
+	}
+}
+
+// 切换到最优节点, 失败时依次尝试次优的节点
+func switchToBest(prefix string) error {
+	tried := make(map[string]bool)
+	candidate := gBest
+	var err error
+	for range failoverCandidates {
+		if candidate == nil {
+			break
+		}
+		err = switchCurrent(candidate, prefix)
+		if err == nil || errors.Is(err, errStartupGrace) || errors.Is(err, errMonitorOnly) || errors.Is(err, errStaleNodeList) || errors.Is(err, ErrAuth) || errors.Is(err, ErrGroupNotFound) || errors.Is(err, ErrBreakerOpen) {
+			return err
+		}
+		tried[candidate.Name] = true
+		candidate = nextCandidate(tried)
+		if candidate != nil {
+			log.Printf("%s 尝试切换到下一个候选节点: %s", prefix, candidate.Name)
+		}
+	}
+	return err
+}
+
+// 当前节点不可用时切换。配置了 prefer_same_region_on_failover 时先尝试与当前节点同区域的节点,
+// 避免切换到其他区域后与区域绑定的会话失效
+func failover(prefix string) error {
+	// 连续多次切换时记住最初的节点
+	if gConfig.PreferRecovery && gCurrent != nil && gRecoverTo == "" {
+		gRecoverTo = gCurrent.Name
+	}
+	if gConfig.PreferSameRegion && gCurrent != nil {
+		if region := regionOf(gCurrent.Name); region != "" {
+			var sameRegion []*ProxyNode
+			for _, node := range gNodes {
+				if !sameNode(node, gCurrent) && regionOf(node.Name) == region {
+					sameRegion = append(sameRegion, node)
+				}
+			}
+			if candidate, _ := pickNode(sameRegion, time.Now()); candidate != nil {
+				log.Printf("%s 切换到同区域 (%s) 的节点: %s", prefix, region, candidate.Name)
+				err := switchCurrent(candidate, prefix)
+				if err == nil || errors.Is(err, errStartupGrace) || errors.Is(err, errMonitorOnly) || errors.Is(err, errStaleNodeList) {
+					return err
+				}
+			}
+			log.Printf("%s 没有可用的同区域 (%s) 节点", prefix, region)
+		}
+	}
+	return switchToBest(prefix)
+}
+
+// 排除已尝试的节点和当前节点后选出的最优节点
+func nextCandidate(tried map[string]bool) *ProxyNode {
+	var candidates []*ProxyNode
+	for _, node := range gNodes {
+		if !tried[node.Name] && !sameNode(node, gCurrent) {
+			candidates = append(candidates, node)
+		}
+	}
+	candidate, _ := pickNode(candidates, time.Now())
+	return candidate
+}
+
+// 更新当前节点, 节点变化时写入 current_node_file
+func setCurrent(node *ProxyNode) {
+	changed := !sameNode(gCurrent, node) && (gCurrent != nil || node != nil)
+	gCurrent = node
+	if changed {
+		name := ""
+		if node != nil {
+			name = node.Name
+		}
+		gStats.recordCurrent(name, time.Now())
+		recordUsage(name, time.Now())
+		gCurrentLatency = -1
+		gCurrentCheckedAt = time.Time{}
+		if name == gRecoverTo {
+			gRecoverTo = ""
+		}
+	}
+	if changed && gConfig.CurrentNodeFile != "" {
+		if err := writeCurrentNodeFile(node); err != nil {
+			log.Printf("写入当前节点文件失败: %v", err)
+		}
+	}
+}
+
+// 将当前节点名写入文件, 第一行为节点名, 启用 current_node_file_latency 时第二行为延迟(ms)
+func writeCurrentNodeFile(node *ProxyNode) error {
+	content := ""
+	if node != nil {
+		content = node.Name + "\n"
+		if gConfig.CurrentNodeFileLatency {
+			content += strconv.Itoa(node.Latency) + "\n"
+		}
+	}
+	return writeFileAtomic(gConfig.CurrentNodeFile, []byte(content))
+}
+
+// 判断两个节点是否为同一节点, 更新节点列表后同名节点是不同的对象
+func sameNode(a, b *ProxyNode) bool {
+	return a != nil && b != nil && a.Name == b.Name
+}
+
+// 当前节点过慢时, 在选出最优节点后决定是否切换: 本轮测试已恢复则保留, 否则切换到最优节点
+func resolveSlowCurrent() {
+	gSlowPending = false
+	if gCurrent == nil || gBest == nil || sameNode(gCurrent, gBest) {
+		return
+	}
+	for _, node := range gNodes {
+		if sameNode(node, gCurrent) && !node.Stale && node.Latency > 0 && node.Latency <= gConfig.SlowThreshold {
+			log.Printf("B 当前节点已恢复，延迟: %d, 不切换", node.Latency)
+			return
+		}
+	}
+	// 推迟时保留标记, 下一轮选出最优节点后再决定
+	if deferSwitchWhenBusy("B") {
+		gSlowPending = true
+		return
+	}
+	log.Printf("B 当前节点过慢，切换到最优节点")
+	gSwitchReason = "当前节点过慢"
+	switchToBest("B")
+}
+
 // 定时检查当前节点是否可用
 func startCurrentNodeChecker() {
-	var err error
-	ticker := time.NewTicker(time.Duration(gConfig.CurrentInterval) * time.Second)
+	ticker := newStaggeredTicker(time.Duration(gConfig.CurrentInterval) * time.Second)
 	defer ticker.Stop()
 	for {
 		log.Println("C 等待检查当前节点")
@@ -396,70 +2252,287 @@ func startCurrentNodeChecker() {
 			log.Println("C 当前节点为空")
 			if gBest != nil {
 				log.Println("C 切换当前节点到最优节点")
-				err = switchNode(gBest)
-				if err != nil {
-					log.Printf("C 切换当前节点失败: %v", err)
-					mu.Unlock()
-					time.Sleep(10 * time.Second)
-					continue
-				}
-				log.Printf("C 切换当前节点成功: %s", gBest.Name)
-				gCurrent = gBest
-				mu.Unlock()
-				time.Sleep(10 * time.Second)
-				continue
+				gSwitchReason = "没有当前节点"
+				switchToBest("C")
 			} else {
 				log.Println("C 没有最优节点")
-				mu.Unlock()
-				time.Sleep(10 * time.Second)
-				continue
-			}
-		} else if gBest != nil && gCurrent != gBest {
-			log.Printf("D 检查当前节点: %s", gCurrent.Name)
-			delay := testNode(gCurrent)
-			if delay == -1 || delay > gConfig.LatencyThreshold*2 {
-				log.Printf("D 当前节点不可用，切换到最优节点")
-				err = switchNode(gBest)
-				if err != nil {
-					log.Printf("D 切换当前节点失败: %v", err)
-				} else {
-					log.Printf("D 切换当前节点成功: %s", gBest.Name)
-					gCurrent = gBest
-				}
-			} else {
-				log.Printf("D 当前节点可用，延迟: %d", delay)
 			}
+			mu.Unlock()
+			time.Sleep(10 * time.Second)
+			continue
+		} else if manuallyExcluded(gCurrent, time.Now()) && gBest != nil && !sameNode(gCurrent, gBest) {
+			log.Printf("D 当前节点被临时排除, 切换到最优节点: %s", gCurrent.Name)
+			gSwitchReason = "当前节点被临时排除"
+			switchToBest("D")
+		} else if testExcluded(gCurrent) {
+			log.Printf("D 当前节点不参与测试: %s", gCurrent.Name)
+		} else if gBest != nil && !sameNode(gCurrent, gBest) {
+			checkCurrentNode()
 		} else if gBest == nil {
 			log.Println("D 没有最优节点")
-		} else if gCurrent == gBest {
+		} else {
 			log.Println("D 当前节点和最优节点相同")
+			measureCurrentNode()
+		}
+		if gRecoverTo != "" {
+			checkRecovery()
 		}
 		mu.Unlock()
-		<-ticker.C
+		ticker.wait()
 	}
 }
 
+// 测试当前节点, 不可用时立即切换到最优节点, 过慢时按 slow_action 处理
+func checkCurrentNode() {
+	log.Printf("D 检查当前节点: %s", gCurrent.Name)
+	delay, err := checkDelay(gShutdown)
+	if gShutdown.Err() != nil {
+		return
+	}
+	// 控制器本身无法访问(连接失败、超时或熔断)时无法判断当前节点是否可用, 本轮不记录结果也不切换
+	if errors.Is(err, ErrUnreachable) {
+		log.Printf("D 无法访问控制器, 本轮不判断当前节点: %v", err)
+		return
+	}
+	recordCurrentLatency(delay, err)
+	switch {
+	case err != nil:
+		gCurrentFailures++
+		publishEvent(EventNodeDown, map[string]any{"name": gCurrent.Name, "failures": gCurrentFailures, "error": err.Error()})
+		if gCurrentFailures < gConfig.DeadFailures {
+			log.Printf("D 当前节点测试失败 (%d/%d): %v", gCurrentFailures, gConfig.DeadFailures, err)
+			return
+		}
+		log.Printf("D 当前节点不可用，切换到最优节点: %v", err)
+		gSwitchReason = "当前节点不可用"
+		failover("D")
+	case gConfig.SelectionMode == "sticky":
+		// sticky 方式不处理 slow_action, 只在延迟超过 sticky_degrade_threshold 时切换
+		markCurrentUp(delay)
+		gSlowPending = false
+		if delay > gConfig.StickyDegradeThreshold && !deferSwitchWhenBusy("D") {
+			log.Printf("D 当前节点延迟超过 sticky_degrade_threshold，延迟: %d, 切换到最优节点", delay)
+			gSwitchReason = "当前节点延迟超过 sticky_degrade_threshold"
+			switchToBest("D")
+			return
+		}
+		log.Printf("D 当前节点可用，延迟: %d", delay)
+	case delay > gConfig.SlowThreshold:
+		markCurrentUp(delay)
+		switch gConfig.SlowAction {
+		case "switch":
+			if deferSwitchWhenBusy("D") {
+				return
+			}
+			log.Printf("D 当前节点过慢，延迟: %d, 切换到最优节点", delay)
+			gSwitchReason = "当前节点过慢"
+			switchToBest("D")
+		case "next_cycle":
+			log.Printf("D 当前节点过慢，延迟: %d, 下一轮选出最优节点后再决定是否切换", delay)
+			gSlowPending = true
+		default:
+			log.Printf("D 当前节点过慢，延迟: %d", delay)
+		}
+	default:
+		markCurrentUp(delay)
+		gSlowPending = false
+		log.Printf("D 当前节点可用，延迟: %d", delay)
+	}
+}
+
+// 测试因不可用而切换走的节点, 恢复且延迟在阈值内时切换回去。
+// 该节点已不在节点列表中或被临时排除时不再等待
+func checkRecovery() {
+	var node *ProxyNode
+	for _, n := range gNodes {
+		if n.Name == gRecoverTo {
+			node = n
+		}
+	}
+	if sameNode(node, gCurrent) {
+		gRecoverTo = ""
+		return
+	}
+	if node == nil || manuallyExcluded(node, time.Now()) {
+		log.Printf("R 不再等待节点恢复: %s", gRecoverTo)
+		gRecoverTo = ""
+		return
+	}
+	delay, err := testNode(gShutdown, node)
+	switch {
+	case gShutdown.Err() != nil:
+		return
+	case err != nil:
+		log.Printf("R 原节点仍不可用: %s: %v", node.Name, err)
+	case delay > gConfig.LatencyThreshold:
+		log.Printf("R 原节点已恢复但延迟超过阈值: %s, 延迟: %d", node.Name, delay)
+	case deferSwitchWhenBusy("R"):
+	default:
+		log.Printf("R 原节点已恢复, 切换回去: %s, 延迟: %d", node.Name, delay)
+		gSwitchReason = "原节点已恢复"
+		switchCurrent(node, "R")
+	}
+}
+
+// 测试当前节点, 配置了 current_test_proxy 时经入站端口测试。
+// 配置了 probe_url 时访问 probe_url, 使频繁的检查保持轻量; tcp 和 icmp 方式不访问 URL, 不受影响
+func testCurrent(ctx context.Context) (int, error) {
+	if gConfig.CurrentTestProxy != "" {
+		return proxyDelay(ctx, gConfig.CurrentTestProxy, probeURL(gCurrent))
+	}
+	if gConfig.ProbeURL != "" && gCurrent != nil && (gConfig.TestMethod == "" || gConfig.TestMethod == "controller") {
+		return controllerDelay(ctx, gCurrent, gConfig.ProbeURL)
+	}
+	return testNode(ctx, gCurrent)
+}
+
+// 定时检查当前节点时的延迟。最优节点选择在 measurement_freshness 秒内成功测试过当前节点时直接使用该结果,
+// 避免重复测试同一个节点。配置了 current_test_proxy 或 probe_url 时检查方式与选择不同, 总是单独测试
+func checkDelay(ctx context.Context) (int, error) {
+	if gConfig.MeasurementFreshness > 0 && gCurrent != nil && gConfig.CurrentTestProxy == "" && gConfig.ProbeURL == "" {
+		m, ok := gMeasurements[gCurrent.Name]
+		age := time.Since(m.TestedAt)
+		if ok && !m.Stale && m.Latency > 0 && age <= time.Duration(gConfig.MeasurementFreshness)*time.Second {
+			if gVerbose {
+				log.Printf("D 使用 %s 前最优节点选择的测试结果", age.Round(time.Second))
+			}
+			return m.Latency, nil
+		}
+	}
+	return testCurrent(ctx)
+}
+
+// 检查当前节点使用的 URL
+func probeURL(node *ProxyNode) string {
+	if gConfig.ProbeURL != "" {
+		return gConfig.ProbeURL
+	}
+	return testURLFor(node)
+}
+
+// 当前节点就是最优节点时只测试并记录延迟, 不做切换
+func measureCurrentNode() {
+	delay, err := checkDelay(gShutdown)
+	if gShutdown.Err() != nil {
+		return
+	}
+	recordCurrentLatency(delay, err)
+	if !gConfig.LogCurrentLatency {
+		return
+	}
+	if err != nil {
+		log.Printf("D 当前节点测试失败: %v", err)
+	} else {
+		log.Printf("D 当前节点延迟: %d", delay)
+	}
+}
+
+// 记录当前节点的延迟, 通过状态服务的 /status 和 /metrics 提供
+func recordCurrentLatency(delay int, err error) {
+	gCurrentCheckedAt = time.Now()
+	gCurrentLatency = delay
+	if err != nil {
+		gCurrentLatency = -1
+	}
+	gStats.recordCurrentTest(gCurrentLatency)
+}
+
+// 当前节点测试成功, 之前失败过时发布恢复事件
+func markCurrentUp(delay int) {
+	if gCurrentFailures > 0 {
+		publishEvent(EventNodeUp, map[string]any{"name": gCurrent.Name, "latency": delay})
+	}
+	gCurrentFailures = 0
+}
+
 func main() {
 	var configPath string
+	var check bool
 
 	var rootCmd = &cobra.Command{
 		Use:   "autoclash",
 		Short: "autoclash 是一个用于自动选择和切换 ClashX 节点的工具",
 		Run: func(cmd *cobra.Command, args []string) {
+			if check {
+				if err := checkConfig(configPath, os.Stdout); err != nil {
+					fmt.Fprintf(os.Stderr, "配置无效: %v\n", err)
+					os.Exit(1)
+				}
+				fmt.Fprintln(os.Stderr, "配置有效")
+				return
+			}
 			var err error
 			gConfig, err = loadConfig(configPath)
 			if err != nil {
 				log.Fatalf("加载配置失败: %v", err)
 			}
+			setupLogTime(gConfig)
+			gWorkers = newWorkerPool(gConfig.MaxGoroutines)
+			if gConfig.StartupTimeout > 0 {
+				if err := waitForController(time.Duration(gConfig.StartupTimeout) * time.Second); err != nil {
+					log.Fatalf("启动失败: %v", err)
+				}
+			}
+			if gConfig.SwitchGroup == "" || gConfig.CurrentGroup == "" {
+				waitSelectGroup()
+			}
+			if gConfig.Profile != "" {
+				log.Printf("使用配置方案: %s", gConfig.Profile)
+			}
+			if gConfig.MonitorOnly {
+				log.Println("仅监控模式: 测试并记录节点状态, 不会切换节点")
+			}
+			if gConfig.WarmupDuration > 0 {
+				log.Printf("预热 %d 秒: 期间多轮测试并累计结果, 结束后才切换节点", gConfig.WarmupDuration)
+			}
+			if gConfig.DeferSwitchWhenBusy {
+				go startBusySampler()
+			}
+			if gConfig.DegradeWebhook != "" {
+				startDegradeWebhook(gShutdown, gConfig.DegradeWebhook)
+			}
+			if err := loadState(time.Now()); err != nil {
+				log.Printf("读取上次运行的测试结果失败: %v", err)
+			}
 
+			if gConfig.StatusAddr != "" {
+				go startStatusServer()
+			}
+			if gConfig.MetricsFile != "" {
+				go startMetricsFileWriter()
+			}
+			if gConfig.ReportFile != "" {
+				go startReportWriter()
+			}
+			gStartedAt = time.Now()
 			go startNodeUpdater()
 			go startBestNodeSelector()
 			go startCurrentNodeChecker()
 
-			select {} // 阻塞主协程
+			// 阻塞主协程直到收到退出信号
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			sig := <-signals
+			log.Printf("收到信号 %v, 退出", sig)
+			stopAll()
+			if gConfig.SessionSummary {
+				log.Printf("本次运行统计: %s", gStats.summary(time.Now()))
+			}
 		},
 	}
 
-	rootCmd.Flags().StringVarP(&configPath, "config", "c", "config.yml", "配置文件路径")
+	rootCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "config.yml", "配置文件路径")
+	rootCmd.PersistentFlags().StringVarP(&gProfileName, "profile", "p", "", "使用的配置方案, 覆盖配置文件中的 profile")
+	rootCmd.PersistentFlags().StringVar(&gConfigDir, "config-dir", "", "配置目录, 其中的 *.yml 按文件名顺序合并到配置文件上")
+	rootCmd.Flags().BoolVarP(&gVerbose, "verbose", "v", false, "每轮选择后输出所有节点的延迟")
+	rootCmd.PersistentFlags().BoolVar(&gDebug, "debug", false, "输出每个控制器请求的方法、URL(隐藏密钥)、结果和耗时")
+	rootCmd.Flags().BoolVar(&check, "check", false, "只加载并校验配置, 输出生效的配置后退出, 不连接控制器")
+	rootCmd.AddCommand(newDoctorCmd(&configPath))
+	rootCmd.AddCommand(newGroupsCmd(&configPath))
+	rootCmd.AddCommand(newWatchCmd(&configPath))
+	rootCmd.AddCommand(newExportCmd(&configPath))
+	rootCmd.AddCommand(newHistoryCmd(&configPath))
+	rootCmd.AddCommand(newRankCmd(&configPath))
+	rootCmd.AddCommand(newSetupCmd(&configPath))
 	rootCmd.Execute()
 }
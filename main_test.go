@@ -0,0 +1,1921 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 启动模拟控制器, 并将 gConfig 指向它
+func newTestController(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	gConfig = &Config{
+		APIEndpoint:  server.URL,
+		SelectNode:   "Proxy",
+		SwitchGroup:  "Proxy",
+		CurrentGroup: "Proxy",
+		ExcludeRegex: "^$",
+		TestURL:      "http://www.gstatic.com/generate_204",
+	}
+}
+
+// 最小可用配置, 测试时在其后追加需要的配置项
+const testConfigBase = `api_endpoint: http://127.0.0.1:9090
+select_node: Proxy
+include_regex: ""
+exclude_regex: "^$"
+test_url: http://www.gstatic.com/generate_204
+retrieve_interval: 3600
+current_interval: 60
+best_interval: 600
+test_times: 3
+latency_threshold: 250
+`
+
+// 写入测试配置文件并返回路径, extra 中的顶层配置项会替换基础配置中的同名项
+func writeTestConfig(t *testing.T, extra string) string {
+	t.Helper()
+	var lines []string
+	for _, line := range strings.Split(testConfigBase, "\n") {
+		key, _, _ := strings.Cut(line, ":")
+		if line != "" && !strings.HasPrefix(extra, key+":") && !strings.Contains(extra, "\n"+key+":") {
+			lines = append(lines, line)
+		}
+	}
+	data := strings.Join(lines, "\n") + "\n" + extra
+	path := t.TempDir() + "/config.yml"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckStatus(t *testing.T) {
+	tests := []struct {
+		code     int
+		notFound error
+		want     error
+	}{
+		{http.StatusOK, nil, nil},
+		{http.StatusNoContent, nil, nil},
+		{http.StatusUnauthorized, nil, ErrAuth},
+		{http.StatusForbidden, ErrNodeNotFound, ErrAuth},
+		{http.StatusNotFound, ErrNodeNotFound, ErrNodeNotFound},
+		{http.StatusNotFound, ErrGroupNotFound, ErrGroupNotFound},
+	}
+	for _, tt := range tests {
+		err := checkStatus(&http.Response{StatusCode: tt.code}, tt.notFound)
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("checkStatus(%d) = %v, want nil", tt.code, err)
+			}
+			continue
+		}
+		if !errors.Is(err, tt.want) {
+			t.Errorf("checkStatus(%d) = %v, want %v", tt.code, err, tt.want)
+		}
+	}
+
+	// 没有指定 notFound 时, 404 和其他错误码都不属于任何错误类型
+	for _, code := range []int{http.StatusNotFound, http.StatusInternalServerError} {
+		err := checkStatus(&http.Response{StatusCode: code}, nil)
+		if err == nil {
+			t.Errorf("checkStatus(%d) = nil, want error", code)
+		}
+		for _, sentinel := range []error{ErrAuth, ErrUnreachable, ErrGroupNotFound, ErrNodeNotFound} {
+			if errors.Is(err, sentinel) {
+				t.Errorf("checkStatus(%d) = %v, should not be %v", code, err, sentinel)
+			}
+		}
+	}
+}
+
+func TestGetNodesGroupErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want error
+	}{
+		{"missing group", `{"proxies":{"HK 01":{"name":"HK 01","type":"Shadowsocks","alive":true}}}`, ErrGroupNotFound},
+		{"not a selector", `{"proxies":{"Proxy":{"name":"Proxy","type":"URLTest","now":"HK 01"}}}`, ErrGroupNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			})
+			if _, _, err := getNodes(); !errors.Is(err, tt.want) {
+				t.Errorf("getNodes() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	if _, _, err := getNodes(); !errors.Is(err, ErrAuth) {
+		t.Errorf("getNodes() error = %v, want %v", err, ErrAuth)
+	}
+
+	newTestController(t, nil)
+	gConfig.APIEndpoint = "http://127.0.0.1:1"
+	if _, _, err := getNodes(); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("getNodes() error = %v, want %v", err, ErrUnreachable)
+	}
+}
+
+func TestGetNodesCurrent(t *testing.T) {
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"proxies":{
+			"Proxy":{"name":"Proxy","type":"Selector","now":"HK 02 2x"},
+			"DIRECT":{"name":"DIRECT","type":"Direct"},
+			"HK 01":{"name":"HK 01","type":"Shadowsocks","alive":true},
+			"HK 02 2x":{"name":"HK 02 2x","type":"Trojan","alive":true},
+			"HK 03":{"name":"HK 03","type":"Trojan","alive":false}
+		}}`))
+	})
+	nodes, current, err := getNodes()
+	if err != nil {
+		t.Fatalf("getNodes() error = %v", err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("getNodes() returned %d nodes, want 2", len(nodes))
+	}
+	if current == nil || current.Name != "HK 02 2x" || current.Flow != 2 {
+		t.Errorf("current = %+v, want HK 02 2x with flow 2", current)
+	}
+}
+
+func TestGetNodesSorted(t *testing.T) {
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"proxies":{
+			"Proxy":{"name":"Proxy","type":"Selector","now":"HK 01"},
+			"SG 01":{"name":"SG 01","type":"Trojan","alive":true},
+			"HK 02":{"name":"HK 02","type":"Trojan","alive":true},
+			"JP 01":{"name":"JP 01","type":"Trojan","alive":true},
+			"HK 01":{"name":"HK 01","type":"Trojan","alive":true}
+		}}`))
+	})
+	for range 5 {
+		nodes, _, err := getNodes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, node := range nodes {
+			names = append(names, node.Name)
+		}
+		if got := strings.Join(names, ","); got != "HK 01,HK 02,JP 01,SG 01" {
+			t.Fatalf("getNodes() order = %s, want sorted by name", got)
+		}
+	}
+}
+
+func TestGetNodesSkipsInfoNodes(t *testing.T) {
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"proxies":{
+			"Proxy":{"name":"Proxy","type":"Selector","now":"HK 01"},
+			"剩余流量：10GB":{"name":"剩余流量：10GB","type":"Trojan","alive":true},
+			"套餐到期：2025-12-31":{"name":"套餐到期：2025-12-31","type":"Trojan","alive":true},
+			"Expire: 2025-12-31":{"name":"Expire: 2025-12-31","type":"Trojan","alive":true},
+			"HK 01":{"name":"HK 01","type":"Trojan","alive":true}
+		}}`))
+	})
+	gConfig.InfoNodeRegex = defaultInfoNodeRegex
+	gConfig.infoNodeRe = regexp.MustCompile(defaultInfoNodeRegex)
+	nodes, _, err := getNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].Name != "HK 01" {
+		t.Errorf("getNodes() = %v, want only HK 01", nodes)
+	}
+}
+
+func TestSeparateSwitchAndCurrentGroups(t *testing.T) {
+	var switched string
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			switched = r.URL.Path
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write([]byte(`{"proxies":{
+			"Proxy":{"name":"Proxy","type":"Selector","now":"HK 01"},
+			"Auto":{"name":"Auto","type":"Fallback","now":"HK 02"},
+			"HK 01":{"name":"HK 01","type":"Shadowsocks","alive":true},
+			"HK 02":{"name":"HK 02","type":"Trojan","alive":true}
+		}}`))
+	})
+	gConfig.CurrentGroup = "Auto"
+	nodes, current, err := getNodes()
+	if err != nil {
+		t.Fatalf("getNodes() error = %v", err)
+	}
+	if len(nodes) != 2 || current == nil || current.Name != "HK 02" {
+		t.Errorf("getNodes() = %d nodes, current %v, want 2 nodes and current HK 02 from Auto", len(nodes), current)
+	}
+	if err := switchNode(nodes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if switched != "/proxies/Proxy" {
+		t.Errorf("switched %s, want /proxies/Proxy", switched)
+	}
+
+	gConfig.CurrentGroup = "Missing"
+	if _, _, err := getNodes(); !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("getNodes() error = %v, want ErrGroupNotFound", err)
+	}
+}
+
+func TestSwitchNodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		body string
+		want error
+	}{
+		{"node not in group", http.StatusBadRequest, `{"message":"Selector update error: proxy not exist"}`, ErrNodeNotFound},
+		{"group missing", http.StatusNotFound, `{"message":"Resource not found"}`, ErrGroupNotFound},
+		{"unauthorized", http.StatusUnauthorized, `{"message":"Unauthorized"}`, ErrAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.code)
+				w.Write([]byte(tt.body))
+			})
+			if err := switchNode(&ProxyNode{Name: "HK 01"}); !errors.Is(err, tt.want) {
+				t.Errorf("switchNode() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// 请求体无效等其他 400 错误不应被识别为节点不存在
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message":"Body invalid"}`))
+	})
+	err := switchNode(&ProxyNode{Name: "HK 01"})
+	if err == nil || errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("switchNode() error = %v, want a generic error", err)
+	}
+}
+
+func TestSwitchNodeSerialized(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			return
+		}
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		if n > maxInFlight.Load() {
+			maxInFlight.Store(n)
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	var wg sync.WaitGroup
+	for i := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := switchNode(&ProxyNode{Name: fmt.Sprintf("HK %02d", i)}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := maxInFlight.Load(); got != 1 {
+		t.Errorf("concurrent PUT requests = %d, want 1", got)
+	}
+}
+
+func TestTestNodeErrors(t *testing.T) {
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	if _, err := testNode(context.Background(), &ProxyNode{Name: "HK 01"}); !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("testNode() error = %v, want %v", err, ErrNodeNotFound)
+	}
+
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"delay":123}`))
+	})
+	if delay, err := testNode(context.Background(), &ProxyNode{Name: "HK 01"}); err != nil || delay != 123 {
+		t.Errorf("testNode() = %d, %v, want 123, nil", delay, err)
+	}
+}
+
+func TestControllerDelayTimeout(t *testing.T) {
+	var timeout, expected string
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		timeout = r.URL.Query().Get("timeout")
+		expected = r.URL.Query().Get("expected")
+		w.Write([]byte(`{"delay":123}`))
+	})
+	gConfig.TestTimeoutMS = 3000
+	if _, err := testNode(context.Background(), &ProxyNode{Name: "HK 01"}); err != nil {
+		t.Fatal(err)
+	}
+	if timeout != "3000" || expected != "" {
+		t.Errorf("timeout = %q, expected = %q, want 3000 and no expected status", timeout, expected)
+	}
+	gConfig.TestExpectStatus = "204/200-299"
+	testNode(context.Background(), &ProxyNode{Name: "HK 01"})
+	if expected != "204/200-299" {
+		t.Errorf("expected = %q, want 204/200-299", expected)
+	}
+	if got := testClientTimeout(); got <= 3*time.Second {
+		t.Errorf("testClientTimeout() = %v, want more than 3s", got)
+	}
+
+	config, err := loadConfig(writeTestConfig(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.TestTimeoutMS != 5000 {
+		t.Errorf("TestTimeoutMS = %d, want 5000", config.TestTimeoutMS)
+	}
+}
+
+func TestControllerRequestsEscapeNames(t *testing.T) {
+	const name = "🇭🇰 香港 |IEPL| 01/x?#"
+	const group = "🔰 节点选择"
+	var paths []string
+	var testURL string
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		testURL = r.URL.Query().Get("url")
+		w.Write([]byte(`{"delay":80}`))
+	})
+	gConfig.SwitchGroup = group
+	gConfig.TestURL = "http://example.com/check?a=1&b=2"
+	if _, err := testNode(context.Background(), &ProxyNode{Name: name}); err != nil {
+		t.Fatal(err)
+	}
+	if err := switchNode(&ProxyNode{Name: name}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"GET /proxies/" + name + "/delay", "PUT /proxies/" + group}
+	if strings.Join(paths, "\n") != strings.Join(want, "\n") {
+		t.Errorf("paths = %q, want %q", paths, want)
+	}
+	if testURL != gConfig.TestURL {
+		t.Errorf("url = %q, want %q", testURL, gConfig.TestURL)
+	}
+}
+
+// 生成一组新的节点, 模拟更新节点列表
+func newTestNodes(names ...string) []*ProxyNode {
+	nodes := make([]*ProxyNode, len(names))
+	for i, name := range names {
+		nodes[i] = &ProxyNode{Name: name, Flow: 1}
+	}
+	return nodes
+}
+
+func TestSampleNodesRotation(t *testing.T) {
+	gConfig = &Config{BestSampleSize: 3, BestInterval: 600}
+	gMeasurements = make(map[string]measurement)
+	gBest = nil
+	names := []string{"n0", "n1", "n2", "n3", "n4", "n5", "n6"}
+	gNodes = newTestNodes(names...)
+
+	tested := make(map[string]bool)
+	now := time.Now()
+	for cycle := range 4 {
+		// 第三轮前更新节点列表, 新的节点对象不带测试结果
+		if cycle == 2 {
+			gNodes = newTestNodes(names...)
+			applyMeasurements(gNodes, now)
+		}
+		targets := sampleNodes(gNodes)
+		if len(targets) != gConfig.BestSampleSize {
+			t.Fatalf("cycle %d: sampled %d nodes, want %d", cycle, len(targets), gConfig.BestSampleSize)
+		}
+		if gBest != nil && targets[0].Name != gBest.Name {
+			t.Errorf("cycle %d: best node %s not sampled first", cycle, gBest.Name)
+		}
+		for _, node := range targets {
+			node.Latency, node.Success = 100+len(tested), 1
+			tested[node.Name] = true
+		}
+		recordMeasurements(targets, now)
+		applyMeasurements(gNodes, now)
+		gBest = targets[0]
+		now = now.Add(time.Duration(gConfig.BestInterval) * time.Second)
+	}
+	if len(tested) != len(names) {
+		t.Errorf("tested %d distinct nodes after 4 cycles, want %d", len(tested), len(names))
+	}
+	for _, node := range gNodes {
+		if node.Latency <= 0 || node.TestedAt.IsZero() {
+			t.Errorf("node %s lost its measurement across cycles", node.Name)
+		}
+	}
+}
+
+func TestTestShards(t *testing.T) {
+	gConfig = &Config{TestShardSize: 2, BestInterval: 600}
+	gMeasurements = make(map[string]measurement)
+	gNodes = newTestNodes("n0", "n1", "n2", "n3", "n4", "n5", "n6", "n7")
+	gBest = gNodes[0]
+
+	// 8 个节点分 4 片, 每 150 秒测试一片, 另加当前最优节点
+	if got := bestCycleInterval(len(gNodes)); got != 150*time.Second {
+		t.Errorf("bestCycleInterval() = %v, want 150s", got)
+	}
+	if got := len(sampleNodes(gNodes)); got != 3 {
+		t.Errorf("sampled %d nodes, want 3", got)
+	}
+	// 所有分片测试完之后再多一轮才失效
+	if got := measurementMaxAge(len(gNodes)); got != 5*150*time.Second {
+		t.Errorf("measurementMaxAge() = %v, want 750s", got)
+	}
+	if got := bestCycleInterval(2); got != 600*time.Second {
+		t.Errorf("bestCycleInterval(2) = %v, want 600s", got)
+	}
+
+	gConfig.TestShardSize = 0
+	if got := bestCycleInterval(len(gNodes)); got != 600*time.Second {
+		t.Errorf("without shards bestCycleInterval() = %v, want 600s", got)
+	}
+}
+
+func TestApplyMeasurementsAge(t *testing.T) {
+	gConfig = &Config{BestSampleSize: 2, BestInterval: 60}
+	gMeasurements = make(map[string]measurement)
+	now := time.Now()
+	nodes := newTestNodes("a", "b", "c", "d")
+	nodes[0].Latency, nodes[0].Success = 80, 1
+	recordMeasurements(nodes[:1], now)
+
+	// 4 个节点每轮测 1 个新节点需要 4 轮, 有效期为 5 轮
+	maxAge := measurementMaxAge(len(nodes))
+	if want := 5 * 60 * time.Second; maxAge != want {
+		t.Fatalf("measurementMaxAge() = %v, want %v", maxAge, want)
+	}
+
+	fresh := newTestNodes("a", "b", "c", "d")
+	applyMeasurements(fresh, now.Add(maxAge))
+	if fresh[0].Latency != 80 || fresh[1].Latency != 0 {
+		t.Errorf("latencies = %d, %d, want 80, 0", fresh[0].Latency, fresh[1].Latency)
+	}
+	applyMeasurements(fresh, now.Add(maxAge+time.Second))
+	if fresh[0].Latency != 0 || !fresh[0].TestedAt.IsZero() {
+		t.Errorf("stale measurement not aged out: %+v", fresh[0])
+	}
+}
+
+func TestUpdateProfiles(t *testing.T) {
+	gProfiles = make(map[string]*[24]float64)
+	now := time.Date(2026, 1, 1, 20, 30, 0, 0, time.Local)
+	node := &ProxyNode{Name: "a", Latency: 100}
+	failed := &ProxyNode{Name: "b", Latency: -1}
+
+	updateProfiles([]*ProxyNode{node, failed}, now)
+	if got := gProfiles["a"][20]; got != 100 {
+		t.Errorf("first sample = %v, want 100", got)
+	}
+	if _, ok := gProfiles["b"]; ok {
+		t.Error("failed node should not get a profile")
+	}
+
+	node.Latency = 200
+	updateProfiles([]*ProxyNode{node}, now)
+	if got, want := gProfiles["a"][20], profileAlpha*200+(1-profileAlpha)*100; got != want {
+		t.Errorf("ewma = %v, want %v", got, want)
+	}
+	if got := gProfiles["a"][21]; got != 0 {
+		t.Errorf("other hour = %v, want 0", got)
+	}
+}
+
+func TestNodeScore(t *testing.T) {
+	gProfiles = map[string]*[24]float64{"a": {20: 300}}
+	evening := time.Date(2026, 1, 1, 20, 59, 59, 0, time.Local)
+	node := &ProxyNode{Name: "a", Latency: 100}
+
+	tests := []struct {
+		weight float64
+		now    time.Time
+		want   float64
+	}{
+		{0, evening, 100},
+		{0.5, evening, 200},
+		{1, evening, 300},
+		{0.5, evening.Add(time.Second), 100}, // 下一个小时没有历史数据
+	}
+	for _, tt := range tests {
+		gConfig = &Config{ProfileWeight: tt.weight}
+		if got := nodeScore(node, tt.now); got != tt.want {
+			t.Errorf("nodeScore(weight=%v, hour=%d) = %v, want %v", tt.weight, tt.now.Hour(), got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigProfileWeight(t *testing.T) {
+	for _, weight := range []string{"-0.1", "1.5"} {
+		if _, err := loadConfig(writeTestConfig(t, "profile_weight: "+weight+"\n")); err == nil {
+			t.Errorf("loadConfig(profile_weight=%s) error = nil, want error", weight)
+		}
+	}
+}
+
+func TestSelectionReasons(t *testing.T) {
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "HK 01"):
+			fmt.Fprint(w, `{"delay": 80}`)
+		case strings.Contains(r.URL.Path, "HK 02"):
+			fmt.Fprint(w, `{"delay": 400}`)
+		case strings.Contains(r.URL.Path, "/delay"):
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	gConfig.TestTimes, gConfig.LatencyThreshold = 1, 250
+	gMeasurements = make(map[string]measurement)
+	gNodes = []*ProxyNode{{Name: "HK 01", Flow: 1}, {Name: "HK 02", Flow: 1}, {Name: "HK 03", Flow: 1}}
+	if _, err := selectFastestNode(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{reasonBest, reasonOverThreshold, reasonFailedAll}
+	for i, node := range takeSnapshot().Nodes {
+		if node.Reason != want[i] {
+			t.Errorf("%s reason = %q, want %q", node.Name, node.Reason, want[i])
+		}
+	}
+	// 更新节点列表后保留到下一轮选择
+	nodes := []*ProxyNode{{Name: "HK 02"}, {Name: "HK 04"}}
+	keepReasons(gNodes, nodes)
+	if nodes[0].Reason != reasonOverThreshold || nodes[1].Reason != "" {
+		t.Errorf("kept reasons = %q, %q", nodes[0].Reason, nodes[1].Reason)
+	}
+}
+
+func TestNodeReason(t *testing.T) {
+	gConfig = &Config{ProfileWeight: 0.5}
+	now := time.Now()
+	best := &ProxyNode{Name: "best", Latency: 150, Flow: 1, TestedAt: now}
+	tests := []struct {
+		node *ProxyNode
+		code string
+		want string
+	}{
+		{best, reasonBest, "最优"},
+		{&ProxyNode{Latency: 0, Flow: 1}, reasonUntested, "未测试"},
+		{&ProxyNode{Latency: -1, Flow: 1, TestedAt: now}, reasonFailedAll, "测试全部失败"},
+		{&ProxyNode{Latency: 300, Flow: 1, TestedAt: now}, reasonOverThreshold, "超过阈值"},
+		{&ProxyNode{Latency: 100, Flow: 2, TestedAt: now}, reasonHigherFlow, "流量系数较高"},
+		{&ProxyNode{Latency: 100, Flow: 1, TestedAt: now}, reasonProfile, "时段加权得分较高"},
+		{&ProxyNode{Latency: 150, Flow: 1, TestedAt: now}, reasonTie, "与最优节点延迟相同"},
+		{&ProxyNode{Latency: 200, Flow: 1, TestedAt: now}, reasonSlower, "延迟较高"},
+	}
+	for _, tt := range tests {
+		if code, got := nodeReason(tt.node, best, 250); code != tt.code || got != tt.want {
+			t.Errorf("nodeReason(%+v) = %s, %s, want %s, %s", tt.node, code, got, tt.code, tt.want)
+		}
+	}
+}
+
+func TestIsAlive(t *testing.T) {
+	alive, dead := true, false
+	tests := []struct {
+		assume bool
+		alive  *bool
+		want   bool
+	}{
+		{true, nil, true},
+		{false, nil, false},
+		{false, &alive, true},
+		{true, &dead, false},
+	}
+	for _, tt := range tests {
+		gConfig = &Config{AssumeAlive: tt.assume}
+		if got := isAlive(&ProxyNode{Alive: tt.alive}); got != tt.want {
+			t.Errorf("isAlive(assume=%v, alive=%v) = %v, want %v", tt.assume, tt.alive, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigAssumeAlive(t *testing.T) {
+	if config, err := loadConfig(writeTestConfig(t, "")); err != nil || !config.AssumeAlive {
+		t.Errorf("default AssumeAlive = %v, %v, want true", config, err)
+	}
+	if config, err := loadConfig(writeTestConfig(t, "assume_alive_when_missing: false\n")); err != nil || config.AssumeAlive {
+		t.Errorf("AssumeAlive = %v, %v, want false", config, err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		extra   string
+		wantErr bool
+	}{
+		{"", false},
+		{"api_endpoint: \"\"\n", true},
+		{"api_endpoint: not a url\n", true},
+		{"select_node: \"\"\n", false}, // 启动后从控制器自动选择
+		{"include_regex: \"(\"\n", true},
+		{"test_times: -1\n", true},
+		{"best_sample_size: -1\n", true},
+		{"selection_mode: soft_penalty\npenalty_slope: 0.5\n", false},
+		{"selection_mode: hard\n", true},
+		{"penalty_slope: -1\n", true},
+		{"test_expect_status: 204/200-299\n", false},
+		{"test_expect_status: ok\n", true},
+		{"current_test_proxy: socks5://127.0.0.1:7891\n", false},
+		{"current_test_proxy: 127.0.0.1:7890\n", true},
+	}
+	for _, tt := range tests {
+		_, err := loadConfig(writeTestConfig(t, tt.extra))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("loadConfig(%q) error = %v, wantErr %v", tt.extra, err, tt.wantErr)
+		}
+	}
+}
+
+// 启动模拟控制器, 测速返回 delay (为 0 时返回超时), 记录切换请求
+func newSwitchController(t *testing.T, delay int) *[]string {
+	t.Helper()
+	var switched []string
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut:
+			var body struct{ Name string }
+			json.NewDecoder(r.Body).Decode(&body)
+			switched = append(switched, body.Name)
+			w.WriteHeader(http.StatusNoContent)
+		case delay == 0:
+			w.WriteHeader(http.StatusRequestTimeout)
+		default:
+			fmt.Fprintf(w, `{"delay":%d}`, delay)
+		}
+	})
+	return &switched
+}
+
+func TestCheckCurrentNode(t *testing.T) {
+	tests := []struct {
+		name         string
+		delay        int
+		slowAction   string
+		deadFailures int
+		checks       int
+		wantSwitched int
+		wantPending  bool
+	}{
+		{"healthy", 100, "next_cycle", 1, 1, 0, false},
+		{"dead switches immediately", 0, "next_cycle", 1, 1, 1, false},
+		{"dead waits for failures", 0, "next_cycle", 3, 2, 0, false},
+		{"slow defers to next cycle", 600, "next_cycle", 1, 1, 0, true},
+		{"slow switches", 600, "switch", 1, 1, 1, false},
+		{"slow ignored", 600, "ignore", 1, 1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			switched := newSwitchController(t, tt.delay)
+			gConfig.SlowThreshold = 500
+			gConfig.SlowAction = tt.slowAction
+			gConfig.DeadFailures = tt.deadFailures
+			gCurrent, gBest = &ProxyNode{Name: "current"}, &ProxyNode{Name: "best"}
+			gSlowPending, gCurrentFailures = false, 0
+			for range tt.checks {
+				checkCurrentNode()
+			}
+			if len(*switched) != tt.wantSwitched {
+				t.Errorf("switched %v, want %d switches", *switched, tt.wantSwitched)
+			}
+			if gSlowPending != tt.wantPending {
+				t.Errorf("gSlowPending = %v, want %v", gSlowPending, tt.wantPending)
+			}
+		})
+	}
+}
+
+func TestCheckCurrentNodeControllerUnreachable(t *testing.T) {
+	var switched int
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			switched++
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// 模拟控制器断开连接
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	})
+	gConfig.DeadFailures = 1
+	gCurrent = &ProxyNode{Name: "current"}
+	gBest = &ProxyNode{Name: "best"}
+	gNodes = []*ProxyNode{gCurrent, gBest}
+	gCurrentFailures = 0
+	gCurrentLatency = 120
+	defer func() { gCurrentLatency = -1 }()
+
+	checkCurrentNode()
+	if switched != 0 || gCurrentFailures != 0 || gCurrentLatency != 120 {
+		t.Errorf("controller error blamed on the node: switched %d, failures %d, latency %d", switched, gCurrentFailures, gCurrentLatency)
+	}
+}
+
+func TestCheckDelayFreshness(t *testing.T) {
+	tested := 0
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		tested++
+		fmt.Fprint(w, `{"delay":90}`)
+	})
+	gConfig.MeasurementFreshness = 60
+	gCurrent = &ProxyNode{Name: "current"}
+	gMeasurements = map[string]measurement{"current": {Latency: 70, TestedAt: time.Now().Add(-30 * time.Second)}}
+	defer func() { gMeasurements = make(map[string]measurement) }()
+
+	if delay, err := checkDelay(context.Background()); err != nil || delay != 70 || tested != 0 {
+		t.Errorf("fresh measurement: delay %d, err %v, tested %d, want 70 without testing", delay, err, tested)
+	}
+	// 过期或失败的结果、来自上次运行的结果都重新测试
+	for _, m := range []measurement{
+		{Latency: 70, TestedAt: time.Now().Add(-2 * time.Minute)},
+		{Latency: -1, TestedAt: time.Now()},
+		{Latency: 70, TestedAt: time.Now(), Stale: true},
+	} {
+		gMeasurements["current"] = m
+		tested = 0
+		if delay, err := checkDelay(context.Background()); err != nil || delay != 90 || tested != 1 {
+			t.Errorf("measurement %+v: delay %d, err %v, tested %d, want a new test", m, delay, err, tested)
+		}
+	}
+}
+
+func TestProbeURL(t *testing.T) {
+	var urls []string
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		urls = append(urls, r.URL.Query().Get("url"))
+		fmt.Fprint(w, `{"delay":50}`)
+	})
+	gConfig.ProbeURL = "http://cp.cloudflare.com/generate_204"
+	gCurrent = &ProxyNode{Name: "current"}
+	if _, err := testCurrent(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testNode(context.Background(), gCurrent); err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 2 || urls[0] != gConfig.ProbeURL || urls[1] != gConfig.TestURL {
+		t.Errorf("tested urls = %v, want probe_url for the current check and test_url for selection", urls)
+	}
+}
+
+func TestMeasureCurrentNode(t *testing.T) {
+	switched := newSwitchController(t, 0)
+	gCurrent = &ProxyNode{Name: "best"}
+	gBest = gCurrent
+	measureCurrentNode()
+	if gCurrentLatency != -1 || gCurrentCheckedAt.IsZero() || len(*switched) != 0 {
+		t.Errorf("failed check: latency %d, checked at %v, switched %v", gCurrentLatency, gCurrentCheckedAt, *switched)
+	}
+
+	newSwitchController(t, 80)
+	measureCurrentNode()
+	if gCurrentLatency != 80 {
+		t.Errorf("gCurrentLatency = %d, want 80", gCurrentLatency)
+	}
+	setCurrent(&ProxyNode{Name: "other"})
+	if gCurrentLatency != -1 {
+		t.Errorf("gCurrentLatency = %d after the current node changed, want -1", gCurrentLatency)
+	}
+}
+
+func TestResolveSlowCurrent(t *testing.T) {
+	for _, recovered := range []bool{true, false} {
+		switched := newSwitchController(t, 100)
+		gConfig.SlowThreshold = 500
+		gNodes = newTestNodes("current", "best")
+		gNodes[0].Latency, gNodes[1].Latency = 800, 100
+		if recovered {
+			gNodes[0].Latency = 300
+		}
+		gCurrent, gBest = gNodes[0], gNodes[1]
+		gSlowPending = true
+		resolveSlowCurrent()
+		if gSlowPending {
+			t.Error("gSlowPending should be cleared")
+		}
+		if wantSwitch := !recovered; (len(*switched) == 1) != wantSwitch {
+			t.Errorf("recovered=%v: switched %v", recovered, *switched)
+		}
+	}
+}
+
+func TestLoadConfigProfiles(t *testing.T) {
+	extra := `profile: home
+profiles:
+  home:
+    include_regex: "香港|台湾"
+  work: &work
+    include_regex: "日本"
+    latency_threshold: 150
+  work-strict:
+    <<: *work
+    exclude_regex: "2x"
+`
+	tests := []struct {
+		flag, wantInclude, wantExclude string
+		wantThreshold                  int
+		wantErr                        bool
+	}{
+		{"", "香港|台湾", "^$", 250, false},
+		{"work", "日本", "^$", 150, false},
+		{"work-strict", "日本", "2x", 150, false},
+		{"missing", "", "", 0, true},
+	}
+	defer func() { gProfileName = "" }()
+	for _, tt := range tests {
+		gProfileName = tt.flag
+		config, err := loadConfig(writeTestConfig(t, extra))
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("loadConfig(--profile %q) error = %v, wantErr %v", tt.flag, err, tt.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if config.IncludeRegex != tt.wantInclude || config.ExcludeRegex != tt.wantExclude || config.LatencyThreshold != tt.wantThreshold {
+			t.Errorf("--profile %q: include=%q exclude=%q threshold=%d", tt.flag, config.IncludeRegex, config.ExcludeRegex, config.LatencyThreshold)
+		}
+	}
+}
+
+func TestSwitchCurrentStartupGrace(t *testing.T) {
+	switched := newSwitchController(t, 100)
+	gConfig.StartupGrace = 60
+	defer func() { gStartedAt = time.Now().Add(-time.Hour) }()
+	gCurrent = nil
+
+	gStartedAt = time.Now()
+	if err := switchCurrent(&ProxyNode{Name: "best"}, "C"); err == nil || len(*switched) != 0 || gCurrent != nil {
+		t.Errorf("switch during grace period: err = %v, switched = %v", err, *switched)
+	}
+	gStartedAt = time.Now().Add(-61 * time.Second)
+	if err := switchCurrent(&ProxyNode{Name: "best"}, "C"); err != nil || len(*switched) != 1 || gCurrent == nil {
+		t.Errorf("switch after grace period: err = %v, switched = %v", err, *switched)
+	}
+}
+
+func TestSwitchCurrentMonitorOnly(t *testing.T) {
+	switched := newSwitchController(t, 100)
+	gConfig.MonitorOnly = true
+	gCurrent = &ProxyNode{Name: "current"}
+	gBest = &ProxyNode{Name: "best"}
+	gNodes = []*ProxyNode{gCurrent, gBest}
+
+	if err := switchToBest("C"); !errors.Is(err, errMonitorOnly) {
+		t.Errorf("switchToBest() error = %v, want errMonitorOnly", err)
+	}
+	if err := failover("D"); !errors.Is(err, errMonitorOnly) {
+		t.Errorf("failover() error = %v, want errMonitorOnly", err)
+	}
+	if len(*switched) != 0 || gCurrent.Name != "current" {
+		t.Errorf("switched = %v in monitor_only mode", *switched)
+	}
+	if snapshot := takeSnapshot(); !snapshot.MonitorOnly {
+		t.Error("snapshot.MonitorOnly = false, want true")
+	}
+}
+
+func TestSwitchCurrentStaleNodeList(t *testing.T) {
+	switched := newSwitchController(t, 100)
+	gConfig.MaxNodeListAge = 60
+	gNodesUpdatedAt, gNodeListStale = time.Now().Add(-2*time.Minute), false
+	defer func() { gNodesUpdatedAt, gNodeListStale = time.Time{}, false }()
+	gCurrent = &ProxyNode{Name: "current"}
+	gBest = &ProxyNode{Name: "best"}
+	gNodes = []*ProxyNode{gCurrent, gBest}
+
+	warnStaleNodeList(time.Now())
+	if !gNodeListStale || !takeSnapshot().NodeListStale {
+		t.Error("stale node list not reported")
+	}
+	if err := switchToBest("B"); !errors.Is(err, errStaleNodeList) || len(*switched) != 0 {
+		t.Errorf("switchToBest() with a stale node list = %v, switched %v", err, *switched)
+	}
+	gNodesUpdatedAt = time.Now()
+	if err := switchToBest("B"); err != nil || len(*switched) != 1 {
+		t.Errorf("switchToBest() after refresh = %v, switched %v", err, *switched)
+	}
+}
+
+func TestRefreshNodesWithoutLock(t *testing.T) {
+	release := make(chan struct{})
+	now := "A"
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprintf(w, `{"proxies":{
+			"Proxy":{"name":"Proxy","type":"Selector","now":%q,"all":["A","B","C"]},
+			"A":{"name":"A","type":"Trojan","alive":true},
+			"B":{"name":"B","type":"Trojan","alive":true},
+			"C":{"name":"C","type":"Trojan","alive":true}
+		}}`, now)
+	})
+	gCurrent = &ProxyNode{Name: "A"}
+	gNodes = []*ProxyNode{gCurrent, {Name: "B"}}
+
+	done := make(chan bool)
+	go func() { done <- refreshNodes() }()
+	// 请求控制器期间其他协程可以持有 mu 读取原来的节点列表, 并切换节点
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if len(gNodes) != 2 {
+		t.Errorf("nodes during refresh = %d, want the previous 2", len(gNodes))
+	}
+	setCurrent(&ProxyNode{Name: "B"})
+	mu.Unlock()
+	close(release)
+	if !<-done {
+		t.Fatal("refreshNodes() failed")
+	}
+	if len(gNodes) != 3 || gCurrent.Name != "B" {
+		t.Errorf("after refresh: %d nodes, current %s, want 3 nodes and the switched node B", len(gNodes), gCurrent.Name)
+	}
+
+	// 期间没有切换时使用控制器返回的当前节点
+	now = "C"
+	if !refreshNodes() || gCurrent.Name != "C" {
+		t.Errorf("current = %s, want C from the controller", gCurrent.Name)
+	}
+}
+
+func TestSelectFastestNodeWithoutLock(t *testing.T) {
+	release := make(chan struct{})
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/delay") {
+			<-release
+			fmt.Fprint(w, `{"delay": 80}`)
+		}
+	})
+	gConfig.TestTimes, gConfig.LatencyThreshold = 1, 250
+	gMeasurements = make(map[string]measurement)
+	gNodes = []*ProxyNode{{Name: "HK 01", Flow: 1, Latency: 120}}
+
+	done := make(chan error)
+	go func() {
+		_, err := selectFastestNode()
+		done <- err
+	}()
+	// 测试期间可以持有 mu 读取上一轮的结果
+	time.Sleep(50 * time.Millisecond)
+	if !mu.TryLock() {
+		t.Fatal("mu is held during the sweep")
+	}
+	if latency := takeSnapshot().Nodes[0].Latency; latency != 120 {
+		t.Errorf("latency during the sweep = %d, want the previous 120", latency)
+	}
+	mu.Unlock()
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if gNodes[0].Latency != 80 {
+		t.Errorf("latency after the sweep = %d, want 80", gNodes[0].Latency)
+	}
+}
+
+func TestSwitchCurrentSameNode(t *testing.T) {
+	switched := newSwitchController(t, 100)
+	gSwitchHistory = nil
+	defer func() { gSwitchHistory = nil }()
+	gCurrent = &ProxyNode{Name: "current"}
+	gNodes = []*ProxyNode{gCurrent}
+	switches := gStats.switches
+
+	if err := switchCurrent(&ProxyNode{Name: "current"}, "B"); err != nil {
+		t.Errorf("switchCurrent() to the current node = %v", err)
+	}
+	if len(*switched) != 0 || len(gSwitchHistory) != 0 || gStats.switches != switches {
+		t.Errorf("switched = %v, history = %v, want no switch", *switched, gSwitchHistory)
+	}
+}
+
+func TestSwitchRecordsReason(t *testing.T) {
+	newSwitchController(t, 100)
+	gSwitchHistory = nil
+	defer func() { gSwitchHistory = nil }()
+	gCurrent = &ProxyNode{Name: "current"}
+	gCurrentLatency = 900
+	defer func() { gCurrentLatency = -1 }()
+	gBest = &ProxyNode{Name: "best", Latency: 80}
+	gNodes = []*ProxyNode{gCurrent, gBest}
+
+	gSwitchReason = "当前节点过慢"
+	if err := switchToBest("D"); err != nil {
+		t.Fatal(err)
+	}
+	if len(gSwitchHistory) != 1 {
+		t.Fatalf("history = %v, want 1 record", gSwitchHistory)
+	}
+	record := gSwitchHistory[0]
+	if record.From != "current" || record.To != "best" || record.Reason != "当前节点过慢" || record.FromLatency != 900 || record.ToLatency != 80 {
+		t.Errorf("record = %+v", record)
+	}
+	if gSwitchReason != "" {
+		t.Errorf("gSwitchReason = %q after switch, want cleared", gSwitchReason)
+	}
+}
+
+func TestVerifyAfterSwitch(t *testing.T) {
+	var switched []string
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut:
+			var body struct{ Name string }
+			json.NewDecoder(r.Body).Decode(&body)
+			switched = append(switched, body.Name)
+			w.WriteHeader(http.StatusNoContent)
+		case strings.Contains(r.URL.Path, "broken"):
+			w.WriteHeader(http.StatusRequestTimeout)
+		default:
+			fmt.Fprint(w, `{"delay":100}`)
+		}
+	})
+	gConfig.VerifyAfterSwitch = true
+	gConfig.LatencyThreshold = 250
+	gSwitchHistory = nil
+	defer func() { gSwitchHistory = nil }()
+	gCurrent = &ProxyNode{Name: "current"}
+	broken := &ProxyNode{Name: "broken", Flow: 1, Latency: 50, TestedAt: time.Now()}
+	good := &ProxyNode{Name: "good", Flow: 1, Latency: 80, TestedAt: time.Now()}
+	gNodes = []*ProxyNode{gCurrent, broken, good}
+	gBest = broken
+
+	if err := switchToBest("D"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(switched, ",") != "broken,good" || gCurrent.Name != "good" {
+		t.Errorf("switched = %v, current = %s, want broken then good", switched, gCurrent.Name)
+	}
+	if len(gSwitchHistory) != 2 || gSwitchHistory[1].Reason != "切换后验证失败" {
+		t.Errorf("history = %+v", gSwitchHistory)
+	}
+}
+
+func TestLoadConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/10-tuning.yml", []byte("latency_threshold: 150\nprofile: work\n"), 0644)
+	os.WriteFile(dir+"/00-secret.yml", []byte("api_key: secret\nlatency_threshold: 100\n"), 0644)
+	os.WriteFile(dir+"/20-profiles.yml", []byte("profiles:\n  work:\n    include_regex: 日本\n"), 0644)
+	os.WriteFile(dir+"/ignored.yaml", []byte("api_key: ignored\n"), 0644)
+
+	gConfigDir = dir
+	defer func() { gConfigDir = "" }()
+	config, err := loadConfig(writeTestConfig(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.APIKey != "secret" || config.LatencyThreshold != 150 || config.IncludeRegex != "日本" || config.TestTimes != 3 {
+		t.Errorf("merged config = key %q, threshold %d, include %q, test_times %d", config.APIKey, config.LatencyThreshold, config.IncludeRegex, config.TestTimes)
+	}
+}
+
+func TestPickFastestNodeDecision(t *testing.T) {
+	gConfig = &Config{LatencyThreshold: 200, TestTimes: 3}
+	gControllerLatency = 15
+	defer func() { gControllerLatency = -1 }()
+	now := time.Now()
+	gNodes = []*ProxyNode{
+		{Name: "cheap slow", Flow: 0.5, Latency: 230},
+		{Name: "fast", Flow: 1, Latency: 100},
+		{Name: "faster 2x", Flow: 2, Latency: 50},
+		{Name: "cheap slower", Flow: 0.5, Latency: 260},
+		{Name: "failed", Flow: 0.1, Latency: -1},
+	}
+	// 阈值 200 时 0.5x 分组没有合格节点, 1x 分组的 fast 胜出, 次优为去掉 fast 后重新选择的结果
+	d := pickFastestNode(now)
+	if d.Best == nil || d.Best.Name != "fast" || d.Threshold != 200 || d.Flow != 1 || d.Mode != "flow_groups" {
+		t.Fatalf("decision = %+v", d)
+	}
+	if d.RunnerUp != "faster 2x" || d.RunnerUpLatency != 50 {
+		t.Errorf("runner-up = %s (%d), want faster 2x (50)", d.RunnerUp, d.RunnerUpLatency)
+	}
+	if d.Controller != 15 || !strings.Contains(d.String(), "控制器延迟: 15ms") {
+		t.Errorf("decision = %s, want controller latency 15ms", d)
+	}
+
+	// 只剩 0.5x 分组时逐步放宽阈值
+	gNodes = gNodes[:1]
+	d = pickFastestNode(now)
+	if d.Best == nil || d.Threshold != 240 || d.RunnerUp != "" {
+		t.Errorf("widened decision = %+v, want threshold 240 and no runner-up", d)
+	}
+
+	gNodes = nil
+	if d = pickFastestNode(now); d.Best != nil || d.Threshold != 400 {
+		t.Errorf("empty decision = %+v", d)
+	}
+}
+
+func TestSwitchToBestRetryAndFailover(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  map[string]int // 每个节点前几次切换请求返回 500
+		wantNode  string
+		wantCalls int
+	}{
+		{"transient failure", map[string]int{"best": 1}, "best", 2},
+		{"fall back to next best", map[string]int{"best": 99}, "second", 4},
+		{"all candidates fail", map[string]int{"best": 99, "second": 99, "third": 99}, "current", 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+				var body struct{ Name string }
+				json.NewDecoder(r.Body).Decode(&body)
+				calls++
+				if tt.failures[body.Name] > 0 {
+					tt.failures[body.Name]--
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			})
+			gConfig.SwitchRetries, gConfig.SwitchRetryDelay, gConfig.LatencyThreshold = 2, 1, 250
+			gNodes = []*ProxyNode{
+				{Name: "current", Flow: 1, Latency: 300},
+				{Name: "best", Flow: 1, Latency: 50},
+				{Name: "second", Flow: 1, Latency: 80},
+				{Name: "third", Flow: 1, Latency: 120},
+			}
+			gCurrent, gBest = gNodes[0], gNodes[1]
+			switchToBest("D")
+			if gCurrent.Name != tt.wantNode || calls != tt.wantCalls {
+				t.Errorf("current = %s after %d calls, want %s after %d", gCurrent.Name, calls, tt.wantNode, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestSwitchCurrentPrewarm(t *testing.T) {
+	var requests []string
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprint(w, `{"delay":60}`)
+	})
+	gConfig.PrewarmBeforeSwitch = true
+	gConfig.TestMethod = "tcp" // 预热总是通过控制器
+	gCurrent = nil
+	if err := switchCurrent(&ProxyNode{Name: "HK 01"}, "D"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"GET /proxies/HK 01/delay", "PUT /proxies/Proxy"}
+	if len(requests) != 2 || requests[0] != want[0] || requests[1] != want[1] {
+		t.Errorf("requests = %q, want %q", requests, want)
+	}
+}
+
+func TestPickNodePriority(t *testing.T) {
+	gConfig = &Config{LatencyThreshold: 200, NodePriority: []string{"IEPL", "BGP"}}
+	if err := validateConfig(&Config{APIEndpoint: "http://x", SelectNode: "P", RetrieveInterval: 1, CurrentInterval: 1, BestInterval: 1, TestTimes: 1, LatencyThreshold: 1, SlowAction: "ignore", NodePriority: []string{"("}}); err == nil {
+		t.Error("invalid node_priority should fail validation")
+	}
+	for _, expr := range gConfig.NodePriority {
+		gConfig.priorityRes = append(gConfig.priorityRes, regexp.MustCompile(expr))
+	}
+	now := time.Now()
+	tests := []struct {
+		name  string
+		nodes []*ProxyNode
+		want  string
+	}{
+		{"top tier wins over faster lower tier", []*ProxyNode{
+			{Name: "HK IEPL", Flow: 1, Latency: 180},
+			{Name: "HK BGP", Flow: 1, Latency: 60},
+			{Name: "HK plain", Flow: 0.5, Latency: 30},
+		}, "HK IEPL"},
+		{"unhealthy top tier falls through", []*ProxyNode{
+			{Name: "HK IEPL", Flow: 1, Latency: -1},
+			{Name: "HK BGP 2x", Flow: 2, Latency: 150},
+			{Name: "HK plain", Flow: 0.5, Latency: 30},
+		}, "HK BGP 2x"},
+		{"flow grouping within a tier", []*ProxyNode{
+			{Name: "HK IEPL 2x", Flow: 2, Latency: 40},
+			{Name: "HK IEPL", Flow: 1, Latency: 190},
+		}, "HK IEPL"},
+		{"widening only after all tiers fail", []*ProxyNode{
+			{Name: "HK IEPL", Flow: 1, Latency: 215},
+			{Name: "HK plain", Flow: 1, Latency: 210},
+		}, "HK IEPL"},
+	}
+	for _, tt := range tests {
+		gNodes = tt.nodes
+		if d := pickFastestNode(now); d.Best == nil || d.Best.Name != tt.want {
+			t.Errorf("%s: best = %v, want %s", tt.name, d.Best, tt.want)
+		}
+	}
+}
+
+func TestSetCurrentWritesFile(t *testing.T) {
+	path := t.TempDir() + "/current"
+	gConfig = &Config{CurrentNodeFile: path, CurrentNodeFileLatency: true}
+	gCurrent = nil
+
+	setCurrent(&ProxyNode{Name: "HK 01", Latency: 88})
+	if data, _ := os.ReadFile(path); string(data) != "HK 01\n88\n" {
+		t.Errorf("file = %q", data)
+	}
+
+	// 更新节点列表后同名节点不视为变化, 不重写文件
+	os.WriteFile(path, []byte("untouched"), 0644)
+	setCurrent(&ProxyNode{Name: "HK 01", Latency: 99})
+	if data, _ := os.ReadFile(path); string(data) != "untouched" {
+		t.Errorf("file rewritten for the same node: %q", data)
+	}
+
+	gConfig.CurrentNodeFileLatency = false
+	setCurrent(nil)
+	if data, _ := os.ReadFile(path); string(data) != "" {
+		t.Errorf("file = %q, want empty when there is no current node", data)
+	}
+	setCurrent(&ProxyNode{Name: "HK 02"})
+	if data, _ := os.ReadFile(path); string(data) != "HK 02\n" {
+		t.Errorf("file = %q", data)
+	}
+}
+
+func TestExcludeFromTest(t *testing.T) {
+	gConfig = &Config{LatencyThreshold: 200, ExcludeFromTest: "UDP"}
+	gConfig.excludeTestRe = regexp.MustCompile(gConfig.ExcludeFromTest)
+	gBest = nil
+	gNodes = []*ProxyNode{
+		{Name: "HK UDP", Flow: 0.5, Latency: 10}, // 例如上次运行保存的结果
+		{Name: "HK 01", Flow: 1, Latency: 100},
+	}
+	for _, node := range sampleNodes(gNodes) {
+		if node.Name == "HK UDP" {
+			t.Error("excluded node should not be sampled for testing")
+		}
+	}
+	if d := pickFastestNode(time.Now()); d.Best == nil || d.Best.Name != "HK 01" {
+		t.Errorf("best = %v, want HK 01", d.Best)
+	}
+	if _, got := nodeReason(gNodes[0], gNodes[1], 200); got != "不参与测试" {
+		t.Errorf("nodeReason() = %s", got)
+	}
+}
+
+func TestMeasureNodesDeadline(t *testing.T) {
+	release := make(chan struct{})
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "Slow") {
+			<-release
+		}
+		fmt.Fprint(w, `{"delay": 80}`)
+	})
+	t.Cleanup(func() { close(release) })
+	gConfig.TestTimes = 1
+	targets := []*ProxyNode{{Name: "Fast"}, {Name: "Slow"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	results, _ := measureNodes(ctx, targets)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("measureNodes took %v, want early return at the deadline", elapsed)
+	}
+	if len(results[0]) != 1 || results[0][0] != 80 {
+		t.Errorf("fast node samples = %v, want [80]", results[0])
+	}
+	if results[1] != nil {
+		t.Errorf("unfinished node samples = %v, want none", results[1])
+	}
+}
+
+func TestZeroDelay(t *testing.T) {
+	node := &ProxyNode{Name: "Local"}
+	gConfig = &Config{TreatZeroAs: "failure"}
+	if latency, err := zeroDelay(node); err == nil || errors.Is(err, errZeroIgnored) {
+		t.Errorf("failure: zeroDelay() = %d, %v, want a failed test", latency, err)
+	}
+	gConfig.TreatZeroAs = "success_min"
+	if latency, err := zeroDelay(node); err != nil || latency != 1 {
+		t.Errorf("success_min: zeroDelay() = %d, %v, want 1", latency, err)
+	}
+
+	// ignore 时这次测试不计入次数, 不影响丢包率
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "Local") {
+			fmt.Fprint(w, `{"delay": 0}`)
+			return
+		}
+		fmt.Fprint(w, `{"delay": 80}`)
+	})
+	gConfig.TestTimes = 1
+	gConfig.TreatZeroAs = "ignore"
+	results, attempts := measureNodes(context.Background(), []*ProxyNode{node, {Name: "Remote"}})
+	if len(results[0]) != 0 || attempts[0] != 0 {
+		t.Errorf("ignored node = %v in %d attempts, want no samples in 0 attempts", results[0], attempts[0])
+	}
+	if len(results[1]) != 1 || attempts[1] != 1 {
+		t.Errorf("remote node = %v in %d attempts, want [80] in 1", results[1], attempts[1])
+	}
+}
+
+func TestFilterNodesTags(t *testing.T) {
+	gConfig = &Config{
+		ExcludeRegex: "^$",
+		RequireTags:  []string{"iepl"},
+		ExcludeTags:  []string{"x2"},
+		TagDelimiter: "|",
+	}
+	nodes := []*ProxyNode{
+		{Name: "香港 01 |IEPL|BGP|"},
+		{Name: "香港 02 |IEPL|x2|"},
+		{Name: "香港 03 |BGP|"},
+		{Name: "IEPL 香港 04"},
+	}
+	filtered, err := filterNodes(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filtered) != 1 || filtered[0].Name != "香港 01 |IEPL|BGP|" {
+		t.Errorf("filtered = %v", filtered)
+	}
+	if tags := nodeTags("香港 01 |IEPL| BGP |"); len(tags) != 2 || tags[1] != "BGP" {
+		t.Errorf("nodeTags() = %q", tags)
+	}
+}
+
+func TestEmptyFilterWarning(t *testing.T) {
+	gConfig = &Config{IncludeRegex: "香港", ExcludeRegex: ""}
+	candidates := []*ProxyNode{{Name: "香港 01"}, {Name: "香港 02"}}
+	filtered, err := filterNodes(candidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warning := emptyFilterWarning(candidates, filtered)
+	for _, want := range []string{`include_regex: "香港"`, `exclude_regex: ""`, "香港 01, 香港 02", "exclude_regex 为空"} {
+		if !strings.Contains(warning, want) {
+			t.Errorf("warning %q does not contain %q", warning, want)
+		}
+	}
+
+	gConfig.ExcludeRegex = "^$"
+	filtered, _ = filterNodes(candidates)
+	if warning := emptyFilterWarning(candidates, filtered); warning != "" {
+		t.Errorf("warning = %q, want none when nodes pass the filter", warning)
+	}
+	if warning := emptyFilterWarning(nil, nil); warning != "" {
+		t.Errorf("warning = %q, want none for an empty node list", warning)
+	}
+}
+
+func TestFilterNodesTypes(t *testing.T) {
+	gConfig = &Config{
+		ExcludeRegex: "^$",
+		IncludeTypes: []string{"trojan", "Vmess"},
+		ExcludeTypes: []string{"vmess"},
+	}
+	nodes := []*ProxyNode{
+		{Name: "香港 01", Type: "Trojan"},
+		{Name: "香港 02", Type: "Vmess"},
+		{Name: "香港 03", Type: "Shadowsocks"},
+	}
+	filtered, err := filterNodes(nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filtered) != 1 || filtered[0].Name != "香港 01" {
+		t.Errorf("filtered = %v", filtered)
+	}
+
+	gConfig.IncludeTypes = nil
+	if filtered, _ := filterNodes(nodes); len(filtered) != 2 {
+		t.Errorf("without include_types filtered = %v, want 2 nodes", filtered)
+	}
+}
+
+func TestPickNodeFlowLatencyPenalty(t *testing.T) {
+	gConfig = &Config{LatencyThreshold: 300, FlowLatencyPenalty: 100}
+	newNode := func(name string, flow float64, latency int) *ProxyNode {
+		return &ProxyNode{Name: name, Flow: flow, Latency: latency, TestedAt: time.Now()}
+	}
+
+	// 2x 节点快 150ms, 折算后仍然更优
+	nodes := []*ProxyNode{newNode("cheap", 1, 250), newNode("fast", 2, 100)}
+	if best, _ := pickNode(nodes, time.Now()); best == nil || best.Name != "fast" {
+		t.Errorf("pickNode() = %v, want fast", best)
+	}
+	// 只快 50ms 时不值得
+	nodes = []*ProxyNode{newNode("cheap", 1, 150), newNode("fast", 2, 100)}
+	if best, _ := pickNode(nodes, time.Now()); best == nil || best.Name != "cheap" {
+		t.Errorf("pickNode() = %v, want cheap", best)
+	}
+	if _, reason := nodeReason(nodes[1], nodes[0], 300); reason != "流量系数折算后延迟较高" {
+		t.Errorf("nodeReason() = %q", reason)
+	}
+	// 超过阈值的节点仍然落选
+	nodes = []*ProxyNode{newNode("cheap", 1, 350), newNode("fast", 2, 100)}
+	if best, _ := pickNode(nodes, time.Now()); best == nil || best.Name != "fast" {
+		t.Errorf("pickNode() = %v, want fast", best)
+	}
+}
+
+func TestPickNodeLoss(t *testing.T) {
+	gConfig = &Config{LatencyThreshold: 250, TestTimes: 5}
+	newNode := func(name string, latency int, loss float64) *ProxyNode {
+		return &ProxyNode{Name: name, Flow: 1, Latency: latency, Loss: loss, TestedAt: time.Now()}
+	}
+	nodes := []*ProxyNode{newNode("lossy", 80, 0.2), newNode("clean", 100, 0)}
+	if best, _ := pickNode(nodes, time.Now()); best == nil || best.Name != "lossy" {
+		t.Errorf("without loss settings pickNode() = %v, want lossy", best)
+	}
+
+	// 丢包 20% 加罚 100ms 后不如稍慢但不丢包的节点
+	gConfig.LossPenalty = 500
+	if best, _ := pickNode(nodes, time.Now()); best == nil || best.Name != "clean" {
+		t.Errorf("with loss_penalty_ms pickNode() = %v, want clean", best)
+	}
+
+	gConfig.LossPenalty = 0
+	gConfig.MaxLossRatio = 0.1
+	if best, _ := pickNode(nodes, time.Now()); best == nil || best.Name != "clean" {
+		t.Errorf("with max_loss_ratio pickNode() = %v, want clean", best)
+	}
+	if _, reason := nodeReason(nodes[0], nodes[1], 250); reason != "丢包率 20% 超过 max_loss_ratio" {
+		t.Errorf("nodeReason() = %q", reason)
+	}
+}
+
+func TestPickNodeFlowJumpRatio(t *testing.T) {
+	gConfig = &Config{LatencyThreshold: 300}
+	newNode := func(name string, flow float64, latency int) *ProxyNode {
+		return &ProxyNode{Name: name, Flow: flow, Latency: latency, TestedAt: time.Now()}
+	}
+	nodes := []*ProxyNode{newNode("cheap", 0.5, 240), newNode("normal", 1, 200), newNode("fast", 1.5, 60)}
+	if best, _ := pickNode(nodes, time.Now()); best == nil || best.Name != "cheap" {
+		t.Errorf("without flow_jump_ratio pickNode() = %v, want cheap", best)
+	}
+
+	// 240 >= 3 × 60, 改选 1.5x 的节点; 200 相对 240 不够快, 不改选
+	gConfig.FlowJumpRatio = 3
+	if best, _ := pickNode(nodes, time.Now()); best == nil || best.Name != "fast" {
+		t.Errorf("with flow_jump_ratio pickNode() = %v, want fast", best)
+	}
+	nodes[2].Latency = 100
+	if best, _ := pickNode(nodes, time.Now()); best == nil || best.Name != "cheap" {
+		t.Errorf("with a modest gap pickNode() = %v, want cheap", best)
+	}
+}
+
+func TestPickNodeSoftPenalty(t *testing.T) {
+	gConfig = &Config{LatencyThreshold: 200, SelectionMode: "soft_penalty", PenaltySlope: 1}
+	newNode := func(name string, flow float64, latency int) *ProxyNode {
+		return &ProxyNode{Name: name, Flow: flow, Latency: latency, TestedAt: time.Now()}
+	}
+
+	// 有阈值内的节点时, 流量系数低的分组仍然优先
+	nodes := []*ProxyNode{newNode("cheap slow", 0.5, 260), newNode("cheap", 0.5, 190), newNode("fast", 1, 50)}
+	if best, threshold := pickNode(nodes, time.Now()); best == nil || best.Name != "cheap" || threshold != 200 {
+		t.Errorf("pickNode() = %v, %d, want cheap, 200", best, threshold)
+	}
+
+	// 全部超过 2 倍阈值时 flow_groups 选不出节点, soft_penalty 仍然选出加罚后得分最低的节点:
+	// cheap: 500 + 300*1*0.5 = 650, fast: 450 + 250*1*2 = 950
+	nodes = []*ProxyNode{newNode("cheap", 0.5, 500), newNode("fast 2x", 2, 450)}
+	if best, _ := pickNode(nodes, time.Now()); best == nil || best.Name != "cheap" {
+		t.Errorf("pickNode() = %v, want cheap", best)
+	}
+	gConfig.PenaltySlope = 0.1 // 500 + 15 = 515, 450 + 50 = 500
+	if best, _ := pickNode(nodes, time.Now()); best == nil || best.Name != "fast 2x" {
+		t.Errorf("pickNode() with a small slope = %v, want fast 2x", best)
+	}
+	gConfig.SelectionMode = "flow_groups"
+	if best, _ := pickNode(nodes, time.Now()); best != nil {
+		t.Errorf("flow_groups pickNode() = %v, want nil", best)
+	}
+}
+
+func TestPickNodeTieBreak(t *testing.T) {
+	defer func() { gCurrent = nil }()
+	nodes := []*ProxyNode{
+		{Name: "HK 02", Flow: 1, Latency: 80, Jitter: 20},
+		{Name: "HK 03", Flow: 1, Latency: 80, Jitter: 5},
+		{Name: "HK 01", Flow: 1, Latency: 80, Jitter: 10},
+	}
+	gCurrent = nodes[0]
+	tests := []struct {
+		tieBreak string
+		mode     string
+		want     string
+	}{
+		{"name", "flow_groups", "HK 01"},
+		{"jitter", "flow_groups", "HK 03"},
+		{"current", "flow_groups", "HK 02"},
+		{"name", "soft_penalty", "HK 01"},
+		{"current", "soft_penalty", "HK 02"},
+	}
+	for _, tt := range tests {
+		gConfig = &Config{LatencyThreshold: 200, SelectionMode: tt.mode, PenaltySlope: 1, TieBreak: tt.tieBreak}
+		// 节点顺序不影响结果
+		for _, order := range [][]*ProxyNode{nodes, {nodes[2], nodes[1], nodes[0]}} {
+			if best, _ := pickNode(order, time.Now()); best == nil || best.Name != tt.want {
+				t.Errorf("%s/%s: pickNode() = %v, want %s", tt.mode, tt.tieBreak, best, tt.want)
+			}
+		}
+	}
+}
+
+func TestTestURLFor(t *testing.T) {
+	path := writeTestConfig(t, `select_node: "🎥 Netflix"
+test_urls:
+  "🎥 Netflix": https://www.netflix.com/title/80018499
+  "日本|JP": https://www.dmm.com
+`)
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gConfig = config
+	tests := map[string]string{
+		"JP 01": "https://www.dmm.com",
+		"香港 01": "https://www.netflix.com/title/80018499",
+	}
+	for name, want := range tests {
+		if got := testURLFor(&ProxyNode{Name: name}); got != want {
+			t.Errorf("testURLFor(%s) = %s, want %s", name, got, want)
+		}
+	}
+
+	gConfig.SwitchGroup = "Proxy"
+	if got := testURLFor(&ProxyNode{Name: "香港 01"}); got != gConfig.TestURL {
+		t.Errorf("testURLFor() = %s, want the default test_url", got)
+	}
+
+	if _, err := loadConfig(writeTestConfig(t, "test_urls:\n  \"(\": http://x\n")); err == nil {
+		t.Error("loadConfig() should reject an invalid test_urls key")
+	}
+}
+
+func TestStaggeredTicker(t *testing.T) {
+	interval := 40 * time.Millisecond
+	ticker := newStaggeredTicker(interval)
+	defer ticker.Stop()
+	start := time.Now()
+	ticker.wait()
+	first := time.Since(start)
+	if first < interval || first > interval*5/4+100*time.Millisecond {
+		t.Errorf("first tick after %v, want between %v and %v", first, interval, interval*5/4)
+	}
+	start = time.Now()
+	ticker.wait()
+	if second := time.Since(start); second > interval+100*time.Millisecond {
+		t.Errorf("second tick after %v, want about %v", second, interval)
+	}
+}
+
+func TestAlignedDelay(t *testing.T) {
+	base := time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		interval time.Duration
+		now      time.Time
+		want     time.Duration
+	}{
+		{time.Minute, base.Add(20 * time.Second), 40 * time.Second},
+		{time.Minute, base.Add(50 * time.Second), 70 * time.Second}, // 不足 1/4 个间隔时跳到下一个
+		{5 * time.Minute, base.Add(time.Minute), 4 * time.Minute},
+		{time.Minute, base, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := alignedDelay(tt.interval, tt.now); got != tt.want {
+			t.Errorf("alignedDelay(%v, %v) = %v, want %v", tt.interval, tt.now.Format(time.TimeOnly), got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigEnvOverrideGroups(t *testing.T) {
+	t.Setenv("AUTOCLASH_SELECTNODE", "🔰 节点选择")
+	config, err := loadConfig(writeTestConfig(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SwitchGroup != "🔰 节点选择" || config.CurrentGroup != "🔰 节点选择" {
+		t.Errorf("switch_group = %q, current_group = %q, want the overridden select_node", config.SwitchGroup, config.CurrentGroup)
+	}
+}
+
+func TestLoadConfigAPIKey(t *testing.T) {
+	keyFile := t.TempDir() + "/secret"
+	if err := os.WriteFile(keyFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_CLASH_SECRET", "from-env")
+	tests := []struct {
+		extra   string
+		want    string
+		wantErr bool
+	}{
+		{"api_key: plain\n", "plain", false},
+		{"api_key: \"${TEST_CLASH_SECRET}\"\n", "from-env", false},
+		{"api_key: \"${TEST_CLASH_MISSING}\"\n", "", true},
+		{"api_key_file: " + keyFile + "\n", "from-file", false},
+		{"api_key: plain\napi_key_file: " + keyFile + "\n", "", true},
+		{"api_key_file: " + keyFile + ".missing\n", "", true},
+	}
+	for _, tt := range tests {
+		config, err := loadConfig(writeTestConfig(t, tt.extra))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("loadConfig(%q) error = %v, wantErr %v", tt.extra, err, tt.wantErr)
+			continue
+		}
+		if err == nil && config.APIKey != tt.want {
+			t.Errorf("loadConfig(%q) api_key = %q, want %q", tt.extra, config.APIKey, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigEnvTypes(t *testing.T) {
+	t.Setenv("AUTOCLASH_LATENCYTHRESHOLD", "180")
+	t.Setenv("AUTOCLASH_ASSUMEALIVE", "false")
+	config, err := loadConfig(writeTestConfig(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.LatencyThreshold != 180 || config.AssumeAlive {
+		t.Errorf("latency_threshold = %d, assume_alive = %v", config.LatencyThreshold, config.AssumeAlive)
+	}
+
+	t.Setenv("AUTOCLASH_LATENCYTHRESHOLD", "fast")
+	if _, err := loadConfig(writeTestConfig(t, "")); err == nil {
+		t.Error("loadConfig() should reject a non-numeric AUTOCLASH_LATENCYTHRESHOLD")
+	}
+}
+
+func TestLoadConfigClampIntervals(t *testing.T) {
+	config, err := loadConfig(writeTestConfig(t, "current_interval: 0\nbest_interval: -5\n"))
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v, want intervals clamped", err)
+	}
+	if config.CurrentInterval != minInterval || config.BestInterval != minInterval || config.RetrieveInterval != 3600 {
+		t.Errorf("intervals = %d/%d/%d", config.RetrieveInterval, config.CurrentInterval, config.BestInterval)
+	}
+
+	// 直接构造的配置没有经过 loadConfig, 定时器本身也不能 panic
+	ticker := newStaggeredTicker(0)
+	ticker.Stop()
+}
+
+func TestMinStabilityCycles(t *testing.T) {
+	gConfig = &Config{LatencyThreshold: 200, BestInterval: 600, MinStabilityCycles: 2}
+	gMeasurements = make(map[string]measurement)
+	steady, flappy := &ProxyNode{Name: "steady", Flow: 1}, &ProxyNode{Name: "flappy", Flow: 1}
+	gNodes = []*ProxyNode{steady, flappy}
+	start := time.Now()
+	cycle := func(i int, steadyLatency, flappyLatency int) *ProxyNode {
+		now := start.Add(time.Duration(i) * time.Minute)
+		steady.Latency, flappy.Latency = steadyLatency, flappyLatency
+		recordMeasurements(gNodes, now)
+		applyMeasurements(gNodes, now)
+		best, _ := pickNode(gNodes, now)
+		return best
+	}
+
+	// 刚启动时没有稳定的节点, 不限制
+	if best := cycle(0, 150, 50); best != flappy {
+		t.Errorf("cycle 0 best = %v, want flappy", best)
+	}
+	if best := cycle(1, 150, -1); best != steady {
+		t.Errorf("cycle 1 best = %v, want steady", best)
+	}
+	// flappy 刚恢复一轮, steady 已连续合格 3 轮
+	if best := cycle(2, 150, 50); best != steady {
+		t.Errorf("cycle 2 best = %v, want steady", best)
+	}
+	if _, got := nodeReason(flappy, steady, 200); got != "连续合格 1 轮, 不足 2 轮" {
+		t.Errorf("nodeReason() = %s", got)
+	}
+	if best := cycle(3, 150, 50); best != flappy {
+		t.Errorf("cycle 3 best = %v, want flappy after 2 healthy cycles", best)
+	}
+}
+
+func TestLimitToBudget(t *testing.T) {
+	gConfig = &Config{LatencyThreshold: 200, TestTimes: 2, TestSizeEstimate: 10, TestBandwidthBudget: 60}
+	gMeasurements = map[string]measurement{
+		"good slow": {Latency: 150},
+		"good fast": {Latency: 50},
+		"bad":       {Latency: 500},
+	}
+	nodes := newTestNodes("new", "bad", "good slow", "current", "good fast")
+	gCurrent = nodes[3]
+	var got []string
+	for _, node := range limitToBudget(nodes) {
+		got = append(got, node.Name)
+	}
+	if want := []string{"current", "good fast", "good slow"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("limitToBudget() = %v, want %v", got, want)
+	}
+
+	gConfig.TestBandwidthBudget = 0
+	if got := limitToBudget(nodes); len(got) != len(nodes) {
+		t.Errorf("limitToBudget() without a budget = %d nodes, want all", len(got))
+	}
+}
+
+func TestSampleNodesFailureCooldown(t *testing.T) {
+	gConfig = &Config{FailureCooldown: 300}
+	now := time.Now()
+	gMeasurements = map[string]measurement{
+		"recent failure": {Latency: -1, TestedAt: now.Add(-time.Minute)},
+		"old failure":    {Latency: -1, TestedAt: now.Add(-time.Hour)},
+		"failed best":    {Latency: -1, TestedAt: now.Add(-time.Minute)},
+		"ok":             {Latency: 80, TestedAt: now.Add(-time.Minute)},
+	}
+	nodes := newTestNodes("recent failure", "old failure", "failed best", "ok")
+	gBest = nodes[2]
+	var got []string
+	for _, node := range sampleNodes(nodes) {
+		got = append(got, node.Name)
+	}
+	if want := "old failure,failed best,ok"; strings.Join(got, ",") != want {
+		t.Errorf("sampleNodes() = %v, want %s", got, want)
+	}
+}
+
+func TestFailoverPrefersSameRegion(t *testing.T) {
+	for _, prefer := range []bool{true, false} {
+		switched := newSwitchController(t, 100)
+		gConfig.PreferSameRegion = prefer
+		gConfig.LatencyThreshold = 250
+		gConfig.regionRe = regexp.MustCompile(defaultRegionRegex)
+		gNodes = []*ProxyNode{
+			{Name: "香港 01", Flow: 1, Latency: -1},
+			{Name: "日本 01", Flow: 1, Latency: 50},
+			{Name: "香港 02", Flow: 1, Latency: 120},
+		}
+		gCurrent, gBest = gNodes[0], gNodes[1]
+		failover("D")
+		want := "日本 01"
+		if prefer {
+			want = "香港 02"
+		}
+		if len(*switched) != 1 || (*switched)[0] != want {
+			t.Errorf("prefer=%v: switched %v, want %s", prefer, *switched, want)
+		}
+	}
+}
+
+func TestPreferRecovery(t *testing.T) {
+	cheapDelay := 0
+	var switched []string
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut:
+			var body struct{ Name string }
+			json.NewDecoder(r.Body).Decode(&body)
+			switched = append(switched, body.Name)
+			w.WriteHeader(http.StatusNoContent)
+		case strings.Contains(r.URL.Path, "cheap") && cheapDelay == 0:
+			w.WriteHeader(http.StatusRequestTimeout)
+		case strings.Contains(r.URL.Path, "cheap"):
+			fmt.Fprintf(w, `{"delay":%d}`, cheapDelay)
+		default:
+			fmt.Fprint(w, `{"delay":80}`)
+		}
+	})
+	gConfig.PreferRecovery = true
+	gConfig.LatencyThreshold = 200
+	defer func() { gRecoverTo = "" }()
+	gNodes = []*ProxyNode{
+		{Name: "cheap 0.5x", Flow: 0.5, Latency: -1},
+		{Name: "backup", Flow: 1, Latency: 80},
+	}
+	gCurrent, gBest = gNodes[0], gNodes[1]
+	failover("D")
+	if gCurrent.Name != "backup" || gRecoverTo != "cheap 0.5x" {
+		t.Fatalf("after failover current = %s, recover to = %q", gCurrent.Name, gRecoverTo)
+	}
+
+	// 仍不可用或超过阈值时留在备用节点
+	for _, delay := range []int{0, 300} {
+		cheapDelay = delay
+		checkRecovery()
+		if gCurrent.Name != "backup" || gRecoverTo != "cheap 0.5x" {
+			t.Errorf("delay %d: current = %s, recover to = %q", delay, gCurrent.Name, gRecoverTo)
+		}
+	}
+
+	cheapDelay = 120
+	checkRecovery()
+	if gCurrent.Name != "cheap 0.5x" || gRecoverTo != "" {
+		t.Errorf("after recovery current = %s, recover to = %q", gCurrent.Name, gRecoverTo)
+	}
+	if want := "backup,cheap 0.5x"; strings.Join(switched, ",") != want {
+		t.Errorf("switched %v, want %s", switched, want)
+	}
+
+	// 节点已不在列表中时不再等待
+	gRecoverTo = "removed"
+	checkRecovery()
+	if gRecoverTo != "" {
+		t.Errorf("recover to = %q, want empty", gRecoverTo)
+	}
+}
+
+func TestShutdownCancelsTests(t *testing.T) {
+	release := make(chan struct{})
+	var switched []string
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			switched = append(switched, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		fmt.Fprint(w, `{"delay":80}`)
+	})
+	t.Cleanup(func() { close(release) })
+	gConfig.TestTimes = 1
+	gConfig.DeadFailures = 1
+	gConfig.BreakerThreshold, gConfig.BreakerCooldown = 1, 60
+	gBreaker = &circuitBreaker{state: breakerClosed}
+
+	parent := gShutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	gShutdown = ctx
+	defer func() { gShutdown = parent }()
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	gCurrent, gBest = &ProxyNode{Name: "current"}, &ProxyNode{Name: "best"}
+	gCurrentFailures = 0
+	checkCurrentNode()
+	if gCurrentFailures != 0 || len(switched) != 0 {
+		t.Errorf("cancelled check: failures %d, switched %v, want none", gCurrentFailures, switched)
+	}
+
+	gNodes = []*ProxyNode{{Name: "HK 01", Flow: 1, Latency: 90}}
+	if _, err := selectFastestNode(); !errors.Is(err, errShutdown) {
+		t.Errorf("selectFastestNode() error = %v, want %v", err, errShutdown)
+	}
+	if gNodes[0].Latency != 90 {
+		t.Errorf("latency = %d, want the previous result kept", gNodes[0].Latency)
+	}
+	if gBreaker.state != breakerClosed {
+		t.Errorf("breaker state = %s, want cancelled requests not counted", gBreaker.state)
+	}
+}
+
+func TestCheckCurrentNodeSticky(t *testing.T) {
+	tests := []struct {
+		delay        int
+		wantSwitched int
+	}{
+		{250, 0}, // 超过 slow_threshold 但未超过 sticky_degrade_threshold
+		{350, 1},
+		{0, 1},
+	}
+	for _, tt := range tests {
+		switched := newSwitchController(t, tt.delay)
+		gConfig.SelectionMode = "sticky"
+		gConfig.SlowThreshold = 200
+		gConfig.SlowAction = "switch"
+		gConfig.StickyDegradeThreshold = 300
+		gConfig.DeadFailures = 1
+		gCurrent, gBest = &ProxyNode{Name: "current"}, &ProxyNode{Name: "best"}
+		gSlowPending, gCurrentFailures = false, 0
+		checkCurrentNode()
+		if len(*switched) != tt.wantSwitched || gSlowPending {
+			t.Errorf("delay %d: switched %v, pending %v, want %d switches", tt.delay, *switched, gSlowPending, tt.wantSwitched)
+		}
+	}
+
+	config, err := loadConfig(writeTestConfig(t, "selection_mode: sticky\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.StickyDegradeThreshold != config.LatencyThreshold {
+		t.Errorf("StickyDegradeThreshold = %d, want latency_threshold", config.StickyDegradeThreshold)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// 以 Prometheus 文本格式输出指标, 标签值用 %q 转义反斜杠、引号和换行
+func writeMetrics(w io.Writer, snapshot statusSnapshot) {
+	fmt.Fprintln(w, "# HELP autoclash_current_latency_ms 最近一次检查当前节点的延迟, -1 为测试失败或未测试")
+	fmt.Fprintln(w, "# TYPE autoclash_current_latency_ms gauge")
+	fmt.Fprintf(w, "autoclash_current_latency_ms{node=%q} %d\n", snapshot.Current, snapshot.CurrentLatency)
+	if !snapshot.CurrentCheckedAt.IsZero() {
+		fmt.Fprintln(w, "# HELP autoclash_current_checked_timestamp_seconds 最近一次检查当前节点的时间")
+		fmt.Fprintln(w, "# TYPE autoclash_current_checked_timestamp_seconds gauge")
+		fmt.Fprintf(w, "autoclash_current_checked_timestamp_seconds %d\n", snapshot.CurrentCheckedAt.Unix())
+	}
+
+	fmt.Fprintln(w, "# HELP autoclash_controller_latency_ms 最近一轮选择时访问控制器本身的耗时, 作为节点延迟的基准, -1 为失败或未测试")
+	fmt.Fprintln(w, "# TYPE autoclash_controller_latency_ms gauge")
+	fmt.Fprintf(w, "autoclash_controller_latency_ms %d\n", snapshot.ControllerLatency)
+
+	fmt.Fprintln(w, "# HELP autoclash_node_latency_ms 最近一轮测试的节点平均延迟, -1 为测试失败")
+	fmt.Fprintln(w, "# TYPE autoclash_node_latency_ms gauge")
+	for _, node := range snapshot.Nodes {
+		if node.TestedAt.IsZero() {
+			continue
+		}
+		fmt.Fprintf(w, "autoclash_node_latency_ms{node=%q} %d\n", node.Name, node.Latency)
+	}
+
+	fmt.Fprintln(w, "# HELP autoclash_node_flow 节点的流量系数")
+	fmt.Fprintln(w, "# TYPE autoclash_node_flow gauge")
+	for _, node := range snapshot.Nodes {
+		fmt.Fprintf(w, "autoclash_node_flow{node=%q} %g\n", node.Name, node.Flow)
+	}
+}
+
+// 将指标以 OpenMetrics 格式写入 metrics_file, 先写临时文件再重命名, 避免 textfile collector 读到写了一半的文件
+func writeMetricsFile(snapshot statusSnapshot) error {
+	var buf bytes.Buffer
+	writeMetrics(&buf, snapshot)
+	buf.WriteString("# EOF\n")
+	if err := writeFileAtomic(gConfig.MetricsFile, buf.Bytes()); err != nil {
+		return err
+	}
+	// node_exporter 通常以其他用户运行, 需要能读取该文件
+	return os.Chmod(gConfig.MetricsFile, 0644)
+}
+
+// 定时写入指标文件
+func startMetricsFileWriter() {
+	ticker := newStaggeredTicker(time.Duration(gConfig.MetricsFileInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		mu.Lock()
+		snapshot := takeSnapshot()
+		mu.Unlock()
+		if err := writeMetricsFile(snapshot); err != nil {
+			log.Printf("M 写入指标文件失败: %v", err)
+		}
+		ticker.wait()
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	snapshot := takeSnapshot()
+	mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, snapshot)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetricsFile(t *testing.T) {
+	path := t.TempDir() + "/autoclash.prom"
+	gConfig = &Config{MetricsFile: path}
+	snapshot := statusSnapshot{
+		Current:           "HK 01",
+		CurrentLatency:    90,
+		ControllerLatency: 12,
+		Nodes: []nodeStatus{
+			{Name: "HK 01", Flow: 1, Latency: 100, TestedAt: time.Now()},
+			{Name: `JP "02" 0.5x`, Flow: 0.5},
+		},
+	}
+	if err := writeMetricsFile(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(data)
+	for _, want := range []string{
+		`autoclash_current_latency_ms{node="HK 01"} 90`,
+		`autoclash_controller_latency_ms 12`,
+		`autoclash_node_latency_ms{node="HK 01"} 100`,
+		`autoclash_node_flow{node="JP \"02\" 0.5x"} 0.5`,
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("metrics file missing %q:\n%s", want, content)
+		}
+	}
+	if !strings.HasSuffix(content, "# EOF\n") {
+		t.Errorf("metrics file should end with # EOF:\n%s", content)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("metrics file mode = %v, %v, want 0644", info.Mode().Perm(), err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// node_scores_file 中的一项: 名称匹配 re 的节点得分加上 bias
+type nodeBias struct {
+	re   *regexp.Regexp
+	bias float64
+}
+
+var gNodeBiases []nodeBias       // 当前生效的节点偏置, 由 mu 保护
+var gNodeScoresModTime time.Time // 上次读取的 node_scores_file 的修改时间
+
+// node_scores_file 修改后重新读取, 读取或解析失败时保留之前的偏置
+func reloadNodeScores() {
+	if gConfig.NodeScoresFile == "" {
+		return
+	}
+	info, err := os.Stat(gConfig.NodeScoresFile)
+	if err != nil {
+		log.Printf("警告: 读取 node_scores_file 失败, 继续使用之前的偏置: %v", err)
+		return
+	}
+	if info.ModTime().Equal(gNodeScoresModTime) {
+		return
+	}
+	biases, err := loadNodeScores(gConfig.NodeScoresFile)
+	if err != nil {
+		log.Printf("警告: %v, 继续使用之前的偏置", err)
+		return
+	}
+	gNodeBiases, gNodeScoresModTime = biases, info.ModTime()
+	log.Printf("读取 node_scores_file: %d 项", len(biases))
+}
+
+// 读取节点偏置文件, 内容为正则到偏置(ms)的 YAML 映射
+func loadNodeScores(path string) ([]nodeBias, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取 node_scores_file 失败: %v", err)
+	}
+	var raw map[string]float64
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("解析 node_scores_file 失败: %v", err)
+	}
+	var biases []nodeBias
+	for expr, bias := range raw {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("node_scores_file 中的正则无效: %v", err)
+		}
+		biases = append(biases, nodeBias{re: re, bias: bias})
+	}
+	return biases, nil
+}
+
+// 节点的偏置, 匹配多个正则时相加
+func nodeBiasFor(name string) float64 {
+	total := 0.0
+	for _, b := range gNodeBiases {
+		if b.re.MatchString(name) {
+			total += b.bias
+		}
+	}
+	return total
+}
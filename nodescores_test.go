@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReloadNodeScores(t *testing.T) {
+	path := t.TempDir() + "/scores.yml"
+	gConfig = &Config{LatencyThreshold: 200, NodeScoresFile: path}
+	gNodeBiases, gNodeScoresModTime = nil, time.Time{}
+	defer func() { gNodeBiases, gNodeScoresModTime = nil, time.Time{} }()
+	write := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+
+	write("\"^HK\": 50\nIEPL: -20\n", time.Now().Add(-time.Hour))
+	reloadNodeScores()
+	if got := nodeBiasFor("HK IEPL 01"); got != 30 {
+		t.Errorf("nodeBiasFor(HK IEPL 01) = %v, want 30", got)
+	}
+	nodes := []*ProxyNode{
+		{Name: "HK 01", Flow: 1, Latency: 80},
+		{Name: "JP 01", Flow: 1, Latency: 100},
+	}
+	if best, _ := pickNode(nodes, time.Now()); best == nil || best.Name != "JP 01" {
+		t.Errorf("pickNode() = %v, want JP 01 after the HK bias", best)
+	}
+
+	// 文件修改后重新读取, 内容无效时保留之前的偏置
+	write("\"(\": 10\n", time.Now())
+	reloadNodeScores()
+	if got := nodeBiasFor("HK 01"); got != 50 {
+		t.Errorf("nodeBiasFor(HK 01) after an invalid file = %v, want 50", got)
+	}
+	write("\"^HK\": -10\n", time.Now().Add(time.Minute))
+	reloadNodeScores()
+	if got := nodeBiasFor("HK 01"); got != -10 {
+		t.Errorf("nodeBiasFor(HK 01) after reload = %v, want -10", got)
+	}
+}
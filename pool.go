@@ -0,0 +1,38 @@
+package main
+
+import "context"
+
+// 限制同时运行的测试协程数的协程池, 所有测试共用, 见 max_goroutines
+type workerPool struct {
+	slots chan struct{} // 为 nil 时不限制
+}
+
+// 所有测试共用的协程池, 启动时按 max_goroutines 创建
+var gWorkers = newWorkerPool(0)
+
+// 创建最多同时运行 n 个协程的协程池, n 小于等于 0 时不限制
+func newWorkerPool(n int) *workerPool {
+	if n <= 0 {
+		return &workerPool{}
+	}
+	return &workerPool{slots: make(chan struct{}, n)}
+}
+
+// 在新协程中运行 fn, 没有空闲名额时等待其他协程结束。
+// ctx 在等待期间结束时不运行 fn, 返回 false
+func (p *workerPool) Go(ctx context.Context, fn func()) bool {
+	if p.slots == nil {
+		go fn()
+		return true
+	}
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	go func() {
+		defer func() { <-p.slots }()
+		fn()
+	}()
+	return true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolLimit(t *testing.T) {
+	pool := newWorkerPool(2)
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	for range 6 {
+		wg.Add(1)
+		pool.Go(t.Context(), func() {
+			defer wg.Done()
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			running.Add(-1)
+		})
+	}
+	wg.Wait()
+	if peak.Load() != 2 {
+		t.Errorf("peak = %d, want 2", peak.Load())
+	}
+
+	// 没有空闲名额时 ctx 结束则不运行
+	block := make(chan struct{})
+	defer close(block)
+	pool.Go(t.Context(), func() { <-block })
+	pool.Go(t.Context(), func() { <-block })
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	if pool.Go(ctx, func() { t.Error("ran after ctx was done") }) {
+		t.Error("Go() = true with a full pool and a done ctx")
+	}
+}
+
+func TestMeasureNodesMaxGoroutines(t *testing.T) {
+	var running, peak atomic.Int32
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(`{"delay":100}`))
+	})
+	gConfig.TestTimes = 1
+	gWorkers = newWorkerPool(2)
+	defer func() { gWorkers = newWorkerPool(0) }()
+
+	targets := []*ProxyNode{{Name: "A"}, {Name: "B"}, {Name: "C"}, {Name: "D"}, {Name: "E"}}
+	results, _ := measureNodes(t.Context(), targets)
+	for i, samples := range results {
+		if len(samples) != 1 {
+			t.Errorf("%s samples = %v", targets[i].Name, samples)
+		}
+	}
+	if peak.Load() > 2 {
+		t.Errorf("peak concurrent tests = %d, want at most 2", peak.Load())
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "time"
+
+// 时段表现的指数加权平均系数, 越大越偏向最近的测试结果
+const profileAlpha = 0.3
+
+// 节点在每个小时的历史延迟 (EWMA), 0 表示该时段尚无数据。仅保存在内存中, 重启后清空
+var gProfiles = make(map[string]*[24]float64)
+
+// 用本轮测试结果更新节点当前时段的历史延迟
+func updateProfiles(nodes []*ProxyNode, now time.Time) {
+	hour := now.Hour()
+	for _, node := range nodes {
+		if node.Latency <= 0 {
+			continue
+		}
+		profile, ok := gProfiles[node.Name]
+		if !ok {
+			profile = new([24]float64)
+			gProfiles[node.Name] = profile
+		}
+		if profile[hour] == 0 {
+			profile[hour] = float64(node.Latency)
+		} else {
+			profile[hour] = profileAlpha*float64(node.Latency) + (1-profileAlpha)*profile[hour]
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// rank 命令中一个节点累计的测试结果
+type rankStats struct {
+	samples  []int // 所有成功测试的延迟
+	attempts int   // 测试次数, 包括失败
+}
+
+func (s *rankStats) add(samples []int, attempts int) {
+	s.samples = append(s.samples, samples...)
+	s.attempts += attempts
+}
+
+// 排名中的一行, 节点或订阅
+type rankRow struct {
+	Name    string
+	Nodes   int // 订阅中参与测试的节点数, 节点为 0
+	Median  int // 延迟中位数, 没有成功的测试时为 -1
+	Jitter  int
+	Loss    float64
+	Samples int
+}
+
+func newRankRow(name string, s *rankStats) rankRow {
+	row := rankRow{Name: name, Median: -1, Samples: s.attempts}
+	if s.attempts > 0 {
+		row.Loss = float64(s.attempts-len(s.samples)) / float64(s.attempts)
+	}
+	if len(s.samples) > 0 {
+		sorted := append([]int(nil), s.samples...)
+		sort.Ints(sorted)
+		row.Median = sorted[len(sorted)/2]
+		if len(sorted)%2 == 0 {
+			row.Median = (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+		}
+		_, row.Jitter = summarizeSamples(s.samples)
+	}
+	return row
+}
+
+// 按延迟中位数排序, 没有成功测试的排在最后, 中位数相同时丢包率低的在前
+func sortRankRows(rows []rankRow) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if (a.Median > 0) != (b.Median > 0) {
+			return a.Median > 0
+		}
+		if a.Median != b.Median {
+			return a.Median < b.Median
+		}
+		if a.Loss != b.Loss {
+			return a.Loss < b.Loss
+		}
+		return a.Name < b.Name
+	})
+}
+
+// 计算节点排名, 以及按订阅汇总的排名。providerOf 为节点所属的订阅, 不属于任何订阅的节点不参与汇总
+func computeRanking(stats map[string]*rankStats, providerOf map[string]string) ([]rankRow, []rankRow) {
+	var nodes []rankRow
+	providers := make(map[string]*rankStats)
+	counts := make(map[string]int)
+	for name, s := range stats {
+		nodes = append(nodes, newRankRow(name, s))
+		if provider, ok := providerOf[name]; ok {
+			if providers[provider] == nil {
+				providers[provider] = &rankStats{}
+			}
+			providers[provider].add(s.samples, s.attempts)
+			counts[provider]++
+		}
+	}
+	var rows []rankRow
+	for name, s := range providers {
+		row := newRankRow(name, s)
+		row.Nodes = counts[name]
+		rows = append(rows, row)
+	}
+	sortRankRows(nodes)
+	sortRankRows(rows)
+	return nodes, rows
+}
+
+func printRanking(w io.Writer, nodes, providers []rankRow) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if len(providers) > 0 {
+		fmt.Fprintln(tw, "#\t订阅\t节点数\t延迟中位数\t抖动(ms)\t丢包率\t测试次数")
+		for i, row := range providers {
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%d\t%.0f%%\t%d\n", i+1, row.Name, row.Nodes, formatLatency(row.Median), row.Jitter, row.Loss*100, row.Samples)
+		}
+		fmt.Fprintln(tw)
+	}
+	fmt.Fprintln(tw, "#\t节点\t延迟中位数\t抖动(ms)\t丢包率\t测试次数")
+	for i, row := range nodes {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%.0f%%\t%d\n", i+1, row.Name, formatLatency(row.Median), row.Jitter, row.Loss*100, row.Samples)
+	}
+	tw.Flush()
+}
+
+// 从控制器的 /providers/proxies 获取每个节点所属的订阅, 跳过配置文件中直接定义的节点
+func fetchProviders() (map[string]string, error) {
+	req, err := http.NewRequest("GET", gConfig.APIEndpoint+"/providers/proxies", nil)
+	if err != nil {
+		return nil, fmt.Errorf("创建请求失败: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+gConfig.APIKey)
+	resp, err := doRequest(&http.Client{}, req)
+	if err != nil {
+		return nil, fmt.Errorf("获取订阅失败: %w: %w", ErrUnreachable, err)
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, nil); err != nil {
+		return nil, fmt.Errorf("获取订阅失败: %w", err)
+	}
+	var result struct {
+		Providers map[string]struct {
+			VehicleType string `json:"vehicleType"`
+			Proxies     []struct {
+				Name string `json:"name"`
+			} `json:"proxies"`
+		} `json:"providers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("解析订阅失败: %v", err)
+	}
+	providerOf := make(map[string]string)
+	for name, provider := range result.Providers {
+		if provider.VehicleType == "Compatible" {
+			continue
+		}
+		for _, proxy := range provider.Proxies {
+			providerOf[proxy.Name] = name
+		}
+	}
+	return providerOf, nil
+}
+
+// 在 duration 内每隔 interval 测试一轮所有节点, 不切换节点。ctx 结束时提前停止, 返回已有的结果。
+// 返回前所有测试协程都已退出
+func runRank(ctx context.Context, duration, interval time.Duration) (map[string]*rankStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	stats := make(map[string]*rankStats)
+	for sweep := 1; ; sweep++ {
+		nodes, _, err := getNodes()
+		if err != nil {
+			return stats, err
+		}
+		log.Printf("第 %d 轮测试, %d 个节点", sweep, len(nodes))
+		results, attempts := measureNodes(ctx, nodes)
+		if ctx.Err() != nil {
+			// 被中断的一轮结果不完整, 不计入
+			return stats, nil
+		}
+		for i, node := range nodes {
+			if stats[node.Name] == nil {
+				stats[node.Name] = &rankStats{}
+			}
+			stats[node.Name].add(results[i], attempts[i])
+		}
+		select {
+		case <-ctx.Done():
+			return stats, nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func newRankCmd(configPath *string) *cobra.Command {
+	var duration, interval time.Duration
+	cmd := &cobra.Command{
+		Use:   "rank",
+		Short: "在一段时间内定期测试所有节点, 结束后按延迟中位数、丢包率和抖动输出节点和订阅的排名, 不切换节点",
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := loadConfig(*configPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "加载配置失败: %v\n", err)
+				os.Exit(1)
+			}
+			gConfig = config
+			gWorkers = newWorkerPool(config.MaxGoroutines)
+			if gConfig.SwitchGroup == "" || gConfig.CurrentGroup == "" {
+				proxiesResp, err := fetchProxies()
+				if err == nil {
+					err = applySelectGroup(gConfig, proxiesResp)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "自动选择节点组失败: %v\n", err)
+					os.Exit(1)
+				}
+			}
+			providerOf, err := fetchProviders()
+			if err != nil {
+				log.Printf("获取订阅失败, 只输出节点排名: %v", err)
+			}
+
+			// Ctrl+C 时停止测试并输出已有的结果
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			stats, err := runRank(ctx, duration, interval)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "测试节点失败: %v\n", err)
+			}
+			if len(stats) == 0 {
+				os.Exit(1)
+			}
+			nodes, providers := computeRanking(stats, providerOf)
+			printRanking(os.Stdout, nodes, providers)
+		},
+	}
+	cmd.Flags().DurationVar(&duration, "duration", time.Hour, "测试的总时长")
+	cmd.Flags().DurationVar(&interval, "interval", 5*time.Minute, "两轮测试之间的间隔")
+	return cmd
+}
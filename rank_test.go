@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestComputeRanking(t *testing.T) {
+	stats := map[string]*rankStats{
+		"HK 01": {samples: []int{100, 80, 120}, attempts: 3},
+		"HK 02": {samples: []int{60, 400}, attempts: 4},
+		"JP 01": {samples: []int{90, 90, 90}, attempts: 3},
+		"US 01": {attempts: 3},
+	}
+	providerOf := map[string]string{"HK 01": "sub-a", "HK 02": "sub-a", "JP 01": "sub-b"}
+	nodes, providers := computeRanking(stats, providerOf)
+
+	var names []string
+	for _, row := range nodes {
+		names = append(names, row.Name)
+	}
+	if got := strings.Join(names, ","); got != "JP 01,HK 01,HK 02,US 01" {
+		t.Errorf("node ranking = %s", got)
+	}
+	if nodes[2].Median != 230 || nodes[2].Loss != 0.5 {
+		t.Errorf("HK 02 = %+v, want median 230 and loss 0.5", nodes[2])
+	}
+	if nodes[3].Median != -1 || nodes[3].Loss != 1 {
+		t.Errorf("US 01 = %+v, want no median and full loss", nodes[3])
+	}
+	if len(providers) != 2 || providers[0].Name != "sub-b" || providers[1].Nodes != 2 || providers[1].Median != 100 {
+		t.Errorf("providers = %+v", providers)
+	}
+
+	var out strings.Builder
+	printRanking(&out, nodes, providers)
+	for _, want := range []string{"订阅", "sub-a", "JP 01", "90ms", "失败", "100%"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRunRank(t *testing.T) {
+	var switched atomic.Bool
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut:
+			switched.Store(true)
+		case strings.HasSuffix(r.URL.Path, "/delay"):
+			w.Write([]byte(`{"delay":70}`))
+		case r.URL.Path == "/providers/proxies":
+			w.Write([]byte(`{"providers":{
+				"default":{"vehicleType":"Compatible","proxies":[{"name":"DIRECT"}]},
+				"sub":{"vehicleType":"HTTP","proxies":[{"name":"HK 01"}]}
+			}}`))
+		default:
+			w.Write([]byte(`{"proxies":{
+				"Proxy":{"name":"Proxy","type":"Selector","now":"HK 01"},
+				"HK 01":{"name":"HK 01","type":"Trojan","alive":true}
+			}}`))
+		}
+	})
+	gConfig.TestTimes = 1
+	gConfig.TestTimeoutMS = 1000
+
+	providerOf, err := fetchProviders()
+	if err != nil || len(providerOf) != 1 || providerOf["HK 01"] != "sub" {
+		t.Errorf("fetchProviders() = %v, %v", providerOf, err)
+	}
+	// 结束时正在测试的协程在 runRank 返回前退出, 不会影响之后修改 gConfig 的测试
+	stats, err := runRank(context.Background(), 1500*time.Millisecond, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := stats["HK 01"]; s == nil || s.attempts == 0 || len(s.samples) != s.attempts || s.samples[0] != 70 {
+		t.Errorf("stats = %+v", s)
+	}
+	if switched.Load() {
+		t.Error("rank switched the node")
+	}
+}
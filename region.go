@@ -0,0 +1,20 @@
+package main
+
+// 默认的区域正则: 节点名中第一段中文或英文字母, 如 "🇭🇰 香港 01" 为 "香港", "HK-02 2x" 为 "HK"
+const defaultRegionRegex = `\p{Han}+|[A-Za-z]+`
+
+// 从节点名中提取区域, 提取不到时为空
+func regionOf(name string) string {
+	re := gConfig.regionRe
+	if re == nil {
+		return ""
+	}
+	match := re.FindStringSubmatch(name)
+	switch {
+	case match == nil:
+		return ""
+	case len(match) > 1:
+		return match[1]
+	}
+	return match[0]
+}
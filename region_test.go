@@ -0,0 +1,26 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRegionOf(t *testing.T) {
+	gConfig = &Config{regionRe: regexp.MustCompile(defaultRegionRegex)}
+	tests := map[string]string{
+		"🇭🇰 香港 01 |IEPL|": "香港",
+		"HK-02 2x":        "HK",
+		"日本东京 03":         "日本东京",
+		"01":              "",
+	}
+	for name, want := range tests {
+		if got := regionOf(name); got != want {
+			t.Errorf("regionOf(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	gConfig.regionRe = regexp.MustCompile(`^\S+ (\S+)`)
+	if got := regionOf("🇺🇸 US-LA 01"); got != "US-LA" {
+		t.Errorf("regionOf() with a capture group = %q, want US-LA", got)
+	}
+}
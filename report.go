@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// 报告中的时间格式
+const reportTimeLayout = "2006-01-02 15:04:05"
+
+// 报告中的一行节点信息
+type reportNode struct {
+	Name    string
+	Latency string
+	Jitter  int
+	Success int
+	Flow    float64
+	Tested  string
+}
+
+// 报告的内容, 与 /status 使用相同的数据
+type reportData struct {
+	Generated  string
+	Current    string
+	Best       string
+	Decision   string
+	Controller string
+	Nodes      []reportNode
+	Switches   []switchRecord
+}
+
+func newReportData(snapshot statusSnapshot, now time.Time) reportData {
+	data := reportData{
+		Generated:  now.Format(reportTimeLayout),
+		Current:    orNone(snapshot.Current),
+		Best:       orNone(snapshot.Best),
+		Decision:   "无",
+		Controller: formatLatency(snapshot.ControllerLatency),
+	}
+	if snapshot.Current != "" && snapshot.CurrentLatency > 0 {
+		data.Current += fmt.Sprintf(" (%dms)", snapshot.CurrentLatency)
+	}
+	if snapshot.Decision != nil {
+		data.Decision = snapshot.Decision.String()
+	}
+
+	// 测试成功的节点按延迟升序在前, 失败和未测试的在后
+	nodes := slices.Clone(snapshot.Nodes)
+	slices.SortStableFunc(nodes, func(a, b nodeStatus) int {
+		switch {
+		case a.Latency > 0 && b.Latency > 0:
+			return a.Latency - b.Latency
+		case a.Latency > 0:
+			return -1
+		case b.Latency > 0:
+			return 1
+		}
+		return 0
+	})
+	for _, node := range nodes {
+		row := reportNode{Name: node.Name, Latency: "未测试", Jitter: node.Jitter, Success: node.Success, Flow: node.Flow, Tested: "-"}
+		if !node.TestedAt.IsZero() {
+			row.Latency = formatLatency(node.Latency)
+			row.Tested = node.TestedAt.Format(reportTimeLayout)
+		}
+		data.Nodes = append(data.Nodes, row)
+	}
+	// 最近的切换在前
+	for i := len(snapshot.Switches) - 1; i >= 0; i-- {
+		data.Switches = append(data.Switches, snapshot.Switches[i])
+	}
+	return data
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "无"
+	}
+	return s
+}
+
+// 延迟的显示, 小于等于 0 为失败
+func formatLatency(latency int) string {
+	if latency <= 0 {
+		return "失败"
+	}
+	return fmt.Sprintf("%dms", latency)
+}
+
+// 转义 Markdown 表格单元格中的竖线和换行
+var markdownCell = strings.NewReplacer("|", `\|`, "\n", " ")
+
+func writeMarkdownReport(w io.Writer, data reportData) {
+	fmt.Fprintf(w, "# autoclash 状态报告\n\n")
+	fmt.Fprintf(w, "生成时间: %s\n\n", data.Generated)
+	fmt.Fprintf(w, "- 当前节点: %s\n", markdownCell.Replace(data.Current))
+	fmt.Fprintf(w, "- 最优节点: %s\n", markdownCell.Replace(data.Best))
+	fmt.Fprintf(w, "- 选择依据: %s\n", markdownCell.Replace(data.Decision))
+	fmt.Fprintf(w, "- 控制器延迟: %s\n\n", data.Controller)
+
+	fmt.Fprintf(w, "## 节点\n\n")
+	fmt.Fprintf(w, "| 节点 | 延迟 | 抖动(ms) | 成功次数 | 流量系数 | 测试时间 |\n")
+	fmt.Fprintf(w, "| --- | --- | --- | --- | --- | --- |\n")
+	for _, node := range data.Nodes {
+		fmt.Fprintf(w, "| %s | %s | %d | %d | %.1fx | %s |\n", markdownCell.Replace(node.Name), node.Latency, node.Jitter, node.Success, node.Flow, node.Tested)
+	}
+
+	fmt.Fprintf(w, "\n## 最近切换\n\n")
+	if len(data.Switches) == 0 {
+		fmt.Fprintf(w, "无\n")
+		return
+	}
+	fmt.Fprintf(w, "| 时间 | 从 | 到 | 原因 |\n")
+	fmt.Fprintf(w, "| --- | --- | --- | --- |\n")
+	for _, record := range data.Switches {
+		fmt.Fprintf(w, "| %s | %s | %s | %s |\n", record.Time.Format(reportTimeLayout), markdownCell.Replace(orNone(record.From)), markdownCell.Replace(record.To), orNone(record.Reason))
+	}
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"orNone": orNone,
+	"format": func(t time.Time) string { return t.Format(reportTimeLayout) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>autoclash 状态报告</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; }
+</style>
+</head>
+<body>
+<h1>autoclash 状态报告</h1>
+<p>生成时间: {{.Generated}}</p>
+<ul>
+<li>当前节点: {{.Current}}</li>
+<li>最优节点: {{.Best}}</li>
+<li>选择依据: {{.Decision}}</li>
+<li>控制器延迟: {{.Controller}}</li>
+</ul>
+<h2>节点</h2>
+<table>
+<tr><th>节点</th><th>延迟</th><th>抖动(ms)</th><th>成功次数</th><th>流量系数</th><th>测试时间</th></tr>
+{{- range .Nodes}}
+<tr><td>{{.Name}}</td><td>{{.Latency}}</td><td>{{.Jitter}}</td><td>{{.Success}}</td><td>{{printf "%.1f" .Flow}}x</td><td>{{.Tested}}</td></tr>
+{{- end}}
+</table>
+<h2>最近切换</h2>
+{{- if .Switches}}
+<table>
+<tr><th>时间</th><th>从</th><th>到</th><th>原因</th></tr>
+{{- range .Switches}}
+<tr><td>{{format .Time}}</td><td>{{orNone .From}}</td><td>{{.To}}</td><td>{{orNone .Reason}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p>无</p>
+{{- end}}
+</body>
+</html>
+`))
+
+// 报告是否使用 HTML 格式
+func htmlReport(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".html" || ext == ".htm"
+}
+
+// 将报告写入 report_file, 先写临时文件再重命名
+func writeReportFile(snapshot statusSnapshot, now time.Time) error {
+	var buf bytes.Buffer
+	data := newReportData(snapshot, now)
+	if htmlReport(gConfig.ReportFile) {
+		if err := htmlReportTemplate.Execute(&buf, data); err != nil {
+			return err
+		}
+	} else {
+		writeMarkdownReport(&buf, data)
+	}
+	return writeFileAtomic(gConfig.ReportFile, buf.Bytes())
+}
+
+// 定时写入报告文件
+func startReportWriter() {
+	ticker := newStaggeredTicker(time.Duration(gConfig.ReportInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		mu.Lock()
+		snapshot := takeSnapshot()
+		mu.Unlock()
+		if err := writeReportFile(snapshot, time.Now()); err != nil {
+			log.Printf("M 写入报告文件失败: %v", err)
+		}
+		ticker.wait()
+	}
+}
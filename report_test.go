@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testReportSnapshot() statusSnapshot {
+	now := time.Now()
+	return statusSnapshot{
+		Current:           "HK 01",
+		CurrentLatency:    90,
+		Best:              "JP|02",
+		ControllerLatency: 3,
+		Nodes: []nodeStatus{
+			{Name: "HK 01", Flow: 1, Latency: 100, Success: 3, TestedAt: now},
+			{Name: "<b>US</b>", Flow: 2, Latency: -1, TestedAt: now},
+			{Name: "JP|02", Flow: 0.5, Latency: 60, Success: 3, TestedAt: now},
+			{Name: "SG 01", Flow: 1},
+		},
+		Switches: []switchRecord{
+			{Time: now.Add(-time.Hour), To: "JP|02"},
+			{Time: now, From: "JP|02", To: "HK 01"},
+		},
+	}
+}
+
+func TestWriteReportFileMarkdown(t *testing.T) {
+	gConfig = &Config{ReportFile: t.TempDir() + "/report.md"}
+	if err := writeReportFile(testReportSnapshot(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(gConfig.ReportFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(data)
+	for _, want := range []string{
+		"- 当前节点: HK 01 (90ms)",
+		"- 控制器延迟: 3ms",
+		`| JP\|02 | 60ms | 0 | 3 | 0.5x |`,
+		"| SG 01 | 未测试 |",
+		`| JP\|02 | HK 01 |`,
+		`| 无 | JP\|02 |`,
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("report missing %q:\n%s", want, content)
+		}
+	}
+	// 节点按延迟排序, 最近的切换在前
+	if strings.Index(content, `| JP\|02 | 60ms`) > strings.Index(content, "| HK 01 | 100ms") {
+		t.Errorf("nodes should be sorted by latency:\n%s", content)
+	}
+	if strings.Index(content, `| JP\|02 | HK 01 |`) > strings.Index(content, `| 无 | JP\|02 |`) {
+		t.Errorf("recent switches should come first:\n%s", content)
+	}
+}
+
+func TestWriteReportFileHTML(t *testing.T) {
+	gConfig = &Config{ReportFile: t.TempDir() + "/report.html"}
+	if err := writeReportFile(testReportSnapshot(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(gConfig.ReportFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(data)
+	if !strings.Contains(content, "<td>&lt;b&gt;US&lt;/b&gt;</td><td>失败</td>") {
+		t.Errorf("report should escape node names:\n%s", content)
+	}
+	if !strings.Contains(content, "<td>JP|02</td><td>HK 01</td>") {
+		t.Errorf("report missing switch history:\n%s", content)
+	}
+}
+
+func TestRecordSwitchHistory(t *testing.T) {
+	gConfig = &Config{HistorySize: 10}
+	gSwitchHistory = nil
+	defer func() { gSwitchHistory = nil }()
+	now := time.Now()
+	for i := range 15 {
+		recordSwitchHistory(switchRecord{Time: now, To: string(rune('a' + i))})
+	}
+	if len(gSwitchHistory) != 10 || gSwitchHistory[0].To != "f" {
+		t.Errorf("history = %d records starting at %v, want 10 starting at f", len(gSwitchHistory), gSwitchHistory[0].To)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/expr-lang/expr"
+)
+
+// 自定义得分表达式中可用的变量
+type scoreEnv struct {
+	Latency float64 `expr:"latency"` // 平均延迟(ms)
+	Jitter  float64 `expr:"jitter"`  // 延迟标准差(ms)
+	Flow    float64 `expr:"flow"`    // 流量系数
+	Success float64 `expr:"success"` // 测试成功率(0~1)
+	Loss    float64 `expr:"loss"`    // 丢包率(0~1)
+}
+
+// 编译配置中的得分表达式, 结果保存在 config.scoreProgram 中
+func compileScoreExpr(config *Config) error {
+	config.scoreProgram = nil
+	switch config.ScoreOrder {
+	case "", "lowest", "highest":
+	default:
+		return fmt.Errorf("score_order 只能为 lowest 或 highest: %s", config.ScoreOrder)
+	}
+	if config.ScoreExpr == "" {
+		return nil
+	}
+	program, err := expr.Compile(config.ScoreExpr, expr.Env(scoreEnv{}), expr.AsFloat64())
+	if err != nil {
+		return fmt.Errorf("score_expr 无效: %v", err)
+	}
+	config.scoreProgram = program
+	return nil
+}
+
+// 计算节点用于排序的得分, 越小越好。
+// 配置了得分表达式时使用表达式的结果, 否则为平均延迟, 启用时段加权时混合 now 所在时段的历史延迟,
+// 启用使用时长加罚时再加上最近使用时长的惩罚, 使表现相近的节点轮流使用, 再加上丢包率的惩罚, 最后加上 node_scores_file 中的偏置
+func nodeScore(node *ProxyNode, now time.Time) float64 {
+	if gConfig.scoreProgram != nil {
+		return exprScore(node)
+	}
+	score := profileScore(node, now)
+	if gConfig.UsagePenaltyWeight > 0 {
+		score += gConfig.UsagePenaltyWeight * recentUsage(node.Name, now)
+	}
+	score += gConfig.LossPenalty * node.Loss
+	return score + nodeBiasFor(node.Name)
+}
+
+// 平均延迟, 启用时段加权时混合 now 所在时段的历史延迟
+func profileScore(node *ProxyNode, now time.Time) float64 {
+	score := float64(node.Latency)
+	weight := gConfig.ProfileWeight
+	if weight <= 0 {
+		return score
+	}
+	hour := now.Hour()
+	profile, ok := gProfiles[node.Name]
+	if !ok || profile[hour] == 0 {
+		return score
+	}
+	return (1-weight)*score + weight*profile[hour]
+}
+
+// 用得分表达式计算节点得分, 统一换算为越小越好
+func exprScore(node *ProxyNode) float64 {
+	env := scoreEnv{
+		Latency: float64(node.Latency),
+		Jitter:  float64(node.Jitter),
+		Flow:    node.Flow,
+		Success: float64(node.Success) / float64(max(gConfig.TestTimes, 1)),
+		Loss:    node.Loss,
+	}
+	out, err := expr.Run(gConfig.scoreProgram, env)
+	if err != nil {
+		log.Printf("B 计算节点 %s 的得分失败: %v", node.Name, err)
+		return math.Inf(1)
+	}
+	score := out.(float64)
+	if gConfig.ScoreOrder == "highest" {
+		return -score
+	}
+	return score
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummarizeSamples(t *testing.T) {
+	tests := []struct {
+		samples []int
+		latency int
+		jitter  int
+	}{
+		{nil, -1, 0},
+		{[]int{100}, 100, 0},
+		{[]int{100, 200}, 150, 50},
+		{[]int{90, 100, 110}, 100, 8},
+	}
+	for _, tt := range tests {
+		latency, jitter := summarizeSamples(tt.samples)
+		if latency != tt.latency || jitter != tt.jitter {
+			t.Errorf("summarizeSamples(%v) = %d, %d, want %d, %d", tt.samples, latency, jitter, tt.latency, tt.jitter)
+		}
+	}
+}
+
+func TestCompileScoreExpr(t *testing.T) {
+	tests := []struct {
+		expr, order string
+		wantErr     bool
+	}{
+		{"", "", false},
+		{"latency + jitter * 2", "lowest", false},
+		{"success * 100 - latency / 10", "highest", false},
+		{"latency +", "", true},
+		{"unknown * 2", "", true},
+		{"latency", "fastest", true},
+	}
+	for _, tt := range tests {
+		config := &Config{ScoreExpr: tt.expr, ScoreOrder: tt.order}
+		if err := compileScoreExpr(config); (err != nil) != tt.wantErr {
+			t.Errorf("compileScoreExpr(%q, %q) error = %v, wantErr %v", tt.expr, tt.order, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPickFastestNodeScoreExpr(t *testing.T) {
+	now := time.Now()
+	gNodes = []*ProxyNode{
+		{Name: "fast but jittery", Latency: 80, Jitter: 60, Flow: 1, Success: 3},
+		{Name: "steady", Latency: 120, Jitter: 5, Flow: 1, Success: 3},
+		{Name: "cheap flaky", Latency: 60, Jitter: 5, Flow: 0.5, Success: 1},
+		{Name: "failed", Latency: -1, Flow: 0.1},
+	}
+	tests := []struct {
+		expr, order, want string
+	}{
+		{"latency + jitter * 2 + (1 - success) * 1000", "", "steady"},
+		{"latency", "lowest", "cheap flaky"},
+		{"success", "highest", "fast but jittery"},
+	}
+	for _, tt := range tests {
+		gConfig = &Config{TestTimes: 3, LatencyThreshold: 250, ScoreExpr: tt.expr, ScoreOrder: tt.order}
+		if err := compileScoreExpr(gConfig); err != nil {
+			t.Fatal(err)
+		}
+		best := pickFastestNode(now).Best
+		if best == nil || best.Name != tt.want {
+			t.Errorf("pickFastestNode(%q, %q) = %v, want %s", tt.expr, tt.order, best, tt.want)
+		}
+	}
+}
+
+func TestUsagePenalty(t *testing.T) {
+	gConfig = &Config{LatencyThreshold: 200, UsagePenaltyWeight: 1}
+	gUsage, gUsageCurrent = make(map[string]usage), ""
+	start := time.Now()
+	a, b := &ProxyNode{Name: "a", Flow: 1, Latency: 100}, &ProxyNode{Name: "b", Flow: 1, Latency: 110}
+
+	recordUsage("a", start)
+	now := start.Add(30 * time.Minute)
+	if got := nodeScore(a, now); got != 130 {
+		t.Errorf("score of the node in use for 30m = %v, want 130", got)
+	}
+	if best, _ := pickNode([]*ProxyNode{a, b}, now); best != b {
+		t.Errorf("best = %s, want the less used b", best.Name)
+	}
+
+	// 切换后 a 的使用时长每小时减半
+	recordUsage("b", now)
+	if got := recentUsage("a", now.Add(time.Hour)); got < 14.9 || got > 15.1 {
+		t.Errorf("recentUsage(a) an hour later = %v, want 15", got)
+	}
+
+	gConfig.UsagePenaltyWeight = 0
+	if got := nodeScore(a, now); got != 100 {
+		t.Errorf("score without usage penalty = %v, want 100", got)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// select_node 为空时优先选择的常见默认节点组名称
+var defaultGroupRe = regexp.MustCompile(`(?i)节点选择|^proxy$|^proxies$|🔰|🚀`)
+
+// 从控制器返回的节点组中选出切换的节点组: 优先名称为常见默认名称的 Selector, 否则为第一个 Selector。
+// 顺序按 GLOBAL 组的成员顺序, 即配置文件中的顺序, 不在 GLOBAL 中的按名称排在后面
+func detectSelectGroup(proxiesResp *ProxiesResponse) (string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	if global, ok := proxiesResp.Proxies["GLOBAL"]; ok {
+		for _, name := range global.All {
+			if !seen[name] {
+				names = append(names, name)
+				seen[name] = true
+			}
+		}
+	}
+	var rest []string
+	for name := range proxiesResp.Proxies {
+		if !seen[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	names = append(names, rest...)
+
+	var selectors []string
+	for _, name := range names {
+		if proxy, ok := proxiesResp.Proxies[name]; ok && proxy.Type == "Selector" && name != "GLOBAL" {
+			selectors = append(selectors, name)
+		}
+	}
+	for _, name := range selectors {
+		if defaultGroupRe.MatchString(name) {
+			return name, nil
+		}
+	}
+	if len(selectors) == 0 {
+		return "", fmt.Errorf("%w: 控制器中没有 Selector 类型的节点组", ErrGroupNotFound)
+	}
+	return selectors[0], nil
+}
+
+// select_node 为空时自动选择节点组, 只填充未设置的 switch_group 和 current_group,
+// 然后按确定的切换节点组区分 test_urls 中的节点组和区域
+func applySelectGroup(config *Config, proxiesResp *ProxiesResponse) error {
+	name, err := detectSelectGroup(proxiesResp)
+	if err != nil {
+		return err
+	}
+	log.Printf("select_node 为空, 自动选择节点组: %s", name)
+	config.SelectNode = name
+	if config.SwitchGroup == "" {
+		config.SwitchGroup = name
+	}
+	if config.CurrentGroup == "" {
+		config.CurrentGroup = config.SwitchGroup
+	}
+	return compileTestURLs(config)
+}
+
+// 启动时自动选择节点组, 控制器暂时无法访问时每 10 秒重试一次
+func waitSelectGroup() {
+	for {
+		proxiesResp, err := fetchProxies()
+		if err == nil {
+			err = applySelectGroup(gConfig, proxiesResp)
+			if err != nil && !errors.Is(err, ErrGroupNotFound) {
+				log.Fatalf("配置无效: %v", err)
+			}
+		}
+		if err == nil {
+			return
+		}
+		log.Printf("自动选择节点组失败, 10 秒后重试: %v", err)
+		time.Sleep(10 * time.Second)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDetectSelectGroup(t *testing.T) {
+	selector := func(name string, all ...string) ProxyNode {
+		return ProxyNode{Name: name, Type: "Selector", All: all}
+	}
+	tests := []struct {
+		name    string
+		proxies map[string]ProxyNode
+		want    string
+	}{
+		{"default name", map[string]ProxyNode{
+			"GLOBAL":  selector("GLOBAL", "🎥 流媒体", "🔰 节点选择"),
+			"🎥 流媒体":   selector("🎥 流媒体"),
+			"🔰 节点选择":  selector("🔰 节点选择"),
+			"♻️ 自动选择": {Name: "♻️ 自动选择", Type: "URLTest"},
+			"HK 01":   {Name: "HK 01", Type: "Shadowsocks"},
+		}, "🔰 节点选择"},
+		{"first selector in config order", map[string]ProxyNode{
+			"GLOBAL":    selector("GLOBAL", "Streaming", "Main"),
+			"Main":      selector("Main"),
+			"Streaming": selector("Streaming"),
+		}, "Streaming"},
+		{"sorted without GLOBAL", map[string]ProxyNode{
+			"b": selector("b"),
+			"a": selector("a"),
+		}, "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := detectSelectGroup(&ProxiesResponse{Proxies: tt.proxies})
+			if err != nil || got != tt.want {
+				t.Errorf("detectSelectGroup() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	_, err := detectSelectGroup(&ProxiesResponse{Proxies: map[string]ProxyNode{"GLOBAL": selector("GLOBAL")}})
+	if !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("detectSelectGroup() without selectors error = %v, want ErrGroupNotFound", err)
+	}
+}
+
+func TestApplySelectGroupKeepsConfiguredGroups(t *testing.T) {
+	config := &Config{CurrentGroup: "Auto"}
+	proxiesResp := &ProxiesResponse{Proxies: map[string]ProxyNode{"PROXY": {Name: "PROXY", Type: "Selector"}}}
+	if err := applySelectGroup(config, proxiesResp); err != nil {
+		t.Fatal(err)
+	}
+	if config.SelectNode != "PROXY" || config.SwitchGroup != "PROXY" || config.CurrentGroup != "Auto" {
+		t.Errorf("config = select %q, switch %q, current %q", config.SelectNode, config.SwitchGroup, config.CurrentGroup)
+	}
+}
+
+func TestApplySelectGroupTestURLs(t *testing.T) {
+	config, err := loadConfig(writeTestConfig(t, `select_node: ""
+test_urls:
+  "🔰 节点选择": https://www.netflix.com/title/80018499
+  "日本|JP": https://www.dmm.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxiesResp := &ProxiesResponse{Proxies: map[string]ProxyNode{"🔰 节点选择": {Name: "🔰 节点选择", Type: "Selector"}}}
+	if err := applySelectGroup(config, proxiesResp); err != nil {
+		t.Fatal(err)
+	}
+	// 自动选择的节点组不作为区域正则
+	if len(config.regionURLs) != 1 || config.regionURLs[0].url != "https://www.dmm.com" {
+		t.Errorf("regionURLs = %+v, want only 日本|JP", config.regionURLs)
+	}
+	gConfig = config
+	if got := testURLFor(&ProxyNode{Name: "香港 01"}); got != "https://www.netflix.com/title/80018499" {
+		t.Errorf("testURLFor() = %s, want the switch group's URL", got)
+	}
+}
+
+func TestLoadConfigCurrentGroupDefault(t *testing.T) {
+	config, err := loadConfig(writeTestConfig(t, "select_node: \"\"\nswitch_group: Streaming\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SwitchGroup != "Streaming" || config.CurrentGroup != "Streaming" {
+		t.Errorf("switch %q, current %q, want both Streaming", config.SwitchGroup, config.CurrentGroup)
+	}
+}
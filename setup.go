@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// setup 命令写入的配置, 只包含首次使用需要的配置项, 其余使用默认值
+type setupConfig struct {
+	APIEndpoint      string `yaml:"api_endpoint"`
+	APIKey           string `yaml:"api_key"`
+	SelectNode       string `yaml:"select_node"`
+	IncludeRegex     string `yaml:"include_regex"`
+	ExcludeRegex     string `yaml:"exclude_regex"`
+	TestURL          string `yaml:"test_url"`
+	TestTimes        int    `yaml:"test_times"`
+	LatencyThreshold int    `yaml:"latency_threshold"`
+	RetrieveInterval int    `yaml:"retrieve_interval"`
+	CurrentInterval  int    `yaml:"current_interval"`
+	BestInterval     int    `yaml:"best_interval"`
+}
+
+// 输入已结束, 无法继续提问
+var errSetupEOF = errors.New("输入已结束, 未写入配置文件")
+
+// 逐行读取回答的问答
+type setupPrompter struct {
+	in  *bufio.Scanner
+	out io.Writer
+}
+
+// 提问并返回回答, 直接回车时使用默认值
+func (p *setupPrompter) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	if !p.in.Scan() {
+		fmt.Fprintln(p.out)
+		return "", errSetupEOF
+	}
+	answer := strings.TrimSpace(p.in.Text())
+	if answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// 提问一个正整数, 无效时重新提问
+func (p *setupPrompter) askInt(question string, def int) (int, error) {
+	for {
+		answer, err := p.ask(question, strconv.Itoa(def))
+		if err != nil {
+			return 0, err
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n > 0 {
+			return n, nil
+		}
+		fmt.Fprintln(p.out, "请输入正整数")
+	}
+}
+
+// 提问一个正则表达式, 无效时重新提问
+func (p *setupPrompter) askRegex(question, def string) (string, error) {
+	for {
+		answer, err := p.ask(question, def)
+		if err != nil {
+			return "", err
+		}
+		if _, err := regexp.Compile(answer); err != nil {
+			fmt.Fprintf(p.out, "正则表达式无效: %v\n", err)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+// 询问控制器地址和密钥, 连接成功后返回节点列表
+func (p *setupPrompter) connect(config *setupConfig) (*ProxiesResponse, error) {
+	for {
+		var err error
+		if config.APIEndpoint, err = p.ask("控制器地址 (Clash 的 external-controller)", config.APIEndpoint); err != nil {
+			return nil, err
+		}
+		if !strings.Contains(config.APIEndpoint, "://") {
+			config.APIEndpoint = "http://" + config.APIEndpoint
+		}
+		if config.APIKey, err = p.ask("控制器密钥 (Clash 的 secret), 没有则直接回车", config.APIKey); err != nil {
+			return nil, err
+		}
+		gConfig = &Config{APIEndpoint: config.APIEndpoint, APIKey: config.APIKey}
+		proxiesResp, err := fetchProxies()
+		switch {
+		case err == nil:
+			fmt.Fprintf(p.out, "✔ 已连接控制器\n")
+			return proxiesResp, nil
+		case errors.Is(err, ErrAuth):
+			fmt.Fprintf(p.out, "✘ 认证失败, 请确认密钥与 Clash 配置中的 secret 一致\n")
+		default:
+			fmt.Fprintf(p.out, "✘ 连接失败: %v\n  请确认 Clash 已启动并开启 external-controller\n", err)
+		}
+	}
+}
+
+// 列出可切换的节点组, 按编号选择, 默认为自动检测到的节点组
+func (p *setupPrompter) chooseGroup(proxiesResp *ProxiesResponse) (string, error) {
+	var groups []ProxyNode
+	for _, group := range listGroups(proxiesResp) {
+		if group.Type == "Selector" {
+			groups = append(groups, group)
+		}
+	}
+	if len(groups) == 0 {
+		return "", fmt.Errorf("控制器中没有 Selector 类型的节点组")
+	}
+	detected, _ := detectSelectGroup(proxiesResp)
+	def := 1
+	fmt.Fprintln(p.out, "可切换的节点组:")
+	for i, group := range groups {
+		if group.Name == detected {
+			def = i + 1
+		}
+		fmt.Fprintf(p.out, "  %d) %s (当前节点: %s, %d 个成员)\n", i+1, group.Name, orNone(group.Now), len(group.All))
+	}
+	for {
+		n, err := p.askInt("选择切换的节点组", def)
+		if err != nil {
+			return "", err
+		}
+		if n <= len(groups) {
+			return groups[n-1].Name, nil
+		}
+		fmt.Fprintf(p.out, "请输入 1 到 %d\n", len(groups))
+	}
+}
+
+// 交互式生成配置文件: 连接控制器、选择节点组、设置筛选条件和阈值, 写入 path 后按正常启动的方式加载校验
+func runSetup(in io.Reader, out io.Writer, path string) error {
+	p := &setupPrompter{in: bufio.NewScanner(in), out: out}
+	if _, err := os.Stat(path); err == nil {
+		answer, err := p.ask(fmt.Sprintf("%s 已存在, 是否覆盖 (y/N)", path), "")
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(answer, "y") {
+			return fmt.Errorf("已取消, 未修改 %s", path)
+		}
+	}
+
+	config := setupConfig{
+		APIEndpoint:      "http://127.0.0.1:9090",
+		ExcludeRegex:     "^$",
+		TestURL:          "http://www.gstatic.com/generate_204",
+		TestTimes:        3,
+		LatencyThreshold: 250,
+		RetrieveInterval: 3600,
+		CurrentInterval:  60,
+		BestInterval:     600,
+	}
+	proxiesResp, err := p.connect(&config)
+	if err != nil {
+		return err
+	}
+	if config.SelectNode, err = p.chooseGroup(proxiesResp); err != nil {
+		return err
+	}
+	if config.IncludeRegex, err = p.askRegex("只使用名称匹配该正则的节点, 如 香港|日本, 直接回车使用全部节点", ""); err != nil {
+		return err
+	}
+	if config.ExcludeRegex, err = p.askRegex("排除名称匹配该正则的节点, 如 10x|官网", config.ExcludeRegex); err != nil {
+		return err
+	}
+	if config.TestURL, err = p.ask("测试 URL", config.TestURL); err != nil {
+		return err
+	}
+	if config.LatencyThreshold, err = p.askInt("延迟阈值 (毫秒)", config.LatencyThreshold); err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal(&config)
+	if err != nil {
+		return fmt.Errorf("生成配置失败: %v", err)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("写入配置文件失败: %v", err)
+	}
+	loaded, err := loadConfig(path)
+	if err != nil {
+		return fmt.Errorf("已写入 %s, 但配置无效, 请修改后再运行: %v", path, err)
+	}
+	gConfig = loaded
+	fmt.Fprintf(out, "✔ 已写入 %s\n", path)
+	nodes, _, err := parseNodes(proxiesResp)
+	switch {
+	case err != nil:
+		fmt.Fprintf(out, "✘ 读取节点失败: %v\n", err)
+	case len(nodes) == 0:
+		fmt.Fprintln(out, "✘ 没有节点通过筛选, 请修改 include_regex 和 exclude_regex")
+	default:
+		fmt.Fprintf(out, "✔ %d 个节点通过筛选, 可以运行 autoclash -c %s 启动, 或运行 doctor 命令做完整检查\n", len(nodes), path)
+	}
+	return nil
+}
+
+func newSetupCmd(configPath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "setup",
+		Short: "交互式生成配置文件: 连接控制器、从列表中选择节点组并设置阈值",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runSetup(os.Stdin, os.Stdout, *configPath); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunSetup(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/proxies" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"proxies":{
+			"GLOBAL":{"name":"GLOBAL","type":"Selector","all":["🔰 节点选择","Streaming"]},
+			"Streaming":{"name":"Streaming","type":"Selector","now":"JP 01","all":["HK 01","JP 01"]},
+			"🔰 节点选择":{"name":"🔰 节点选择","type":"Selector","now":"HK 01","all":["HK 01","JP 01","官网"]},
+			"HK 01":{"name":"HK 01","type":"Trojan"},
+			"JP 01":{"name":"JP 01","type":"Trojan"},
+			"官网":{"name":"官网","type":"Trojan"}
+		}}`))
+	}))
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "config.yml")
+
+	answers := strings.Join([]string{
+		server.URL, "wrong", // 密钥错误时重新输入
+		"", "secret",
+		"9", "", // 编号超出范围, 然后使用自动检测到的节点组
+		"", "官网|(", "官网", // 无效的正则重新输入
+		"", "abc", "200",
+	}, "\n") + "\n"
+	var out strings.Builder
+	if err := runSetup(strings.NewReader(answers), &out, path); err != nil {
+		t.Fatalf("runSetup() = %v\n%s", err, out.String())
+	}
+	for _, want := range []string{"认证失败", "3) 🔰 节点选择", "请输入 1 到 3", "正则表达式无效", "请输入正整数", "2 个节点通过筛选"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out.String())
+		}
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.APIEndpoint != server.URL || config.APIKey != "secret" || config.SelectNode != "🔰 节点选择" || config.ExcludeRegex != "官网" || config.LatencyThreshold != 200 {
+		t.Errorf("config = endpoint %q, key %q, group %q, exclude %q, threshold %d", config.APIEndpoint, config.APIKey, config.SelectNode, config.ExcludeRegex, config.LatencyThreshold)
+	}
+
+	// 已存在时不确认覆盖则不修改
+	if err := runSetup(strings.NewReader("n\n"), &out, path); err == nil {
+		t.Error("runSetup() overwrote the existing config without confirmation")
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "官网") {
+		t.Errorf("config changed after cancelling:\n%s", data)
+	}
+	// 输入提前结束时不写入
+	other := filepath.Join(t.TempDir(), "config.yml")
+	if err := runSetup(strings.NewReader(server.URL+"\n"), &out, other); err != errSetupEOF {
+		t.Errorf("runSetup() with truncated input = %v, want errSetupEOF", err)
+	}
+	if _, err := os.Stat(other); !os.IsNotExist(err) {
+		t.Errorf("config written after truncated input: %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+// 每个节点最近几轮测试的延迟, 从早到晚, -1 为测试失败。仅保存在内存中, 重启后清空
+var gLatencyHistory = make(map[string][]int)
+
+// 把本轮测试结果追加到节点的延迟历史, 只保留最近 latency_history_size 轮
+func updateLatencyHistory(nodes []*ProxyNode) {
+	size := gConfig.LatencyHistorySize
+	if size <= 0 {
+		return
+	}
+	for _, node := range nodes {
+		history := append(gLatencyHistory[node.Name], node.Latency)
+		if len(history) > size {
+			// 复制到新的切片, 避免底层数组无限增长
+			history = append([]int(nil), history[len(history)-size:]...)
+		}
+		gLatencyHistory[node.Name] = history
+	}
+}
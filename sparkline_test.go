@@ -0,0 +1,31 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestUpdateLatencyHistory(t *testing.T) {
+	gConfig = &Config{LatencyHistorySize: 3}
+	gLatencyHistory = make(map[string][]int)
+	node := &ProxyNode{Name: "HK 01"}
+	for _, latency := range []int{100, -1, 120, 90} {
+		node.Latency = latency
+		updateLatencyHistory([]*ProxyNode{node})
+	}
+	if got := gLatencyHistory["HK 01"]; !slices.Equal(got, []int{-1, 120, 90}) {
+		t.Errorf("history = %v, want [-1 120 90]", got)
+	}
+
+	gNodes = []*ProxyNode{node}
+	if history := takeSnapshot().Nodes[0].History; !slices.Equal(history, []int{-1, 120, 90}) {
+		t.Errorf("status history = %v", history)
+	}
+
+	gConfig.LatencyHistorySize = 0
+	gLatencyHistory = make(map[string][]int)
+	updateLatencyHistory([]*ProxyNode{node})
+	if len(gLatencyHistory) != 0 {
+		t.Errorf("history kept with latency_history_size 0: %v", gLatencyHistory)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 等待控制器时两次连接之间的间隔
+const startupRetryInterval = time.Second
+
+// 控制器是否已经在监听。收到任何 HTTP 响应即可, 认证失败等问题由之后的请求报告。
+// 不经过熔断器, 避免等待期间的连接失败触发熔断
+func controllerReady(ctx context.Context) bool {
+	req, err := http.NewRequestWithContext(ctx, "GET", gConfig.APIEndpoint+"/version", nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Authorization", "Bearer "+gConfig.APIKey)
+	resp, err := (&http.Client{Timeout: 2 * time.Second}).Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+// 启动时等待控制器就绪, 最多等待 timeout, 超时返回错误
+func waitForController(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		if controllerReady(ctx) {
+			if attempt > 1 {
+				log.Printf("控制器已就绪, 等待了 %s", time.Since(start).Round(time.Second))
+			}
+			return nil
+		}
+		if attempt == 1 {
+			log.Printf("控制器尚未就绪, 最多等待 %s: %s", timeout, gConfig.APIEndpoint)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: 等待 %s 后控制器仍未就绪: %s", ErrUnreachable, timeout, gConfig.APIEndpoint)
+		case <-time.After(startupRetryInterval):
+		}
+	}
+}
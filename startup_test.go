@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWaitForController(t *testing.T) {
+	// 先占用一个端口得到地址, 关闭后控制器还未监听
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	gConfig = &Config{APIEndpoint: "http://" + addr}
+
+	if err := waitForController(100 * time.Millisecond); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("waitForController() without a controller error = %v, want ErrUnreachable", err)
+	}
+
+	// 控制器稍后启动, 返回 401 也视为就绪
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		server := &httptest.Server{Listener: listener, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		})}}
+		server.Start()
+		t.Cleanup(server.Close)
+	}()
+	if err := waitForController(5 * time.Second); err != nil {
+		t.Errorf("waitForController() = %v, want the controller to become ready", err)
+	}
+}
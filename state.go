@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 超过该时间的持久化测试结果在启动时丢弃
+const stateMaxAge = 24 * time.Hour
+
+// 持久化到 state_file 的运行状态
+type persistedState struct {
+	Best         string                 `json:"best"`
+	Measurements map[string]measurement `json:"measurements"`
+	Switches     []switchRecord         `json:"switches,omitempty"` // 最近的切换记录
+}
+
+// 先写入临时文件再重命名, 避免读取方看到写了一半的内容
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// 保存最优节点、所有节点的测试结果和最近的切换记录
+func saveState() error {
+	if gConfig.StateFile == "" {
+		return nil
+	}
+	state := persistedState{Measurements: gMeasurements, Switches: gSwitchHistory}
+	if gBest != nil {
+		state.Best = gBest.Name
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("序列化状态失败: %v", err)
+	}
+	if err := writeFileAtomic(gConfig.StateFile, data); err != nil {
+		return fmt.Errorf("写入状态文件失败: %v", err)
+	}
+	return nil
+}
+
+// 读取上次运行保存的测试结果, 标记为过期, 在下一轮测试时刷新
+func loadState(now time.Time) error {
+	if gConfig.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(gConfig.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取状态文件失败: %v", err)
+	}
+	state, err := parseState(data)
+	if err != nil {
+		return err
+	}
+	gSwitchHistory = state.Switches
+	if size := historySize(); len(gSwitchHistory) > size {
+		gSwitchHistory = gSwitchHistory[len(gSwitchHistory)-size:]
+	}
+	count := 0
+	for name, m := range state.Measurements {
+		if now.Sub(m.TestedAt) > stateMaxAge {
+			continue
+		}
+		m.Stale = true
+		gMeasurements[name] = m
+		count++
+	}
+	log.Printf("读取到 %d 个节点上次运行的测试结果, 上次最优节点: %s", count, state.Best)
+	return nil
+}
+
+func parseState(data []byte) (persistedState, error) {
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("解析状态文件失败: %v", err)
+	}
+	return state, nil
+}
+
+// 用上次运行的测试结果临时选出最优节点, 没有可用结果时返回 nil
+func provisionalBest(now time.Time) *ProxyNode {
+	for _, node := range gNodes {
+		if node.Stale && node.Latency > 0 {
+			return pickFastestNode(now).Best
+		}
+	}
+	return nil
+}
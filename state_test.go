@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	path := t.TempDir() + "/state.json"
+	now := time.Now()
+	gConfig = &Config{StateFile: path, LatencyThreshold: 250, BestInterval: 600, TestTimes: 3}
+	gMeasurements = map[string]measurement{
+		"a":   {Latency: 120, Success: 3, TestedAt: now},
+		"b":   {Latency: 90, Success: 3, TestedAt: now},
+		"old": {Latency: 50, Success: 3, TestedAt: now.Add(-2 * stateMaxAge)},
+	}
+	gBest = &ProxyNode{Name: "b"}
+	if err := saveState(); err != nil {
+		t.Fatalf("saveState() error = %v", err)
+	}
+
+	// 模拟重启: 内存中的结果清空, 从状态文件恢复
+	gMeasurements = make(map[string]measurement)
+	gBest = nil
+	restart := now.Add(3 * time.Hour)
+	if err := loadState(restart); err != nil {
+		t.Fatalf("loadState() error = %v", err)
+	}
+	if _, ok := gMeasurements["old"]; ok {
+		t.Error("measurement older than stateMaxAge should be dropped")
+	}
+	if m := gMeasurements["a"]; !m.Stale || m.Latency != 120 {
+		t.Errorf("restored measurement = %+v, want stale latency 120", m)
+	}
+
+	// 过期的持久化结果不受有效期限制, 可以临时选出最优节点
+	gNodes = newTestNodes("a", "b", "c")
+	applyMeasurements(gNodes, restart)
+	best := provisionalBest(restart)
+	if best == nil || best.Name != "b" {
+		t.Fatalf("provisionalBest() = %v, want b", best)
+	}
+
+	// 重新测试后清除过期标记
+	gNodes[0].Latency = 100
+	recordMeasurements(gNodes[:1], restart)
+	applyMeasurements(gNodes, restart)
+	if gNodes[0].Stale || !gNodes[1].Stale {
+		t.Errorf("stale flags = %v, %v, want false, true", gNodes[0].Stale, gNodes[1].Stale)
+	}
+}
+
+func TestLoadStateMissingFile(t *testing.T) {
+	gConfig = &Config{StateFile: t.TempDir() + "/missing.json"}
+	if err := loadState(time.Now()); err != nil {
+		t.Errorf("loadState() error = %v, want nil for a missing file", err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/current"
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(content)); err != nil {
+			t.Fatalf("writeFileAtomic() error = %v", err)
+		}
+		if data, _ := os.ReadFile(path); string(data) != content {
+			t.Errorf("content = %q, want %q", data, content)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
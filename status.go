@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 节点状态
+type nodeStatus struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Flow     float64   `json:"flow"`
+	Latency  int       `json:"latency"`
+	Jitter   int       `json:"jitter"`
+	Success  int       `json:"success"`
+	Loss     float64   `json:"loss"` // 最近一轮测试失败的比例(0~1)
+	TestedAt time.Time `json:"tested_at,omitzero"`
+	Stale    bool      `json:"stale,omitempty"`
+	History  []int     `json:"history,omitempty"` // 最近几轮的延迟, 从早到晚, -1 为失败, 需要设置 latency_history_size
+	Reason   string    `json:"reason,omitempty"`  // 最近一轮选择的结果代码, 如 best、over_threshold、failed_all
+}
+
+// /status 返回的运行状态
+type statusSnapshot struct {
+	Profile           string               `json:"profile,omitempty"`
+	MonitorOnly       bool                 `json:"monitor_only,omitempty"` // 仅监控模式, 不会切换节点
+	WarmingUp         bool                 `json:"warming_up,omitempty"`   // 预热中, 只测试不切换节点
+	NodesUpdatedAt    time.Time            `json:"nodes_updated_at,omitzero"`
+	NodeListStale     bool                 `json:"node_list_stale,omitempty"` // 节点列表超过 max_node_list_age 未更新, 暂停切换
+	Current           string               `json:"current"`
+	CurrentLatency    int                  `json:"current_latency"` // 最近一次检查当前节点的延迟, -1 为失败或未测试
+	CurrentCheckedAt  time.Time            `json:"current_checked_at,omitzero"`
+	ControllerLatency int                  `json:"controller_latency"` // 最近一轮选择时访问控制器本身的耗时, -1 为失败或未测试
+	Best              string               `json:"best"`
+	Decision          *selectionDecision   `json:"decision,omitempty"`
+	Excluded          map[string]time.Time `json:"excluded,omitempty"`   // 临时排除的节点及截止时间
+	RecoverTo         string               `json:"recover_to,omitempty"` // 启用 prefer_recovery 时等待恢复后切换回去的节点
+	Switches          []switchRecord       `json:"switches"`             // 最近的切换记录, 从早到晚
+	Nodes             []nodeStatus         `json:"nodes"`
+}
+
+// 一次切换当前节点的记录
+type switchRecord struct {
+	Time        time.Time `json:"time"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Reason      string    `json:"reason,omitempty"`
+	FromLatency int       `json:"from_latency,omitempty"` // 切换前最近一次检查当前节点的延迟, -1 为失败或未测试
+	ToLatency   int       `json:"to_latency,omitempty"`   // 新节点最近一轮测试的延迟
+}
+
+// 默认保留的切换记录数
+const defaultHistorySize = 20
+
+var gSwitchHistory []switchRecord // 最近的切换记录, 由 mu 保护
+
+// 保留的切换记录数
+func historySize() int {
+	if gConfig.HistorySize <= 0 {
+		return defaultHistorySize
+	}
+	return gConfig.HistorySize
+}
+
+// 记录一次切换, 只保留最近 history_size 条
+func recordSwitchHistory(record switchRecord) {
+	gSwitchHistory = append(gSwitchHistory, record)
+	if size := historySize(); len(gSwitchHistory) > size {
+		gSwitchHistory = gSwitchHistory[len(gSwitchHistory)-size:]
+	}
+}
+
+// 获取当前运行状态, 调用方需持有 mu
+func takeSnapshot() statusSnapshot {
+	snapshot := statusSnapshot{
+		Profile:           gConfig.Profile,
+		MonitorOnly:       gConfig.MonitorOnly,
+		WarmingUp:         warmingUp(),
+		NodesUpdatedAt:    gNodesUpdatedAt,
+		NodeListStale:     nodeListStale(time.Now()),
+		CurrentLatency:    gCurrentLatency,
+		CurrentCheckedAt:  gCurrentCheckedAt,
+		ControllerLatency: gControllerLatency,
+		Decision:          gDecision,
+		Excluded:          activeExclusions(time.Now()),
+		RecoverTo:         gRecoverTo,
+		Switches:          append([]switchRecord{}, gSwitchHistory...),
+		Nodes:             []nodeStatus{},
+	}
+	if gCurrent != nil {
+		snapshot.Current = gCurrent.Name
+	}
+	if gBest != nil {
+		snapshot.Best = gBest.Name
+	}
+	for _, node := range gNodes {
+		snapshot.Nodes = append(snapshot.Nodes, nodeStatus{
+			Name:     node.Name,
+			Type:     node.Type,
+			Flow:     node.Flow,
+			Latency:  node.Latency,
+			Jitter:   node.Jitter,
+			Success:  node.Success,
+			Loss:     node.Loss,
+			TestedAt: node.TestedAt,
+			Stale:    node.Stale,
+			History:  append([]int(nil), gLatencyHistory[node.Name]...),
+			Reason:   node.Reason,
+		})
+	}
+	return snapshot
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	snapshot := takeSnapshot()
+	mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// 立即重新测试所有节点, 当前节点不是选出的最优节点时切换过去。
+// 用于 sticky 方式下手动重新选择, 测试期间请求会一直等待
+func handleReevaluate(w http.ResponseWriter, r *http.Request) {
+	log.Println("S 手动重新选择最优节点")
+	best, err := selectFastestNode()
+	mu.Lock()
+	if err == nil {
+		adoptBest(best, "S")
+		if !sameNode(gCurrent, best) {
+			gSwitchReason = "手动重新选择"
+			err = switchToBest("S")
+		}
+		// 仅监控模式下只重新测试, 不算失败
+		if errors.Is(err, errMonitorOnly) {
+			err = nil
+		}
+	}
+	snapshot := takeSnapshot()
+	mu.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("重新选择失败: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// 以 Server-Sent Events 推送事件, 每个事件为一个 JSON 对象
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "不支持事件流", http.StatusInternalServerError)
+		return
+	}
+	events, unsubscribe := subscribeEvents()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case event := <-events:
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
+func newStatusMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", handleStatus)
+	mux.HandleFunc("GET /events", handleEvents)
+	mux.HandleFunc("GET /metrics", handleMetrics)
+	mux.HandleFunc("POST /exclude", handleExclude)
+	mux.HandleFunc("DELETE /exclude", handleExclude)
+	mux.HandleFunc("POST /reevaluate", handleReevaluate)
+	return mux
+}
+
+// 状态服务的监听器。unix:/path 形式的地址监听 unix socket, 权限为 0600, 只有运行 autoclash 的用户可以访问
+func statusListener(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixAddrPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	// 上次异常退出时留下的 socket 文件会导致监听失败, 只删除 socket, 不删除同名的普通文件
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	// 先在只有自己可以访问的临时目录中创建 socket 并设置权限, 再移动到 path,
+	// 避免创建后、设置权限前其他用户连接; 不修改进程的 umask, 以免影响其他协程创建的文件
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".autoclash")
+	if err != nil {
+		return nil, fmt.Errorf("创建临时目录失败: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// 关闭时删除的是临时路径, 移动后的 socket 由下次启动时删除
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("设置 socket 权限失败: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("移动 socket 失败: %v", err)
+	}
+	return listener, nil
+}
+
+// 启动状态服务
+func startStatusServer() {
+	listener, err := statusListener(gConfig.StatusAddr)
+	if err != nil {
+		log.Printf("S 状态服务监听失败: %v", err)
+		return
+	}
+	log.Printf("S 状态服务监听: %s", gConfig.StatusAddr)
+	err = http.Serve(listener, newStatusMux())
+	log.Printf("S 状态服务退出: %v", err)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleStatus(t *testing.T) {
+	gConfig = &Config{}
+	gNodes = newTestNodes("a", "b")
+	gNodes[0].Latency = 120
+	gCurrent, gBest = gNodes[1], gNodes[0]
+
+	rec := httptest.NewRecorder()
+	newStatusMux().ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	var snapshot statusSnapshot
+	if err := json.NewDecoder(rec.Body).Decode(&snapshot); err != nil {
+		t.Fatalf("decode /status: %v", err)
+	}
+	if snapshot.Current != "b" || snapshot.Best != "a" || len(snapshot.Nodes) != 2 || snapshot.Nodes[0].Latency != 120 {
+		t.Errorf("/status = %+v", snapshot)
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	server := httptest.NewServer(newStatusMux())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	// 等待订阅生效后再发布事件
+	for deadline := time.Now().Add(time.Second); ; {
+		eventMu.Lock()
+		n := len(eventSubscribers)
+		eventMu.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	publishEvent(EventSwitched, map[string]any{"from": "a", "to": "b"})
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if lines[0] != "event: switched" {
+		t.Errorf("event line = %q", lines[0])
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &event); err != nil || event.Type != EventSwitched {
+		t.Errorf("data line = %q, err = %v", lines[1], err)
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	gConfig = &Config{}
+	gNodes = newTestNodes("a", "b")
+	gNodes[0].Latency, gNodes[0].TestedAt = 120, time.Now()
+	gCurrent, gBest = gNodes[0], gNodes[0]
+	gCurrentLatency, gCurrentCheckedAt = 95, time.Unix(1700000000, 0)
+
+	rec := httptest.NewRecorder()
+	newStatusMux().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`autoclash_current_latency_ms{node="a"} 95`,
+		"autoclash_current_checked_timestamp_seconds 1700000000",
+		`autoclash_node_latency_ms{node="a"} 120`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics missing %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `autoclash_node_latency_ms{node="b"}`) {
+		t.Errorf("/metrics should skip untested nodes:\n%s", body)
+	}
+}
+
+func TestHandleReevaluate(t *testing.T) {
+	var switched []string
+	newTestController(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut:
+			var body struct{ Name string }
+			json.NewDecoder(r.Body).Decode(&body)
+			switched = append(switched, body.Name)
+			w.WriteHeader(http.StatusNoContent)
+		case strings.Contains(r.URL.Path, "fast"):
+			w.Write([]byte(`{"delay":40}`))
+		default:
+			w.Write([]byte(`{"delay":150}`))
+		}
+	})
+	gConfig.SelectionMode = "sticky"
+	gConfig.LatencyThreshold = 200
+	gConfig.TestTimes = 1
+	gNodes = []*ProxyNode{{Name: "HK slow", Flow: 1}, {Name: "HK fast", Flow: 1}}
+	gCurrent, gBest = gNodes[0], gNodes[0]
+
+	rec := httptest.NewRecorder()
+	newStatusMux().ServeHTTP(rec, httptest.NewRequest("POST", "/reevaluate", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /reevaluate = %d %s", rec.Code, rec.Body)
+	}
+	var snapshot statusSnapshot
+	json.NewDecoder(rec.Body).Decode(&snapshot)
+	if snapshot.Current != "HK fast" || snapshot.Best != "HK fast" || len(switched) != 1 {
+		t.Errorf("current = %s, best = %s, switched %v, want HK fast", snapshot.Current, snapshot.Best, switched)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 本次运行的统计, 启用 session_summary 时在退出时输出到日志
+type sessionStats struct {
+	lock         sync.Mutex
+	startedAt    time.Time
+	cycles       int                      // 完成的最优节点选择轮数
+	switches     int                      // 切换当前节点的次数
+	failedTests  int                      // 测试失败的次数, 包括选择最优节点和检查当前节点
+	latencyTotal int                      // 当前节点测试成功的延迟之和
+	latencyCount int                      // 当前节点测试成功的次数
+	nodeTime     map[string]time.Duration // 每个节点作为当前节点的时间
+	current      string
+	since        time.Time
+}
+
+var gStats = newSessionStats(time.Now())
+
+func newSessionStats(now time.Time) *sessionStats {
+	return &sessionStats{startedAt: now, nodeTime: make(map[string]time.Duration)}
+}
+
+// 完成一轮最优节点选择, failed 为本轮失败的测试次数
+func (s *sessionStats) recordCycle(failed int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cycles++
+	s.failedTests += failed
+}
+
+func (s *sessionStats) recordSwitch() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.switches++
+}
+
+// 检查当前节点的结果, latency 小于 0 表示测试失败
+func (s *sessionStats) recordCurrentTest(latency int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if latency < 0 {
+		s.failedTests++
+		return
+	}
+	s.latencyTotal += latency
+	s.latencyCount++
+}
+
+// 当前节点变化, name 为空表示没有当前节点
+func (s *sessionStats) recordCurrent(name string, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.accumulate(now)
+	s.current = name
+	s.since = now
+}
+
+// 把当前节点从 since 到 now 的时间计入 nodeTime
+func (s *sessionStats) accumulate(now time.Time) {
+	if s.current != "" {
+		s.nodeTime[s.current] += now.Sub(s.since)
+	}
+	s.since = now
+}
+
+// 生成本次运行的统计摘要
+func (s *sessionStats) summary(now time.Time) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.accumulate(now)
+
+	longest, longestTime := "无", time.Duration(0)
+	for name, d := range s.nodeTime {
+		if d > longestTime || d == longestTime && name < longest {
+			longest, longestTime = name, d
+		}
+	}
+	average := "无"
+	if s.latencyCount > 0 {
+		average = fmt.Sprintf("%dms", s.latencyTotal/s.latencyCount)
+	}
+	return fmt.Sprintf("运行时间: %s, 选择轮数: %d, 切换次数: %d, 使用最久的节点: %s (%s), 当前节点平均延迟: %s, 失败的测试: %d",
+		now.Sub(s.startedAt).Round(time.Second), s.cycles, s.switches, longest, longestTime.Round(time.Second), average, s.failedTests)
+}
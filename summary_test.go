@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionStatsSummary(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newSessionStats(start)
+	s.recordCurrent("HK 01", start)
+	s.recordCycle(2)
+	s.recordCurrentTest(100)
+	s.recordCurrentTest(-1)
+	s.recordSwitch()
+	s.recordCurrent("JP 01", start.Add(10*time.Minute))
+	s.recordCurrentTest(200)
+	s.recordCycle(0)
+
+	got := s.summary(start.Add(15 * time.Minute))
+	for _, want := range []string{
+		"运行时间: 15m0s",
+		"选择轮数: 2",
+		"切换次数: 1",
+		"使用最久的节点: HK 01 (10m0s)",
+		"当前节点平均延迟: 150ms",
+		"失败的测试: 3",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("summary() = %s, missing %q", got, want)
+		}
+	}
+}
+
+func TestSessionStatsEmpty(t *testing.T) {
+	start := time.Now()
+	got := newSessionStats(start).summary(start)
+	if !strings.Contains(got, "使用最久的节点: 无") || !strings.Contains(got, "当前节点平均延迟: 无") {
+		t.Errorf("summary() = %s", got)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"gopkg.in/yaml.v3"
+)
+
+// 直接测试节点时的超时时间
+const directTestTimeout = 5 * time.Second
+
+// 从 Clash 配置文件中读取节点名到服务器地址(host:port)的映射
+func loadNodeAddresses(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取节点地址文件失败: %v", err)
+	}
+	var clashConfig struct {
+		Proxies []struct {
+			Name   string `yaml:"name"`
+			Server string `yaml:"server"`
+			Port   int    `yaml:"port"`
+		} `yaml:"proxies"`
+	}
+	if err := yaml.Unmarshal(data, &clashConfig); err != nil {
+		return nil, fmt.Errorf("解析节点地址文件失败: %v", err)
+	}
+	addresses := make(map[string]string)
+	for _, proxy := range clashConfig.Proxies {
+		if proxy.Server != "" {
+			addresses[proxy.Name] = net.JoinHostPort(proxy.Server, strconv.Itoa(proxy.Port))
+		}
+	}
+	return addresses, nil
+}
+
+// 测量与节点服务器建立 TCP 连接的耗时
+func tcpPing(ctx context.Context, node *ProxyNode) (int, error) {
+	if node.Address == "" {
+		return -1, fmt.Errorf("%w: 缺少节点 %s 的服务器地址", ErrNodeNotFound, node.Name)
+	}
+	start := time.Now()
+	dialer := net.Dialer{Timeout: directTestTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", node.Address)
+	if err != nil {
+		return -1, fmt.Errorf("连接节点失败: %v", err)
+	}
+	conn.Close()
+	return max(int(time.Since(start).Milliseconds()), 1), nil
+}
+
+// 向节点服务器发送 ICMP Echo 测量往返时间, 使用无需 root 权限的 UDP ICMP 套接字,
+// Linux 下需要 net.ipv4.ping_group_range 包含当前用户组
+func icmpPing(ctx context.Context, node *ProxyNode) (int, error) {
+	if node.Address == "" {
+		return -1, fmt.Errorf("%w: 缺少节点 %s 的服务器地址", ErrNodeNotFound, node.Name)
+	}
+	host, _, err := net.SplitHostPort(node.Address)
+	if err != nil {
+		return -1, err
+	}
+	ip, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return -1, fmt.Errorf("解析节点地址失败: %v", err)
+	}
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		return -1, fmt.Errorf("创建 ICMP 套接字失败(可能没有权限): %v", err)
+	}
+	defer conn.Close()
+	// ctx 取消时关闭套接字, 中断等待响应
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: 1, Data: []byte("autoclash")},
+	}
+	data, _ := msg.Marshal(nil)
+	start := time.Now()
+	if _, err := conn.WriteTo(data, &net.UDPAddr{IP: ip.IP}); err != nil {
+		return -1, fmt.Errorf("发送 ICMP 请求失败: %v", err)
+	}
+	conn.SetReadDeadline(start.Add(directTestTimeout))
+	reply := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(reply)
+		if err != nil {
+			return -1, fmt.Errorf("等待 ICMP 响应失败: %v", err)
+		}
+		parsed, err := icmp.ParseMessage(1, reply[:n])
+		if err == nil && parsed.Type == ipv4.ICMPTypeEchoReply {
+			return max(int(time.Since(start).Milliseconds()), 1), nil
+		}
+	}
+}
+
+// 经 Clash 的入站端口(HTTP 或 SOCKS5 代理)访问测试 URL, 返回收到响应头的耗时。
+// 测试经过的节点由 Clash 的规则决定, 而不是指定的节点, 因此只用于测试当前节点
+func proxyDelay(ctx context.Context, proxy, testURL string) (int, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return -1, fmt.Errorf("current_test_proxy 无效: %v", err)
+	}
+	client := &http.Client{
+		Timeout: time.Duration(gConfig.TestTimeoutMS) * time.Millisecond,
+		// 每次测试都建立新连接, 与控制器的测试一致
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true},
+		// 不跟随重定向, 以便检查测试 URL 本身的状态码
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	req, err := http.NewRequestWithContext(ctx, cmp.Or(gConfig.TestURLOptions[testURL].Method, http.MethodGet), testURL, nil)
+	if err != nil {
+		return -1, fmt.Errorf("创建请求失败: %v", err)
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return -1, fmt.Errorf("经入站端口测试失败: %v", err)
+	}
+	resp.Body.Close()
+	delay := max(int(time.Since(start).Milliseconds()), 1)
+	if expect := expectStatusFor(testURL); !statusExpected(resp.StatusCode, expect) {
+		return -1, fmt.Errorf("经入站端口测试失败: 状态码 %d 不符合 %s", resp.StatusCode, expect)
+	}
+	return delay, nil
+}
+
+// 测试 URL 期望的状态码: test_url_options 中为该 URL 设置的优先, 否则为 test_expect_status
+func expectStatusFor(testURL string) string {
+	return cmp.Or(gConfig.TestURLOptions[testURL].ExpectStatus, gConfig.TestExpectStatus)
+}
+
+// 状态码是否符合 test_expect_status, 未配置时小于 400 即可
+func statusExpected(code int, expect string) bool {
+	if expect == "" {
+		return code < 400
+	}
+	for _, part := range strings.Split(expect, "/") {
+		low, high, found := strings.Cut(part, "-")
+		if !found {
+			high = low
+		}
+		lo, _ := strconv.Atoi(low)
+		hi, _ := strconv.Atoi(high)
+		if code >= lo && code <= hi {
+			return true
+		}
+	}
+	return false
+}
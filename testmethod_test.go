@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadNodeAddresses(t *testing.T) {
+	path := t.TempDir() + "/clash.yml"
+	os.WriteFile(path, []byte(`proxies:
+  - {name: "HK 01", type: ss, server: hk.example.com, port: 8388}
+  - {name: "v6", type: trojan, server: "2001:db8::1", port: 443}
+  - {name: "no server", type: direct}
+`), 0644)
+	addresses, err := loadNodeAddresses(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"HK 01": "hk.example.com:8388", "v6": "[2001:db8::1]:443"}
+	if len(addresses) != len(want) {
+		t.Fatalf("addresses = %v, want %v", addresses, want)
+	}
+	for name, addr := range want {
+		if addresses[name] != addr {
+			t.Errorf("addresses[%q] = %q, want %q", name, addresses[name], addr)
+		}
+	}
+}
+
+func TestTCPPing(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	gConfig = &Config{TestMethod: "tcp"}
+	if delay, err := testNode(context.Background(), &ProxyNode{Name: "local", Address: listener.Addr().String()}); err != nil || delay <= 0 {
+		t.Errorf("testNode() = %d, %v, want a positive delay", delay, err)
+	}
+	if _, err := testNode(context.Background(), &ProxyNode{Name: "unknown"}); !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("testNode() without address error = %v, want ErrNodeNotFound", err)
+	}
+}
+
+func TestProxyDelay(t *testing.T) {
+	var requested string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+		if strings.HasSuffix(r.URL.Path, "generate_204") {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+	gConfig = &Config{TestTimeoutMS: 1000, TestExpectStatus: "204"}
+
+	if delay, err := proxyDelay(context.Background(), proxy.URL, "http://www.gstatic.com/generate_204"); err != nil || delay <= 0 {
+		t.Errorf("proxyDelay() = %d, %v, want a positive delay", delay, err)
+	}
+	if requested != "http://www.gstatic.com/generate_204" {
+		t.Errorf("proxy received %q, want the test URL", requested)
+	}
+	if _, err := proxyDelay(context.Background(), proxy.URL, "http://www.gstatic.com/portal"); err == nil {
+		t.Error("proxyDelay() should fail when the status is not 204")
+	}
+}
+
+func TestProxyDelayURLOptions(t *testing.T) {
+	var method string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+	gConfig = &Config{TestTimeoutMS: 1000, TestExpectStatus: "204", TestURLOptions: testURLOptions{
+		"http://www.netflix.com/": {ExpectStatus: "200-299", Method: http.MethodHead},
+	}}
+	for _, tt := range []struct {
+		options string
+		wantErr bool
+	}{
+		{`{"http://www.netflix.com/": {expect_status: "200-299", method: HEAD}}`, false},
+		{`{"http://www.netflix.com/": {method: POST}}`, true},
+		{`{"http://www.netflix.com/": {expect_status: "2xx"}}`, true},
+	} {
+		if _, err := loadConfig(writeTestConfig(t, "test_url_options: "+tt.options+"\n")); (err != nil) != tt.wantErr {
+			t.Errorf("loadConfig(test_url_options: %s) error = %v, wantErr %v", tt.options, err, tt.wantErr)
+		}
+	}
+
+	if _, err := proxyDelay(context.Background(), proxy.URL, "http://www.netflix.com/"); err != nil || method != http.MethodHead {
+		t.Errorf("proxyDelay() with its own expect_status = %v, method %s, want success with HEAD", err, method)
+	}
+	if _, err := proxyDelay(context.Background(), proxy.URL, "http://www.gstatic.com/generate_204"); err == nil || method != http.MethodGet {
+		t.Errorf("proxyDelay() with the global expect status = %v, method %s, want a failure with GET", err, method)
+	}
+}
+
+func TestStatusExpected(t *testing.T) {
+	tests := []struct {
+		code   int
+		expect string
+		want   bool
+	}{
+		{204, "", true},
+		{302, "", true},
+		{404, "", false},
+		{204, "204", true},
+		{200, "204", false},
+		{250, "204/200-299", true},
+		{302, "204/200-299", false},
+	}
+	for _, tt := range tests {
+		if got := statusExpected(tt.code, tt.expect); got != tt.want {
+			t.Errorf("statusExpected(%d, %q) = %v, want %v", tt.code, tt.expect, got, tt.want)
+		}
+	}
+}
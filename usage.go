@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// 最近使用时长每隔 usageHalfLife 减半
+const usageHalfLife = time.Hour
+
+// 节点截至 at 的最近使用时长(分钟, 已衰减)
+type usage struct {
+	minutes float64
+	at      time.Time
+}
+
+var gUsage = make(map[string]usage)
+var gUsageCurrent string  // 正在计时的当前节点
+var gUsageSince time.Time // 当前节点开始计时的时间
+
+// 衰减到 now 的使用时长
+func (u usage) decayed(now time.Time) float64 {
+	if u.at.IsZero() {
+		return 0
+	}
+	return u.minutes * math.Exp2(-now.Sub(u.at).Hours()/usageHalfLife.Hours())
+}
+
+// 当前节点变为 name, 把上一个节点的使用时长计入 gUsage
+func recordUsage(name string, now time.Time) {
+	if gUsageCurrent != "" {
+		u := gUsage[gUsageCurrent]
+		gUsage[gUsageCurrent] = usage{minutes: u.decayed(now) + now.Sub(gUsageSince).Minutes(), at: now}
+	}
+	gUsageCurrent, gUsageSince = name, now
+}
+
+// 节点的最近使用时长(分钟), 包括作为当前节点尚未计入的时间
+func recentUsage(name string, now time.Time) float64 {
+	minutes := gUsage[name].decayed(now)
+	if name == gUsageCurrent {
+		minutes += now.Sub(gUsageSince).Minutes()
+	}
+	return minutes
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// 预热期间两轮测试的最长间隔, 使预热期内能完成多轮测试
+const warmupSweepInterval = 30 * time.Second
+
+// 预热期间每个节点累计的测试样本和测试次数
+type warmupStats struct {
+	samples  []int
+	attempts int
+}
+
+var gWarmup = make(map[string]*warmupStats) // 预热结束后清空
+var gWarmupRounds int                       // 预热期间完成的测试轮数
+var gWarmupDone bool
+
+// 是否处于预热期。预热期间只测试不切换节点, 预热时间过后的第一轮测试完成时结束
+func warmingUp() bool {
+	return gConfig.WarmupDuration > 0 && !gWarmupDone
+}
+
+// 预热期间把本轮结果并入累计结果, 用累计的样本计算节点的延迟、抖动、成功次数和丢包率, 避免根据一轮有波动的测试做第一次选择。
+// now 超过预热时间后这一轮是最后一轮, 之后恢复为只使用每轮自己的结果
+func mergeWarmup(targets []*ProxyNode, results [][]int, attempts []int, now time.Time) {
+	if !warmingUp() {
+		return
+	}
+	for i, node := range targets {
+		stats := gWarmup[node.Name]
+		if stats == nil {
+			stats = &warmupStats{}
+			gWarmup[node.Name] = stats
+		}
+		stats.samples = append(stats.samples, results[i]...)
+		stats.attempts += attempts[i]
+		node.Success = len(stats.samples)
+		node.Latency, node.Jitter = summarizeSamples(stats.samples)
+		node.Loss = float64(stats.attempts-node.Success) / float64(max(stats.attempts, 1))
+	}
+	gWarmupRounds++
+	if now.Sub(gStartedAt) < time.Duration(gConfig.WarmupDuration)*time.Second {
+		log.Printf("B 预热中, 已完成 %d 轮测试", gWarmupRounds)
+		return
+	}
+	log.Printf("B 预热结束, 根据 %d 轮测试的累计结果选择最优节点", gWarmupRounds)
+	gWarmupDone = true
+	gWarmup = nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMergeWarmup(t *testing.T) {
+	gConfig = &Config{WarmupDuration: 60, TestTimes: 2}
+	start := time.Now()
+	startedAt := gStartedAt
+	gStartedAt = start
+	gWarmup, gWarmupRounds, gWarmupDone = make(map[string]*warmupStats), 0, false
+	t.Cleanup(func() {
+		gStartedAt = startedAt
+		gWarmup, gWarmupRounds, gWarmupDone = make(map[string]*warmupStats), 0, false
+	})
+
+	node := &ProxyNode{Name: "HK 01"}
+	mergeWarmup([]*ProxyNode{node}, [][]int{{100, 300}}, []int{2}, start.Add(time.Second))
+	if !warmingUp() || node.Latency != 200 {
+		t.Fatalf("after the first round: warming up %v, latency %d", warmingUp(), node.Latency)
+	}
+	if err := switchCurrent(node, "T"); !errors.Is(err, errStartupGrace) {
+		t.Errorf("switchCurrent() during warm-up = %v, want errStartupGrace", err)
+	}
+	if !takeSnapshot().WarmingUp {
+		t.Error("status does not show warming up")
+	}
+	// 预热时间过后的一轮仍按累计结果计算, 然后结束预热
+	mergeWarmup([]*ProxyNode{node}, [][]int{{80}}, []int{2}, start.Add(time.Minute))
+	if warmingUp() || node.Latency != 160 || node.Success != 3 || node.Loss != 0.25 {
+		t.Errorf("after warm-up: warming up %v, latency %d, success %d, loss %v, want 160, 3 and 0.25", warmingUp(), node.Latency, node.Success, node.Loss)
+	}
+	// 预热结束后不再累计
+	mergeWarmup([]*ProxyNode{node}, [][]int{{50}}, []int{1}, start.Add(2*time.Minute))
+	if node.Latency != 160 || gWarmupRounds != 2 {
+		t.Errorf("merged after warm-up: latency %d, rounds %d", node.Latency, gWarmupRounds)
+	}
+}
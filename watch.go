@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// watch 命令连接失败时输出的内容
+const watchOffline = "autoclash 未运行"
+
+// unix socket 形式的状态服务地址的前缀, 如 unix:/run/autoclash.sock
+const unixAddrPrefix = "unix:"
+
+// 状态服务的地址, 只有端口时连接本机。unix socket 时 URL 中的主机名不使用, 由 statusClient 拨号
+func statusURL(addr string) string {
+	if strings.HasPrefix(addr, unixAddrPrefix) {
+		return "http://autoclash"
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	return "http://" + addr
+}
+
+// 连接状态服务的客户端, unix:/path 形式的地址经 unix socket 连接
+func statusClient(addr string, timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if path, ok := strings.CutPrefix(addr, unixAddrPrefix); ok {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		}
+	}
+	return client
+}
+
+// 从运行中的 autoclash 获取状态
+func fetchStatus(client *http.Client, baseURL string) (statusSnapshot, error) {
+	var snapshot statusSnapshot
+	resp, err := client.Get(baseURL + "/status")
+	if err != nil {
+		return snapshot, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return snapshot, fmt.Errorf("状态码: %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&snapshot)
+	return snapshot, err
+}
+
+// 状态栏显示的一行: 当前节点和最近一次检查的延迟
+func formatWatchLine(snapshot statusSnapshot) string {
+	switch {
+	case snapshot.Current == "":
+		return "无当前节点"
+	case snapshot.CurrentLatency > 0:
+		return fmt.Sprintf("%s %dms", snapshot.Current, snapshot.CurrentLatency)
+	}
+	return snapshot.Current
+}
+
+// 每隔 interval 获取一次状态, 内容变化时输出一行, 直到 ctx 结束。
+// 连接失败时输出 watchOffline 并继续重试, autoclash 重启后自动恢复
+func runWatch(ctx context.Context, client *http.Client, baseURL string, interval time.Duration, w io.Writer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := ""
+	for {
+		line := watchOffline
+		if snapshot, err := fetchStatus(client, baseURL); err == nil {
+			line = formatWatchLine(snapshot)
+		}
+		if line != last {
+			fmt.Fprintln(w, line)
+			last = line
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func newWatchCmd(configPath *string) *cobra.Command {
+	var addr string
+	var interval time.Duration
+	cmd := &cobra.Command{
+		Use:   "watch",
+		Short: "持续输出当前节点和延迟, 每次变化输出一行, 适合 tmux / polybar 等状态栏",
+		Run: func(cmd *cobra.Command, args []string) {
+			if addr == "" {
+				config, err := loadConfig(*configPath)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "加载配置失败: %v\n", err)
+					os.Exit(1)
+				}
+				addr = config.StatusAddr
+			}
+			if addr == "" {
+				fmt.Fprintln(os.Stderr, "需要在配置中设置 status_addr 或使用 --addr 指定状态服务地址")
+				os.Exit(1)
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			interval = max(interval, 100*time.Millisecond)
+			runWatch(ctx, statusClient(addr, interval), statusURL(addr), interval, os.Stdout)
+		},
+	}
+	cmd.Flags().StringVar(&addr, "addr", "", "状态服务地址, 如 127.0.0.1:9091 或 unix:/path, 默认为配置中的 status_addr")
+	cmd.Flags().DurationVar(&interval, "interval", 2*time.Second, "获取状态的间隔")
+	return cmd
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 并发安全的输出缓冲
+type syncBuffer struct {
+	mu sync.Mutex
+	sb strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sb.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sb.String()
+}
+
+func TestRunWatch(t *testing.T) {
+	var lock sync.Mutex
+	snapshot := statusSnapshot{Current: "HK 01", CurrentLatency: 80}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		json.NewEncoder(w).Encode(snapshot)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var out syncBuffer
+	done := make(chan struct{})
+	go func() {
+		runWatch(ctx, &http.Client{Timeout: 20 * time.Millisecond}, server.URL, 20*time.Millisecond, &out)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	snapshot = statusSnapshot{Current: "JP 01", CurrentLatency: -1}
+	lock.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	server.Close()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	want := "HK 01 80ms\nJP 01\n" + watchOffline + "\n"
+	if got := out.String(); got != want {
+		t.Errorf("runWatch() output = %q, want %q", got, want)
+	}
+}
+
+func TestStatusURL(t *testing.T) {
+	if got := statusURL(":9091"); got != "http://127.0.0.1:9091" {
+		t.Errorf("statusURL() = %s", got)
+	}
+	if got := statusURL("10.0.0.2:9091"); got != "http://10.0.0.2:9091" {
+		t.Errorf("statusURL() = %s", got)
+	}
+	if got := statusURL("unix:/run/autoclash.sock"); got != "http://autoclash" {
+		t.Errorf("statusURL() = %s", got)
+	}
+}
+
+func TestStatusUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "autoclash.sock")
+	addr := unixAddrPrefix + path
+	// 留下的旧 socket 文件不影响监听
+	stale, err := statusListener(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := statusListener(addr)
+	if err != nil {
+		t.Fatalf("statusListener() with a stale socket: %v", err)
+	}
+	defer listener.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+	// 创建 socket 用的临时目录已删除
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("socket directory has %d entries, want only the socket", len(entries))
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(statusSnapshot{Current: "HK 01"})
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	snapshot, err := fetchStatus(statusClient(addr, time.Second), statusURL(addr))
+	if err != nil || snapshot.Current != "HK 01" {
+		t.Errorf("fetchStatus() over unix socket = %+v, %v", snapshot, err)
+	}
+}